@@ -0,0 +1,190 @@
+package timeturner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var aggregateFunctions = map[string]bool{
+	"count": true,
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+}
+
+type Aggregate struct {
+	Function string
+	Column   string
+}
+
+func (aggregate Aggregate) Name() string {
+	if aggregate.Column == "" {
+		return aggregate.Function
+	}
+	return fmt.Sprintf("%s(%s)", aggregate.Function, aggregate.Column)
+}
+
+// parseAggregates parses a comma-separated list like "count,sum:rss,max:cpu".
+func parseAggregates(spec string) ([]Aggregate, error) {
+	aggregates := make([]Aggregate, 0)
+	for _, item := range splitList(spec) {
+		parts := strings.SplitN(item, ":", 2)
+		aggregate := Aggregate{Function: strings.ToLower(parts[0])}
+		if len(parts) == 2 {
+			aggregate.Column = parts[1]
+		}
+		if !aggregateFunctions[aggregate.Function] {
+			return nil, fmt.Errorf("Unknown aggregate function %q", parts[0])
+		}
+		if aggregate.Column == "" && aggregate.Function != "count" {
+			return nil, fmt.Errorf("Aggregate function %q requires a column", aggregate.Function)
+		}
+		aggregates = append(aggregates, aggregate)
+	}
+	if len(aggregates) == 0 {
+		aggregates = append(aggregates, Aggregate{Function: "count"})
+	}
+	return aggregates, nil
+}
+
+func splitList(spec string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseNumber parses a cell holding a finite decimal number, ignoring surrounding spaces. NaN,
+// infinities and hex floats, which strconv.ParseFloat also accepts, aren't treated as numbers.
+func parseNumber(cell string) (float64, bool) {
+	trimmed := strings.TrimSpace(cell)
+	if trimmed == "" || strings.Trim(trimmed, "0123456789+-.eE") != "" {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(trimmed, 64)
+	return value, err == nil
+}
+
+func formatNumber(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// accumulator tracks one aggregate over one group. Cells that aren't numeric are ignored, like
+// NULLs in SQL.
+type accumulator struct {
+	rowCount     int
+	numericCount int
+	sum          float64
+	min          float64
+	max          float64
+}
+
+func (acc *accumulator) add(cell string, isCount bool) {
+	acc.rowCount++
+	if isCount {
+		return
+	}
+	value, ok := parseNumber(cell)
+	if !ok {
+		return
+	}
+	if acc.numericCount == 0 || value < acc.min {
+		acc.min = value
+	}
+	if acc.numericCount == 0 || value > acc.max {
+		acc.max = value
+	}
+	acc.numericCount++
+	acc.sum += value
+}
+
+func (acc *accumulator) result(function string) string {
+	if function == "count" {
+		return strconv.Itoa(acc.rowCount)
+	}
+	if acc.numericCount == 0 {
+		return ""
+	}
+	switch function {
+	case "sum":
+		return formatNumber(acc.sum)
+	case "avg":
+		return formatNumber(acc.sum / float64(acc.numericCount))
+	case "min":
+		return formatNumber(acc.min)
+	default:
+		return formatNumber(acc.max)
+	}
+}
+
+type aggregateGroup struct {
+	key          []string
+	accumulators []accumulator
+}
+
+func aggregateRows(columnNames []string, data [][]string, groupColumns []string,
+	aggregates []Aggregate) (resultColumns []string, result [][]string, err error) {
+	groupIndexes := make([]int, len(groupColumns))
+	for index, columnName := range groupColumns {
+		if groupIndexes[index] = findColumnIndex(columnNames, columnName); groupIndexes[index] < 0 {
+			return nil, nil, fmt.Errorf("Unknown group-by column %q", columnName)
+		}
+	}
+	aggregateIndexes := make([]int, len(aggregates))
+	for index, aggregate := range aggregates {
+		aggregateIndexes[index] = -1
+		if aggregate.Column != "" {
+			aggregateIndexes[index] = findColumnIndex(columnNames, aggregate.Column)
+			if aggregateIndexes[index] < 0 {
+				return nil, nil, fmt.Errorf("Unknown aggregate column %q", aggregate.Column)
+			}
+		}
+	}
+
+	groups := make([]*aggregateGroup, 0)
+	groupMap := make(map[string]*aggregateGroup)
+	for _, row := range data {
+		key := make([]string, len(groupIndexes))
+		for index, columnIndex := range groupIndexes {
+			key[index] = cellAt(row, columnIndex)
+		}
+		mapKey := dumpCsv([][]string{key})
+		group, seen := groupMap[mapKey]
+		if !seen {
+			group = &aggregateGroup{key, make([]accumulator, len(aggregates))}
+			groupMap[mapKey] = group
+			groups = append(groups, group)
+		}
+		for index, aggregate := range aggregates {
+			group.accumulators[index].add(
+				cellAt(row, aggregateIndexes[index]), aggregate.Function == "count",
+			)
+		}
+	}
+
+	resultColumns = append(resultColumns, groupColumns...)
+	for _, aggregate := range aggregates {
+		resultColumns = append(resultColumns, aggregate.Name())
+	}
+	result = make([][]string, 0, len(groups))
+	for _, group := range groups {
+		row := append([]string{}, group.key...)
+		for index, aggregate := range aggregates {
+			row = append(row, group.accumulators[index].result(aggregate.Function))
+		}
+		result = append(result, row)
+	}
+	return resultColumns, result, nil
+}
+
+func cellAt(row []string, index int) string {
+	if index < 0 || index >= len(row) {
+		return ""
+	}
+	return row[index]
+}
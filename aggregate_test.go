@@ -0,0 +1,72 @@
+package timeturner
+
+import (
+	"testing"
+)
+
+func TestParseAggregates(t *testing.T) {
+	aggregates, err := parseAggregates("count, sum:rss,MAX:cpu")
+	if err != nil {
+		t.Fatalf("Got error parsing aggregates: %v", err)
+	}
+	names := make([]string, 0)
+	for _, aggregate := range aggregates {
+		names = append(names, aggregate.Name())
+	}
+	if !areStringsEqual(names, []string{"count", "sum(rss)", "max(cpu)"}) {
+		t.Fatalf("Unexpected aggregates %v", names)
+	}
+
+	aggregates, _ = parseAggregates("")
+	if len(aggregates) != 1 || aggregates[0].Name() != "count" {
+		t.Fatalf("Expected default count aggregate, got %v", aggregates)
+	}
+
+	for _, spec := range []string{"median:rss", "sum"} {
+		if _, err := parseAggregates(spec); err == nil {
+			t.Fatalf("No error for invalid aggregate %q", spec)
+		}
+	}
+}
+
+func TestAggregateRows(t *testing.T) {
+	columnNames := []string{"user", "command", "rss"}
+	data := [][]string{
+		{"root", "init", "10"},
+		{"steve", "vim", "200"},
+		{"root", "sshd", "30"},
+		{"steve", "bash", "-"},
+	}
+	aggregates := []Aggregate{{"count", ""}, {"sum", "rss"}, {"avg", "rss"}, {"min", "rss"}}
+	resultColumns, result, err := aggregateRows(columnNames, data, []string{"user"}, aggregates)
+	if err != nil {
+		t.Fatalf("Got error aggregating rows: %v", err)
+	}
+	if !areStringsEqual(resultColumns, []string{"user", "count", "sum(rss)", "avg(rss)", "min(rss)"}) {
+		t.Fatalf("Unexpected columns %v", resultColumns)
+	}
+	isDataOk := len(result) == 2 &&
+		areStringsEqual(result[0], []string{"root", "2", "40", "20", "10"}) &&
+		areStringsEqual(result[1], []string{"steve", "2", "200", "200", "200"})
+	if !isDataOk {
+		t.Fatalf("Unexpected data %v", result)
+	}
+
+	_, _, err = aggregateRows(columnNames, data, []string{"nonexistent"}, aggregates)
+	if err == nil {
+		t.Fatalf("No error for unknown group-by column")
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	for _, cell := range []string{"12", " 12 ", "-1.5", "1e3", ".5"} {
+		if _, ok := parseNumber(cell); !ok {
+			t.Errorf("%q wasn't parsed as a number", cell)
+		}
+	}
+	for _, cell := range []string{"", "NaN", "Inf", "-Infinity", "0x1p4", "1e999", "1_000", "-"} {
+		if value, ok := parseNumber(cell); ok {
+			t.Errorf("%q was parsed as %v", cell, value)
+		}
+	}
+}
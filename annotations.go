@@ -0,0 +1,118 @@
+package timeturner
+
+import (
+	"strings"
+	"time"
+)
+
+// Annotation describes what happened from StartUnixTimestamp (inclusive) to EndUnixTimestamp
+// (exclusive), like "DB failover", and shows up on the pages for snapshots in that window.
+// UnixTimestamp is when it was written and Identity who wrote it.
+type Annotation struct {
+	Id                 int64
+	UnixTimestamp      int64
+	StartUnixTimestamp int64
+	EndUnixTimestamp   int64
+	Text               string
+	Identity           string
+}
+
+func (annotation Annotation) Timestamp() time.Time {
+	return time.Unix(annotation.UnixTimestamp, 0)
+}
+
+func (annotation Annotation) Start() time.Time {
+	return time.Unix(annotation.StartUnixTimestamp, 0)
+}
+
+func (annotation Annotation) End() time.Time {
+	return time.Unix(annotation.EndUnixTimestamp, 0)
+}
+
+func (annotation Annotation) Covers(timestamp time.Time) bool {
+	return annotation.StartUnixTimestamp <= timestamp.Unix() &&
+		timestamp.Unix() < annotation.EndUnixTimestamp
+}
+
+// AddAnnotation stores the annotation, stamped with the current time, and returns it with its Id.
+func (database *TimeturnerDatabase) AddAnnotation(annotation Annotation) Annotation {
+	annotation.Id = -1
+	annotation.UnixTimestamp = database.nowFunc().Unix()
+	if err := database.mapper.Insert(&annotation); err != nil {
+		panic(err)
+	}
+	return annotation
+}
+
+// UpdateAnnotation replaces an annotation's window and text, reporting false if it doesn't exist.
+func (database *TimeturnerDatabase) UpdateAnnotation(annotation Annotation) bool {
+	result, err := database.mapper.Exec(
+		"UPDATE Annotation SET StartUnixTimestamp = ?, EndUnixTimestamp = ?, Text = ? WHERE Id = ?",
+		annotation.StartUnixTimestamp, annotation.EndUnixTimestamp, annotation.Text, annotation.Id,
+	)
+	if err != nil {
+		panic(err)
+	}
+	rowCount, err := result.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	return rowCount > 0
+}
+
+func (database *TimeturnerDatabase) GetAnnotation(id int64) (annotation Annotation, ok bool) {
+	result, err := database.mapper.Get(Annotation{}, id)
+	if err != nil {
+		panic(err)
+	}
+	if result == nil {
+		return Annotation{}, false
+	}
+	return *result.(*Annotation), true
+}
+
+func (database *TimeturnerDatabase) DeleteAnnotation(id int64) (annotation Annotation, ok bool) {
+	annotation, ok = database.GetAnnotation(id)
+	if ok {
+		if _, err := database.mapper.Delete(&annotation); err != nil {
+			panic(err)
+		}
+	}
+	return
+}
+
+func (database *TimeturnerDatabase) selectAnnotations(query string,
+	args ...interface{}) []Annotation {
+	var annotations []Annotation
+	if _, err := database.mapper.Select(&annotations, query, args...); err != nil {
+		panic(err)
+	}
+	return annotations
+}
+
+// GetAnnotations returns the annotations overlapping start (inclusive) to end (exclusive), in
+// order of their start.
+func (database *TimeturnerDatabase) GetAnnotations(start time.Time, end time.Time) []Annotation {
+	return database.selectAnnotations(
+		"SELECT * FROM Annotation WHERE StartUnixTimestamp < ? AND EndUnixTimestamp > ? "+
+			"ORDER BY StartUnixTimestamp, Id",
+		end.Unix(), start.Unix(),
+	)
+}
+
+// SearchAnnotations returns the annotations whose text contains the query, ignoring case, latest
+// windows first. An empty query matches every annotation.
+func (database *TimeturnerDatabase) SearchAnnotations(query string) []Annotation {
+	pattern := "%" + escapeLikePattern(query) + "%"
+	return database.selectAnnotations(
+		"SELECT * FROM Annotation WHERE Text LIKE ? ESCAPE '\\' "+
+			"ORDER BY StartUnixTimestamp DESC, Id DESC",
+		pattern,
+	)
+}
+
+var likePatternEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLikePattern(text string) string {
+	return likePatternEscaper.Replace(text)
+}
@@ -0,0 +1,59 @@
+package timeturner
+
+import (
+	"testing"
+	"time"
+)
+
+func addTestAnnotation(database Database, start time.Time, minutes int, text string) Annotation {
+	return database.AddAnnotation(Annotation{
+		StartUnixTimestamp: start.Unix(),
+		EndUnixTimestamp:   start.Add(time.Duration(minutes) * time.Minute).Unix(),
+		Text:               text,
+	})
+}
+
+func TestAnnotations(t *testing.T) {
+	database := setUp()
+	failover := addTestAnnotation(database, now.Add(14*time.Hour), 8, "DB failover")
+	addTestAnnotation(database, now.Add(13*time.Hour), 120, "Deploy at 100% traffic")
+	addTestAnnotation(database, now.AddDate(0, 0, 1), 10, "Next day")
+
+	overlapping := database.GetAnnotations(now.Add(14*time.Hour), now.Add(14*time.Hour+time.Second))
+	if len(overlapping) != 2 || overlapping[0].Text != "Deploy at 100% traffic" ||
+		overlapping[1].Id != failover.Id {
+		t.Fatalf("Unexpected overlapping annotations: %v", overlapping)
+	}
+	after := database.GetAnnotations(now.Add(15*time.Hour), now.Add(16*time.Hour))
+	if len(after) != 0 {
+		t.Fatalf("Annotations overlapped a later window: %v", after)
+	}
+
+	found := database.SearchAnnotations("failover")
+	if len(found) != 1 || found[0].Id != failover.Id {
+		t.Fatalf("Unexpected search results: %v", found)
+	}
+	if found = database.SearchAnnotations("0% "); len(found) != 1 {
+		t.Fatalf("Search didn't treat %% literally: %v", found)
+	}
+	if found = database.SearchAnnotations(""); len(found) != 3 || found[0].Text != "Next day" {
+		t.Fatalf("Unexpected annotations listed: %v", found)
+	}
+
+	failover.Text = "DB failover to replica"
+	if !database.UpdateAnnotation(failover) {
+		t.Fatalf("Failed to update annotation")
+	}
+	if updated, ok := database.GetAnnotation(failover.Id); !ok || updated.Text != failover.Text {
+		t.Fatalf("Unexpected updated annotation: %v, %v", updated, ok)
+	}
+	if _, ok := database.DeleteAnnotation(failover.Id); !ok {
+		t.Fatalf("Failed to delete annotation")
+	}
+	if database.UpdateAnnotation(failover) {
+		t.Fatalf("Updated a deleted annotation")
+	}
+	if _, ok := database.GetAnnotation(failover.Id); ok {
+		t.Fatalf("Found a deleted annotation")
+	}
+}
@@ -1,18 +1,24 @@
 package timeturner
 
 import (
+	"errors"
 	"github.com/gorilla/mux"
 	"html/template"
-	"log"
+	"io/ioutil"
 	"net/http"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 type App struct {
-	Database  Database
-	Router    *mux.Router
-	Templates *template.Template
+	Database    Database
+	Authorizer  Authorizer
+	Router      *mux.Router
+	Templates   *template.Template
+	Metrics     *Metrics
+	ClientCerts *ClientCertPolicy
+	Limiter     *IngestionLimiter
 }
 
 func parseTimestamp(urlVars map[string]string) (timestamp time.Time, err error) {
@@ -30,14 +36,40 @@ func parseTimestamp(urlVars map[string]string) (timestamp time.Time, err error)
 	return
 }
 
+func parseRangeBoundary(value string) (time.Time, error) {
+	if len(value) == len(DATE_FORMAT) {
+		return time.ParseInLocation(DATE_FORMAT, value, time.Local)
+	}
+	return time.ParseInLocation(DATE_FORMAT+" "+TIME_FORMAT, value, time.Local)
+}
+
+// parseTimeRange reads the "start" (inclusive) and "end" (exclusive) form values, each either a
+// date or a date and time.
+func parseTimeRange(form map[string]string) (start time.Time, end time.Time, err error) {
+	if form["start"] == "" || form["end"] == "" {
+		err = errors.New("start and end are required")
+		return
+	}
+	if start, err = parseRangeBoundary(form["start"]); err != nil {
+		return
+	}
+	if end, err = parseRangeBoundary(form["end"]); err != nil {
+		return
+	}
+	if !start.Before(end) {
+		err = errors.New("start must be before end")
+	}
+	return
+}
+
+// readRequestBody reads the whole body of a write, which may arrive over many reads.
 func readRequestBody(request *http.Request) (string, error) {
-	if request.Method == "PUT" {
-		contents := make([]byte, 1024*1024)
-		bytesRead, err := request.Body.Read(contents)
+	if request.Method == "PUT" || request.Method == "PATCH" || request.Method == "POST" {
+		contents, err := ioutil.ReadAll(request.Body)
 		if err != nil {
 			return "", err
 		}
-		return string(contents[:bytesRead]), nil
+		return string(contents), nil
 	} else {
 		return "", nil
 	}
@@ -53,25 +85,104 @@ func readFormValues(request *http.Request) map[string]string {
 }
 
 func (app App) WrapHandler(handler func(View)) http.HandlerFunc {
+	return app.WrapAuthorizedHandler("", handler)
+}
+
+// routeName is the name given in MakeApp to the route the request matched.
+func routeName(request *http.Request) string {
+	if route := mux.CurrentRoute(request); route != nil && route.GetName() != "" {
+		return route.GetName()
+	}
+	return UNNAMED_ROUTE
+}
+
+// finishRequest recovers from a panic in the handler, responding with a 500, then records the
+// request's latency in the metrics and writes it to the access log.
+func (app App) finishRequest(response *loggedResponse, request *http.Request,
+	entry *AccessLogEntry) {
+	if recovered := recover(); recovered != nil {
+		app.handlePanic(recovered, response, request, entry.RequestId, response.status != 0)
+	}
+	entry.Duration = time.Since(entry.Time)
+	app.Metrics.ObserveRequest(entry.Route, entry.Duration)
+	entry.Status = response.status
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+	entry.Bytes = response.bytes
+	AccessLog.Print(entry.Logfmt())
+}
+
+func (app App) WrapAuthorizedHandler(permission Permission, handler func(View)) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
-		log.Printf("Handling %v\n", request.URL)
 		vars := mux.Vars(request)
+		entry := &AccessLogEntry{
+			Time:      time.Now(),
+			RequestId: requestIdFor(request),
+			Method:    request.Method,
+			Route:     routeName(request),
+			Path:      request.URL.RequestURI(),
+			Client:    clientAddress(request),
+			Hostname:  vars["hostname"],
+			Title:     vars["title"],
+		}
+		writer.Header().Set(REQUEST_ID_HEADER, entry.RequestId)
+		response := &loggedResponse{ResponseWriter: writer}
+		defer app.finishRequest(response, request, entry)
+
+		identity, ok := app.Authorizer.Authorize(request, permission)
+		if !ok {
+			app.httpError(
+				response, request, entry.RequestId, "Not authorized to "+string(permission),
+				http.StatusForbidden,
+			)
+			return
+		}
+		changesHost := permission == WritePermission || permission == DeletePermission
+		if app.ClientCerts.Required && changesHost && vars["hostname"] != "" {
+			commonName, err := app.ClientCerts.AuthorizeHostname(request, vars["hostname"])
+			if err != nil {
+				app.httpError(
+					response, request, entry.RequestId, "Not authorized: "+err.Error(),
+					http.StatusForbidden,
+				)
+				return
+			}
+			if identity == "" {
+				identity = commonName
+			}
+		}
+		entry.Identity = identity
 
 		timestamp, err := parseTimestamp(vars)
 		if err != nil {
-			http.Error(writer, "Failed to parse timestamp: "+err.Error(), http.StatusBadRequest)
+			app.httpError(
+				response, request, entry.RequestId, "Failed to parse timestamp: "+err.Error(),
+				http.StatusBadRequest,
+			)
 			return
 		}
 
 		body, err := readRequestBody(request)
 		if err != nil {
-			http.Error(writer, "Failed to read request body: "+err.Error(), http.StatusBadRequest)
+			app.httpError(
+				response, request, entry.RequestId, "Failed to read request body: "+err.Error(),
+				http.StatusBadRequest,
+			)
 			return
 		}
 
+		// The body has been read, so ParseForm needs it back to read form-encoded values from it.
+		request.Body = ioutil.NopCloser(strings.NewReader(body))
 		formValues := readFormValues(request)
-		presenter := Presenter{app.Database, RequestInfo{vars, timestamp, formValues, body}}
-		view := View{app.Router, app.Templates, writer, presenter}
+		presenter := Presenter{
+			app.Database,
+			RequestInfo{
+				vars, timestamp, formValues, body, identity, entry.Client, request.Header,
+				entry.RequestId,
+			},
+		}
+		view := View{app.Router, app.Templates, response, presenter, app.Metrics, app.Limiter}
 
 		handler(view)
 	}
@@ -84,26 +195,170 @@ func LoadTemplates(router *mux.Router) *template.Template {
 	)
 }
 
-func MakeApp(database Database) App {
+func MakeApp(database Database, authorizer Authorizer) App {
 	router := mux.NewRouter()
-	app := App{Database: database, Router: router, Templates: LoadTemplates(router)}
+	app := App{
+		Database:    database,
+		Authorizer:  authorizer,
+		Router:      router,
+		Templates:   LoadTemplates(router),
+		Metrics:     NewMetrics(),
+		ClientCerts: NewClientCertPolicy(),
+		Limiter:     NewIngestionLimiter(time.Now),
+	}
+	if store, ok := database.(UsageStore); ok {
+		app.Limiter.UseStore(store)
+	}
 
+	// Health checks skip authorization and logging, since load balancers poll them constantly.
+	router.HandleFunc("/healthz", app.ServeHealth).Name("health").Methods("GET", "HEAD")
+	router.HandleFunc("/readyz", app.ServeReadiness).Name("readiness").Methods("GET", "HEAD")
 	router.HandleFunc("/", app.WrapHandler(func(v View) { v.ListDays() })).
 		Name("list days").
 		Methods("GET")
+	router.HandleFunc(
+		"/admin/audit/",
+		app.WrapAuthorizedHandler(AdminPermission, func(v View) { v.ListAuditEntries() }),
+	).
+		Name("audit log").
+		Methods("GET")
+	router.HandleFunc(
+		"/admin/audit.json",
+		app.WrapAuthorizedHandler(AdminPermission, func(v View) { v.ExportAuditEntries() }),
+	).
+		Name("export audit log").
+		Methods("GET")
+	router.HandleFunc(
+		"/admin/storage/",
+		app.WrapAuthorizedHandler(AdminPermission, func(v View) { v.StorageStats() }),
+	).
+		Name("storage stats").
+		Methods("GET")
+	router.HandleFunc(
+		"/admin/usage/",
+		app.WrapAuthorizedHandler(AdminPermission, func(v View) { v.Usage() }),
+	).
+		Name("usage").
+		Methods("GET")
+	router.HandleFunc("/metrics", app.WrapHandler(func(v View) { v.ExportMetrics() })).
+		Name("metrics").
+		Methods("GET")
+	router.HandleFunc(
+		"/hosts/{hostname}/",
+		app.WrapAuthorizedHandler(DeletePermission, func(v View) { v.DeleteHost() }),
+	).
+		Name("delete host").
+		Methods("DELETE")
+	router.HandleFunc(
+		"/titles/{title}/",
+		app.WrapAuthorizedHandler(DeletePermission, func(v View) { v.DeleteTitle() }),
+	).
+		Name("delete title").
+		Methods("DELETE")
+	router.HandleFunc(
+		"/timerange/",
+		app.WrapAuthorizedHandler(DeletePermission, func(v View) { v.DeleteTimeRange() }),
+	).
+		Name("delete time range").
+		Methods("DELETE")
+	router.HandleFunc("/pins/", app.WrapHandler(func(v View) { v.ListPins() })).
+		Name("pins").
+		Methods("GET")
+	router.HandleFunc(
+		"/pins/", app.WrapAuthorizedHandler(WritePermission, func(v View) { v.AddPin() }),
+	).
+		Name("add pin").
+		Methods("POST")
+	router.HandleFunc(
+		"/pins/{id:[0-9]+}/",
+		app.WrapAuthorizedHandler(WritePermission, func(v View) { v.DeletePin() }),
+	).
+		Name("delete pin").
+		Methods("DELETE")
+	router.HandleFunc("/annotations/", app.WrapHandler(func(v View) { v.SearchAnnotations() })).
+		Name("annotations").
+		Methods("GET")
+	router.HandleFunc(
+		"/annotations/",
+		app.WrapAuthorizedHandler(WritePermission, func(v View) { v.AddAnnotation() }),
+	).
+		Name("add annotation").
+		Methods("POST")
+	router.HandleFunc("/annotations.json", app.WrapHandler(func(v View) { v.ExportAnnotations() })).
+		Name("export annotations").
+		Methods("GET")
+	annotationRoute := "/annotations/{id:[0-9]+}/"
+	router.HandleFunc(annotationRoute, app.WrapHandler(func(v View) { v.ViewAnnotation() })).
+		Name("annotation").
+		Methods("GET")
+	router.HandleFunc(
+		annotationRoute,
+		app.WrapAuthorizedHandler(WritePermission, func(v View) { v.UpdateAnnotation() }),
+	).
+		Name("update annotation").
+		Methods("PUT")
+	router.HandleFunc(
+		annotationRoute,
+		app.WrapAuthorizedHandler(WritePermission, func(v View) { v.DeleteAnnotation() }),
+	).
+		Name("delete annotation").
+		Methods("DELETE")
 	router.HandleFunc("/{date}/", app.WrapHandler(func(v View) { v.ListTimes() })).
 		Name("list times on day").
 		Methods("GET")
 	router.HandleFunc("/{date}/{time}/", app.WrapHandler(func(v View) { v.ListSnapshots() })).
 		Name("list snapshots at time").
 		Methods("GET")
+	compareHosts := app.WrapHandler(func(v View) { v.CompareHosts() })
+	router.HandleFunc("/{date}/{time}/compare/{title}/", compareHosts).
+		Name("compare hosts").
+		Methods("GET")
 
 	snapshotRouter := router.PathPrefix("/{date}/{time}/{hostname}/{title}/").Subrouter()
 	snapshotRouter.HandleFunc("/", app.WrapHandler(func(v View) { v.ViewSnapshot() })).
 		Name("view snapshot").
 		Methods("GET")
-	snapshotRouter.HandleFunc("/", app.WrapHandler(func(v View) { v.AddSnapshot() })).
+	snapshotRouter.HandleFunc("/aggregate/", app.WrapHandler(func(v View) { v.AggregateSnapshot() })).
+		Name("aggregate snapshot").
+		Methods("GET")
+	snapshotRouter.HandleFunc(
+		"/export.{format:csv|tsv|json|xlsx}", app.WrapHandler(func(v View) { v.ExportSnapshot() }),
+	).
+		Name("export snapshot").
+		Methods("GET")
+	snapshotRouter.HandleFunc(
+		"/aggregate/export.{format:csv|tsv|json|xlsx}",
+		app.WrapHandler(func(v View) { v.ExportAggregate() }),
+	).
+		Name("export aggregate").
+		Methods("GET")
+	snapshotRouter.HandleFunc(
+		"/", app.WrapAuthorizedHandler(WritePermission, func(v View) { v.AddSnapshot() }),
+	).
+		Name("add snapshot").
 		Methods("PUT")
+	snapshotRouter.HandleFunc(
+		"/", app.WrapAuthorizedHandler(WritePermission, func(v View) { v.AppendRows() }),
+	).
+		Name("append rows").
+		Methods("PATCH", "POST")
+	snapshotRouter.HandleFunc(
+		"/", app.WrapAuthorizedHandler(DeletePermission, func(v View) { v.DeleteSnapshot() }),
+	).
+		Name("delete snapshot").
+		Methods("DELETE")
+
+	// Unknown paths get a plain 404, without WrapHandler reading their request bodies.
+	router.NotFoundHandler = http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			requestId := requestIdFor(request)
+			writer.Header().Set(REQUEST_ID_HEADER, requestId)
+			renderError(
+				app.Templates, writer, request.Header, requestId, http.StatusNotFound,
+				"There's no page here.",
+			)
+		},
+	)
 
 	return app
 }
@@ -1,6 +1,11 @@
 package timeturner
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
@@ -32,3 +37,92 @@ func TestParseTimestampWithInvalidDate(t *testing.T) {
 		t.Fatalf("No error for invalid date")
 	}
 }
+
+func TestParseTimeRange(t *testing.T) {
+	start, end, err := parseTimeRange(
+		map[string]string{"start": "2013-10-05", "end": "2013-10-05 15:32:44"},
+	)
+	assertTimestampResults(t, time.Date(2013, 10, 5, 0, 0, 0, 0, time.Local), start, err)
+	assertTimestampResults(t, time.Date(2013, 10, 5, 15, 32, 44, 0, time.Local), end, err)
+
+	invalidForms := []map[string]string{
+		{"start": "2013-10-05"},
+		{"start": "2013-10-06", "end": "2013-10-05"},
+		{"start": "yesterday", "end": "2013-10-05"},
+	}
+	for _, form := range invalidForms {
+		if _, _, err := parseTimeRange(form); err == nil {
+			t.Fatalf("No error for invalid time range %v", form)
+		}
+	}
+}
+
+func TestCompareHostsRoute(t *testing.T) {
+	database := setUp()
+	database.AddSnapshot(now, "*", "queries", wrapSimpleContents("star"), OverwriteOnConflict, Actor{})
+	database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("one"), OverwriteOnConflict,
+		Actor{})
+	handler := MakeApp(database, make(Authorizer)).Handler()
+
+	response := serveWithAccept(handler, "/2013-10-06/00:00:00/*/queries/", "text/html")
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "star") ||
+		strings.Contains(response.Body.String(), "one") {
+		t.Fatalf("Expected the snapshot from host *, got %v:\n%v", response.Code, response.Body)
+	}
+	response = serveWithAccept(handler, "/2013-10-06/00:00:00/compare/queries/", "text/html")
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "star") ||
+		!strings.Contains(response.Body.String(), "one") {
+		t.Fatalf("Expected both hosts compared, got %v:\n%v", response.Code, response.Body)
+	}
+}
+
+func TestReadRequestBody(t *testing.T) {
+	contents := strings.Repeat("name,value\nkey,1\n", 100000)
+	request := httptest.NewRequest("PUT", "/", io.MultiReader(
+		strings.NewReader(contents[:1000]), strings.NewReader(contents[1000:]),
+	))
+	if body, err := readRequestBody(request); err != nil || body != contents {
+		t.Fatalf("Didn't read the whole body: %d bytes, %v", len(body), err)
+	}
+	request = httptest.NewRequest("GET", "/", strings.NewReader(contents))
+	if body, err := readRequestBody(request); err != nil || body != "" {
+		t.Fatalf("Read the body of a GET: %d bytes, %v", len(body), err)
+	}
+}
+
+func TestFormBodies(t *testing.T) {
+	authorizer := Authorizer{"secret": {"writer", map[Permission]bool{WritePermission: true}}}
+	database := setUp()
+	handler := MakeApp(database, authorizer).Handler()
+	post := func(url string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", url, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.Header.Set("Authorization", "Bearer secret")
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+	response := post("/pins/", "start=2013-10-05&end=2013-10-06&note=x")
+	if pins := database.GetPins(); response.Code != http.StatusOK || len(pins) != 1 ||
+		pins[0].Note != "x" {
+		t.Fatalf("Form body wasn't read: %v %v %v", response.Code, response.Body, pins)
+	}
+
+	text := strings.Repeat("Failed over to the replica. ", 1000)
+	form := url.Values{"start": {"2013-10-05 14:02:00"}, "end": {"2013-10-05 14:10:00"},
+		"text": {text}}
+	response = post("/annotations/", form.Encode())
+	if annotation, ok := database.GetAnnotation(1); response.Code != http.StatusOK || !ok ||
+		annotation.Text != text {
+		t.Fatalf("Annotation form body wasn't read: %v %v", response.Code, response.Body)
+	}
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("PUT", "/annotations/1/", strings.NewReader("text=updated"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "Bearer secret")
+	handler.ServeHTTP(recorder, request)
+	if annotation, _ := database.GetAnnotation(1); recorder.Code != http.StatusOK ||
+		annotation.Text != "updated" {
+		t.Fatalf("Annotation update form body wasn't read: %v %v", recorder.Code, recorder.Body)
+	}
+}
@@ -0,0 +1,278 @@
+package timeturner
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// An archive is a tar file holding ARCHIVE_MANIFEST_NAME followed by one CSV file per snapshot.
+// The manifest comes first so an archive can be imported as it's read, and maps each file back to
+// the snapshot's exact timestamp, hostname and title, which file names can't hold faithfully.
+const (
+	ARCHIVE_MANIFEST_NAME  = "manifest.json"
+	ARCHIVE_FORMAT_VERSION = 1
+)
+
+type ArchiveManifest struct {
+	FormatVersion int
+	ExportedAt    int64
+	Snapshots     []ArchivedSnapshot
+}
+
+type ArchivedSnapshot struct {
+	Path          string
+	UnixTimestamp int64
+	Hostname      string
+	Title         string
+}
+
+func (archived ArchivedSnapshot) Timestamp() time.Time {
+	return time.Unix(archived.UnixTimestamp, 0)
+}
+
+// ArchiveFilter selects the snapshots to export: those from Start (inclusive) to End (exclusive),
+// where a zero time leaves that end unbounded, and on Hostnames, or on any host if it's empty.
+type ArchiveFilter struct {
+	Start     time.Time
+	End       time.Time
+	Hostnames []string
+}
+
+// ParseArchiveFilter reads a filter from command-line values. Times are "2013-10-05" or
+// "2013-10-05 15:32:44", hostnames are comma-separated, and empty values don't filter.
+func ParseArchiveFilter(start string, end string, hostnames string) (
+	filter ArchiveFilter, err error) {
+	if start != "" {
+		if filter.Start, err = parseRangeBoundary(start); err != nil {
+			return
+		}
+	}
+	if end != "" {
+		if filter.End, err = parseRangeBoundary(end); err != nil {
+			return
+		}
+	}
+	if hostnames != "" {
+		filter.Hostnames = strings.Split(hostnames, ",")
+	}
+	return
+}
+
+func (filter ArchiveFilter) includesDay(day time.Time) bool {
+	return (filter.Start.IsZero() || day.AddDate(0, 0, 1).After(filter.Start)) &&
+		(filter.End.IsZero() || day.Before(filter.End))
+}
+
+func (filter ArchiveFilter) includesTimestamp(timestamp time.Time) bool {
+	return (filter.Start.IsZero() || !timestamp.Before(filter.Start)) &&
+		(filter.End.IsZero() || timestamp.Before(filter.End))
+}
+
+func (filter ArchiveFilter) includesHost(hostname string) bool {
+	if len(filter.Hostnames) == 0 {
+		return true
+	}
+	for _, included := range filter.Hostnames {
+		if hostname == included {
+			return true
+		}
+	}
+	return false
+}
+
+// archivePath names a snapshot's file, like "2013-10-05/stevebox/quotes/153244.csv", adding a
+// suffix if an earlier snapshot's name sanitized to the same path.
+func archivePath(snapshot Snapshot, usedPaths map[string]bool) string {
+	timestamp := snapshot.Timestamp()
+	base := strings.Join(
+		[]string{
+			timestamp.Format(DATE_FORMAT),
+			unsafeFilenameCharacters.ReplaceAllString(snapshot.Hostname, "_"),
+			unsafeFilenameCharacters.ReplaceAllString(snapshot.Title, "_"),
+			timestamp.Format("150405"),
+		},
+		"/",
+	)
+	path := base + ".csv"
+	for suffix := 2; usedPaths[path]; suffix++ {
+		path = fmt.Sprintf("%s-%d.csv", base, suffix)
+	}
+	usedPaths[path] = true
+	return path
+}
+
+func listArchivedSnapshots(database Database, filter ArchiveFilter) []ArchivedSnapshot {
+	archived := make([]ArchivedSnapshot, 0)
+	usedPaths := make(map[string]bool)
+	for _, day := range database.GetAllDays() {
+		if !filter.includesDay(day) {
+			continue
+		}
+		for _, timestamp := range database.GetTimestamps(day) {
+			if !filter.includesTimestamp(timestamp) {
+				continue
+			}
+			for _, snapshot := range database.GetSnapshots(timestamp) {
+				if filter.includesHost(snapshot.Hostname) {
+					archived = append(archived, ArchivedSnapshot{
+						archivePath(snapshot, usedPaths), snapshot.UnixTimestamp,
+						snapshot.Hostname, snapshot.Title,
+					})
+				}
+			}
+		}
+	}
+	return archived
+}
+
+// ExportArchive writes the snapshots selected by filter to an archive and returns how many it
+// wrote. Snapshots deleted while the archive is written are left out, though still listed in the
+// manifest.
+func ExportArchive(database Database, writer io.Writer, filter ArchiveFilter,
+	exportedAt time.Time) (snapshotCount int, err error) {
+	manifest := ArchiveManifest{
+		ARCHIVE_FORMAT_VERSION, exportedAt.Unix(), listArchivedSnapshots(database, filter),
+	}
+	encodedManifest, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	archive := tar.NewWriter(writer)
+	err = writeArchiveFile(archive, ARCHIVE_MANIFEST_NAME, encodedManifest, exportedAt)
+	for index := 0; err == nil && index < len(manifest.Snapshots); index++ {
+		archived := manifest.Snapshots[index]
+		snapshot, ok := database.GetSnapshotWithContents(
+			archived.Timestamp(), archived.Hostname, archived.Title,
+		)
+		if ok {
+			err = writeArchiveFile(
+				archive, archived.Path, []byte(snapshot.CsvContents), archived.Timestamp(),
+			)
+			snapshotCount++
+		}
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	return snapshotCount, err
+}
+
+func writeArchiveFile(archive *tar.Writer, path string, contents []byte,
+	modified time.Time) error {
+	header := &tar.Header{
+		Name:     path,
+		Mode:     0644,
+		Size:     int64(len(contents)),
+		ModTime:  modified,
+		Typeflag: tar.TypeReg,
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := archive.Write(contents)
+	return err
+}
+
+// pinImportedRanges pins the range of times of each host and title's imported snapshots.
+func pinImportedRanges(database Database, snapshots []ArchivedSnapshot, source string) {
+	type hostAndTitle struct{ hostname, title string }
+	ranges := make(map[hostAndTitle]*Pin)
+	var keys []hostAndTitle
+	for _, archived := range snapshots {
+		key := hostAndTitle{archived.Hostname, archived.Title}
+		pin, ok := ranges[key]
+		if !ok {
+			pin = &Pin{
+				StartUnixTimestamp: archived.UnixTimestamp,
+				EndUnixTimestamp:   archived.UnixTimestamp + 1,
+				Hostname:           archived.Hostname,
+				Title:              archived.Title,
+				Note:               "Imported from " + source,
+			}
+			ranges[key] = pin
+			keys = append(keys, key)
+		}
+		if archived.UnixTimestamp < pin.StartUnixTimestamp {
+			pin.StartUnixTimestamp = archived.UnixTimestamp
+		}
+		if archived.UnixTimestamp >= pin.EndUnixTimestamp {
+			pin.EndUnixTimestamp = archived.UnixTimestamp + 1
+		}
+	}
+	for _, key := range keys {
+		database.AddPin(*ranges[key])
+	}
+}
+
+// ImportArchive adds the snapshots in an archive to the database with their original timestamps.
+// Snapshots that already exist are skipped rather than overwritten. Each imported snapshot is
+// recorded in the audit log with source as its source address. Imports don't apply the retention
+// policy, so expired snapshots are kept until the next compaction; if pin is set, each host and
+// title's range of imported times is pinned once the import ends, so retention keeps them.
+func ImportArchive(database Database, reader io.Reader, source string, pin bool) (
+	imported int, skipped int, err error) {
+	archive := tar.NewReader(reader)
+	header, err := archive.Next()
+	if err == io.EOF || err == nil && header.Name != ARCHIVE_MANIFEST_NAME {
+		return 0, 0, fmt.Errorf("Archive doesn't start with %s", ARCHIVE_MANIFEST_NAME)
+	} else if err != nil {
+		return 0, 0, err
+	}
+	var manifest ArchiveManifest
+	if err = json.NewDecoder(archive).Decode(&manifest); err != nil {
+		return 0, 0, fmt.Errorf("Invalid manifest: %v", err)
+	}
+	if manifest.FormatVersion != ARCHIVE_FORMAT_VERSION {
+		return 0, 0, fmt.Errorf("Unsupported archive format version %d", manifest.FormatVersion)
+	}
+	snapshotsByPath := make(map[string]ArchivedSnapshot)
+	for _, archived := range manifest.Snapshots {
+		snapshotsByPath[archived.Path] = archived
+	}
+	var written []ArchivedSnapshot
+	if pin {
+		defer func() { pinImportedRanges(database, written, source) }()
+	}
+
+	for {
+		header, err = archive.Next()
+		if err == io.EOF {
+			return imported, skipped, nil
+		} else if err != nil {
+			return imported, skipped, err
+		}
+		archived, ok := snapshotsByPath[header.Name]
+		if !ok {
+			return imported, skipped, fmt.Errorf("%s isn't in the manifest", header.Name)
+		}
+		csvContents, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return imported, skipped, err
+		}
+		// Every row must be as wide as the first, like the snapshots the server stores.
+		contents, err := csv.NewReader(bytes.NewReader(csvContents)).ReadAll()
+		if err != nil {
+			return imported, skipped, fmt.Errorf("Invalid CSV in %s: %v", header.Name, err)
+		}
+
+		_, err = database.AddSnapshot(
+			archived.Timestamp(), archived.Hostname, archived.Title, contents, RejectOnConflict,
+			Actor{SourceAddress: source, Importing: true},
+		)
+		if err == ErrSnapshotExists {
+			skipped++
+			continue
+		} else if err != nil {
+			return imported, skipped, err
+		}
+		written = append(written, archived)
+		imported++
+	}
+}
@@ -0,0 +1,171 @@
+package timeturner
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArchiveFilter(t *testing.T) {
+	filter, err := ParseArchiveFilter("2013-10-05", "2013-10-05 16:00:00", "host1,host2")
+	if err != nil {
+		t.Fatalf("Failed to parse filter: %v", err)
+	}
+	if filter.Start.Format(DATE_FORMAT+" "+TIME_FORMAT) != "2013-10-05 00:00:00" ||
+		filter.End.Format(TIME_FORMAT) != "16:00:00" || len(filter.Hostnames) != 2 {
+		t.Fatalf("Unexpected filter: %v", filter)
+	}
+	if filter, _ = ParseArchiveFilter("", "", ""); !filter.includesTimestamp(now) ||
+		!filter.includesHost("anything") {
+		t.Fatalf("Empty filter excluded something: %v", filter)
+	}
+	if _, err = ParseArchiveFilter("yesterday", "", ""); err == nil {
+		t.Fatalf("Parsed invalid start time")
+	}
+}
+
+func TestArchivePathsAreUnique(t *testing.T) {
+	usedPaths := make(map[string]bool)
+	first := archivePath(
+		Snapshot{UnixTimestamp: now.Unix(), Hostname: "host1", Title: "a b"}, usedPaths,
+	)
+	second := archivePath(
+		Snapshot{UnixTimestamp: now.Unix(), Hostname: "host1", Title: "a/b"}, usedPaths,
+	)
+	if !strings.HasSuffix(first, "/host1/a_b/000000.csv") ||
+		!strings.HasSuffix(second, "/host1/a_b/000000-2.csv") {
+		t.Fatalf("Unexpected paths %q and %q", first, second)
+	}
+}
+
+func TestExportAndImportArchive(t *testing.T) {
+	source := setUp()
+	source.AddSnapshot(now, "host1", "processes", repetitiveContents(3), OverwriteOnConflict, Actor{})
+	source.AddSnapshot(now, "host2", "processes", wrapSimpleContents("x"), OverwriteOnConflict,
+		Actor{})
+	source.AddSnapshot(now.Add(time.Hour), "host1", "slow queries", wrapSimpleContents("a,\"b\""),
+		OverwriteOnConflict, Actor{})
+	source.AddSnapshot(now.AddDate(0, 0, 1), "host1", "processes", wrapSimpleContents("y"),
+		OverwriteOnConflict, Actor{})
+
+	var archive bytes.Buffer
+	filter := ArchiveFilter{Start: now, End: now.AddDate(0, 0, 1), Hostnames: []string{"host1"}}
+	snapshotCount, err := ExportArchive(source, &archive, filter, now)
+	if snapshotCount != 2 || err != nil {
+		t.Fatalf("Failed to export: %d, %v", snapshotCount, err)
+	}
+
+	destination := setUp()
+	destination.AddSnapshot(now, "host1", "processes", wrapSimpleContents("existing"),
+		OverwriteOnConflict, Actor{})
+	imported, skipped, err := ImportArchive(destination, &archive, "backup.tar", false)
+	if imported != 1 || skipped != 1 || err != nil {
+		t.Fatalf("Unexpected import: %d imported, %d skipped, %v", imported, skipped, err)
+	}
+	snapshot, ok := destination.GetSnapshotWithContents(now.Add(time.Hour), "host1", "slow queries")
+	if !ok || snapshot.CsvContents != "column\n\"a,\"\"b\"\"\"\n" {
+		t.Fatalf("Unexpected imported snapshot: %q, %v", snapshot.CsvContents, ok)
+	}
+	existing, _ := destination.GetSnapshotWithContents(now, "host1", "processes")
+	if existing.CsvContents != "column\nexisting\n" {
+		t.Fatalf("Import overwrote an existing snapshot: %q", existing.CsvContents)
+	}
+	entries := destination.GetAuditEntries(10)
+	if len(entries) != 2 || entries[0].Action != ImportAction ||
+		entries[0].SourceAddress != "backup.tar" || entries[1].Action != CreateAction {
+		t.Fatalf("Unexpected audit entries: %v", entries)
+	}
+}
+
+func TestImportKeepsSnapshotsPastRetention(t *testing.T) {
+	source := setUp()
+	for _, timestamp := range []time.Time{now, now.Add(time.Hour)} {
+		source.AddSnapshot(timestamp, "host1", "processes", wrapSimpleContents("x"),
+			OverwriteOnConflict, Actor{})
+	}
+	var archive bytes.Buffer
+	if _, err := ExportArchive(source, &archive, ArchiveFilter{}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	later := now.AddDate(0, 0, 30)
+	destination := InitializeDatabase(setUpConnection(), func() time.Time { return later }, false)
+	destination.AddSnapshot(now.Add(30*time.Minute), "host1", "mounts", wrapSimpleContents("x"),
+		OverwriteOnConflict, Actor{Importing: true})
+	imported, _, err := ImportArchive(destination, bytes.NewReader(archive.Bytes()), "backup.tar",
+		true)
+	if imported != 2 || err != nil {
+		t.Fatalf("Unexpected import: %d imported, %v", imported, err)
+	}
+	destination.Compact()
+	for _, timestamp := range []time.Time{now, now.Add(time.Hour)} {
+		if _, ok := destination.GetSnapshotWithContents(timestamp, "host1", "processes"); !ok {
+			t.Fatalf("Retention deleted the snapshot imported at %v", timestamp)
+		}
+	}
+	if _, ok := destination.GetSnapshotWithContents(now.Add(30*time.Minute), "host1",
+		"mounts"); ok {
+		t.Fatal("The import's pin kept a snapshot it didn't import")
+	}
+	pins := destination.GetPins()
+	isPinOk := len(pins) == 1 && pins[0].Start().Equal(now) &&
+		pins[0].End().Equal(now.Add(time.Hour+time.Second)) && pins[0].Hostname == "host1" &&
+		pins[0].Title == "processes" && pins[0].Note == "Imported from backup.tar"
+	if !isPinOk {
+		t.Fatalf("Unexpected pins %v", pins)
+	}
+
+	unpinned := InitializeDatabase(setUpConnection(), func() time.Time { return later }, false)
+	imported, _, err = ImportArchive(unpinned, bytes.NewReader(archive.Bytes()), "backup.tar",
+		false)
+	if imported != 2 || err != nil || len(unpinned.GetPins()) != 0 {
+		t.Fatalf("Unexpected import without pins: %d imported, %v", imported, err)
+	}
+	if unpinned.Compact(); len(unpinned.GetAllDays()) != 0 {
+		t.Fatal("Retention kept unpinned imported snapshots")
+	}
+}
+
+func TestImportPinsWhatWasWrittenBeforeFailing(t *testing.T) {
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	manifest, _ := json.Marshal(ArchiveManifest{FormatVersion: ARCHIVE_FORMAT_VERSION,
+		Snapshots: []ArchivedSnapshot{
+			{"a.csv", now.Unix(), "host1", "a"}, {"b.csv", now.Unix(), "host1", "b"},
+		}})
+	writeArchiveFile(writer, ARCHIVE_MANIFEST_NAME, manifest, now)
+	writeArchiveFile(writer, "a.csv", []byte("column\nx\n"), now)
+	writeArchiveFile(writer, "b.csv", []byte("name,value\nx\n"), now)
+	writer.Close()
+
+	database := setUp()
+	imported, _, err := ImportArchive(database, &archive, "ragged.tar", true)
+	if imported != 1 || err == nil || !strings.Contains(err.Error(), "b.csv") {
+		t.Fatalf("Expected an error about ragged rows in b.csv, got %d imported, %v", imported, err)
+	}
+	if pins := database.GetPins(); len(pins) != 1 || pins[0].Title != "a" {
+		t.Fatalf("Unexpected pins %v", pins)
+	}
+	if _, ok := database.GetSnapshotWithContents(now, "host1", "b"); ok {
+		t.Fatal("Imported a snapshot with ragged rows")
+	}
+}
+
+func TestImportRejectsFilesMissingFromManifest(t *testing.T) {
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	writeArchiveFile(writer, ARCHIVE_MANIFEST_NAME, []byte(`{"FormatVersion": 1}`), now)
+	writeArchiveFile(writer, "stray.csv", []byte("column\nx\n"), now)
+	writer.Close()
+
+	_, _, err := ImportArchive(setUp(), &archive, "stray.tar", false)
+	if err == nil || !strings.Contains(err.Error(), "stray.csv") {
+		t.Fatalf("Expected an error about stray.csv, got %v", err)
+	}
+	if _, _, err = ImportArchive(setUp(), strings.NewReader(""), "empty.tar", false); err == nil {
+		t.Fatalf("Imported an archive without a manifest")
+	}
+}
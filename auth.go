@@ -0,0 +1,91 @@
+package timeturner
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type Permission string
+
+const (
+	WritePermission  Permission = "write"
+	DeletePermission Permission = "delete"
+	AdminPermission  Permission = "admin"
+)
+
+var knownPermissions = map[Permission]bool{
+	WritePermission:  true,
+	DeletePermission: true,
+	AdminPermission:  true,
+}
+
+type AccessToken struct {
+	Identity    string
+	Permissions map[Permission]bool
+}
+
+// Authorizer maps secret bearer tokens to the identity and permissions they grant. An empty
+// Authorizer, which is how the server behaves when no tokens are configured, allows reads and
+// writes but refuses deletes and the admin pages.
+type Authorizer map[string]AccessToken
+
+// LoadAuthorizer reads lines of the form "<identity> <token> <permission>,<permission>". Blank
+// lines and lines starting with # are ignored.
+func LoadAuthorizer(reader io.Reader) (Authorizer, error) {
+	authorizer := make(Authorizer)
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Line %d: expected identity, token and permissions", lineNumber)
+		}
+		accessToken := AccessToken{fields[0], make(map[Permission]bool)}
+		for _, permission := range splitList(fields[2]) {
+			if !knownPermissions[Permission(permission)] {
+				return nil, fmt.Errorf("Line %d: unknown permission %q", lineNumber, permission)
+			}
+			accessToken.Permissions[Permission(permission)] = true
+		}
+		authorizer[fields[1]] = accessToken
+	}
+	return authorizer, scanner.Err()
+}
+
+func LoadAuthorizerFile(path string) (Authorizer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return LoadAuthorizer(file)
+}
+
+func bearerToken(request *http.Request) string {
+	header := request.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(header[len("Bearer "):])
+	}
+	return ""
+}
+
+// Authorize returns the identity behind the request's bearer token, if any, and whether that token
+// grants the given permission. An empty permission only identifies the caller.
+func (authorizer Authorizer) Authorize(request *http.Request, permission Permission) (
+	identity string, ok bool) {
+	accessToken, known := authorizer[bearerToken(request)]
+	if known {
+		identity = accessToken.Identity
+	}
+	if permission == "" || len(authorizer) == 0 && permission == WritePermission {
+		return identity, true
+	}
+	return identity, known && accessToken.Permissions[permission]
+}
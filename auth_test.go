@@ -0,0 +1,103 @@
+package timeturner
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTokens = `
+# identity token permissions
+collector secret1 write
+admin secret2 write,delete
+`
+
+func requestWithToken(token string) *http.Request {
+	request, _ := http.NewRequest("PUT", "/", nil)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return request
+}
+
+func TestLoadAuthorizer(t *testing.T) {
+	authorizer, err := LoadAuthorizer(strings.NewReader(testTokens))
+	if err != nil {
+		t.Fatalf("Got error loading tokens: %v", err)
+	}
+	if len(authorizer) != 2 || authorizer["secret2"].Identity != "admin" {
+		t.Fatalf("Unexpected authorizer %v", authorizer)
+	}
+
+	for _, contents := range []string{"collector secret1", "collector secret1 read"} {
+		if _, err := LoadAuthorizer(strings.NewReader(contents)); err == nil {
+			t.Fatalf("No error for invalid tokens %q", contents)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	authorizer, _ := LoadAuthorizer(strings.NewReader(testTokens))
+	cases := []struct {
+		token      string
+		permission Permission
+		identity   string
+		ok         bool
+	}{
+		{"secret1", WritePermission, "collector", true},
+		{"secret1", DeletePermission, "collector", false},
+		{"secret2", DeletePermission, "admin", true},
+		{"wrong", WritePermission, "", false},
+		{"", WritePermission, "", false},
+		{"", "", "", true},
+		{"secret1", "", "collector", true},
+	}
+	for _, testCase := range cases {
+		identity, ok := authorizer.Authorize(requestWithToken(testCase.token), testCase.permission)
+		if identity != testCase.identity || ok != testCase.ok {
+			t.Fatalf("Expected %v/%v for %v, got %v/%v",
+				testCase.identity, testCase.ok, testCase, identity, ok)
+		}
+	}
+}
+
+func TestEmptyAuthorizer(t *testing.T) {
+	authorizer := make(Authorizer)
+	if _, ok := authorizer.Authorize(requestWithToken(""), WritePermission); !ok {
+		t.Fatalf("Empty authorizer refused a write")
+	}
+	for _, permission := range []Permission{DeletePermission, AdminPermission} {
+		if _, ok := authorizer.Authorize(requestWithToken(""), permission); ok {
+			t.Fatalf("Empty authorizer allowed %v", permission)
+		}
+	}
+}
+
+func TestAppRefusesDeletesWithoutTokens(t *testing.T) {
+	database := setUp()
+	handler := MakeApp(database, make(Authorizer)).Handler()
+	serve := func(method string, url string, body string) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return recorder.Code
+	}
+
+	url := "/2013-10-05/15:32:44/host1/quotes/"
+	if status := serve("PUT", url, "name\nsteve\n"); status != http.StatusOK {
+		t.Fatalf("Expected writes to be allowed by default, got %v", status)
+	}
+	for _, url := range []string{url, "/hosts/host1/", "/titles/quotes/"} {
+		if status := serve("DELETE", url, ""); status != http.StatusForbidden {
+			t.Fatalf("Expected an unauthenticated DELETE %v to be refused, got %v", url, status)
+		}
+	}
+	if status := serve("GET", "/admin/audit/", ""); status != http.StatusForbidden {
+		t.Fatalf("Expected the audit log to be refused by default, got %v", status)
+	}
+	timestamp := time.Date(2013, 10, 5, 15, 32, 44, 0, time.Local)
+	if _, ok := database.GetSnapshotWithContents(timestamp, "host1", "quotes"); !ok {
+		t.Fatalf("Snapshot was deleted without a token")
+	}
+}
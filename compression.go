@@ -0,0 +1,109 @@
+package timeturner
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+)
+
+// Snapshot contents are stored encoded with one of these codecs, recorded in the Codec column.
+// LEGACY_CODEC marks rows written before compression existed, which are migrated at startup;
+// NO_CODEC marks contents that didn't get any smaller when compressed.
+const (
+	LEGACY_CODEC = ""
+	NO_CODEC     = "none"
+	GZIP_CODEC   = "gzip"
+)
+
+func gzipEncode(contents string) string {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := io.WriteString(writer, contents); err != nil {
+		panic(err)
+	}
+	if err := writer.Close(); err != nil {
+		panic(err)
+	}
+	return buffer.String()
+}
+
+// gzipDecode decompresses every gzip member in the input, since appends add a member at a time.
+// With allowTruncated, it returns whatever could be decompressed from a prefix of the contents.
+func gzipDecode(encoded string, allowTruncated bool) string {
+	reader, err := gzip.NewReader(bytes.NewBufferString(encoded))
+	if err != nil {
+		panic(err)
+	}
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil && !(allowTruncated && err == io.ErrUnexpectedEOF) {
+		panic(err)
+	}
+	return string(contents)
+}
+
+// encodeContents compresses contents, falling back to storing them as-is when that's smaller.
+func encodeContents(contents string) (codec string, encoded string) {
+	encoded = gzipEncode(contents)
+	if len(encoded) >= len(contents) {
+		return NO_CODEC, contents
+	}
+	return GZIP_CODEC, encoded
+}
+
+// encodeAppendedContents encodes contents so they can be concatenated to contents already stored
+// with the given codec.
+func encodeAppendedContents(codec string, contents string) string {
+	if codec == GZIP_CODEC {
+		return gzipEncode(contents)
+	}
+	return contents
+}
+
+func decodeContents(codec string, encoded string) string {
+	if codec == GZIP_CODEC {
+		return gzipDecode(encoded, false)
+	}
+	return encoded
+}
+
+// decodeContentsPrefix decodes as much as possible of the first bytes of some encoded contents.
+func decodeContentsPrefix(codec string, encodedPrefix string) string {
+	if codec == GZIP_CODEC {
+		return gzipDecode(encodedPrefix, true)
+	}
+	return encodedPrefix
+}
+
+// EXTERNAL_STORAGE stands in for the codec in StorageStats of contents kept in a ContentStore,
+// which take up no space in the database.
+const EXTERNAL_STORAGE = "external"
+
+// StorageStats summarizes the snapshots stored with one codec.
+type StorageStats struct {
+	Codec         string
+	SnapshotCount int64
+	ContentBytes  int64
+	StoredBytes   int64
+}
+
+func (stats StorageStats) BytesSaved() int64 {
+	return stats.ContentBytes - stats.StoredBytes
+}
+
+func (stats StorageStats) PercentSaved() float64 {
+	if stats.ContentBytes == 0 {
+		return 0
+	}
+	return 100 * float64(stats.BytesSaved()) / float64(stats.ContentBytes)
+}
+
+func totalStorageStats(allStats []StorageStats) StorageStats {
+	total := StorageStats{Codec: "total"}
+	for _, stats := range allStats {
+		total.SnapshotCount += stats.SnapshotCount
+		total.ContentBytes += stats.ContentBytes
+		total.StoredBytes += stats.StoredBytes
+	}
+	return total
+}
@@ -0,0 +1,270 @@
+package timeturner
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ContentStore keeps snapshot contents outside of the database, which then only records the key
+// each blob was stored under. Keys are slash-separated paths like
+// "2013-10-06/stevebox/processes/153244-0123456789ab.csv.gz".
+type ContentStore interface {
+	Put(key string, contents []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// OpenContentStore opens the content store described by a URL, either "file:///path/to/dir" or
+// "s3://bucket?endpoint=http://localhost:9000&region=us-east-1". S3 credentials are read from the
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+func OpenContentStore(storeUrl string) (ContentStore, error) {
+	parsedUrl, err := url.Parse(storeUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch parsedUrl.Scheme {
+	case "file":
+		if parsedUrl.Path == "" {
+			return nil, fmt.Errorf("Content store URL %q has no directory", storeUrl)
+		}
+		return FileContentStore{parsedUrl.Path}, nil
+	case "s3":
+		query := parsedUrl.Query()
+		store := S3ContentStore{
+			Endpoint:  query.Get("endpoint"),
+			Bucket:    parsedUrl.Host,
+			Region:    query.Get("region"),
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}
+		if store.Endpoint == "" || store.Bucket == "" {
+			return nil, fmt.Errorf("Content store URL %q needs a bucket and an endpoint", storeUrl)
+		}
+		if store.Region == "" {
+			store.Region = "us-east-1"
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("Unknown content store %q", storeUrl)
+	}
+}
+
+// contentKey names the blob first stored for a snapshot. Later snapshots with identical contents
+// share it.
+func contentKey(snapshot Snapshot, hash string, codec string) string {
+	extension := ".csv"
+	if codec == GZIP_CODEC {
+		extension += ".gz"
+	}
+	timestamp := snapshot.Timestamp()
+	return strings.Join(
+		[]string{
+			timestamp.Format(DATE_FORMAT),
+			unsafeFilenameCharacters.ReplaceAllString(snapshot.Hostname, "_"),
+			unsafeFilenameCharacters.ReplaceAllString(snapshot.Title, "_"),
+			timestamp.Format("150405") + "-" + hash[:12] + extension,
+		},
+		"/",
+	)
+}
+
+// FileContentStore keeps contents in a directory tree under Root.
+type FileContentStore struct {
+	Root string
+}
+
+func (store FileContentStore) path(key string) string {
+	return filepath.Join(store.Root, filepath.FromSlash(key))
+}
+
+// Put writes to a temporary file first, so readers never see partial contents.
+func (store FileContentStore) Put(key string, contents []byte) error {
+	path := store.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func (store FileContentStore) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(store.path(key))
+}
+
+func (store FileContentStore) Delete(key string) error {
+	err := os.Remove(store.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// S3_REQUEST_TIMEOUT bounds each request to an S3ContentStore without its own Client, long enough
+// to upload a large snapshot over a slow link.
+const S3_REQUEST_TIMEOUT = 2 * time.Minute
+
+var s3Client = &http.Client{Timeout: S3_REQUEST_TIMEOUT}
+
+// S3ContentStore keeps contents in a bucket of an S3-compatible store such as MinIO, addressed
+// path-style at Endpoint. Requests are made with Client, or with a client that gives up after
+// S3_REQUEST_TIMEOUT if it's nil.
+type S3ContentStore struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+func (store S3ContentStore) Put(key string, contents []byte) error {
+	_, err := store.do("PUT", key, contents, http.StatusOK)
+	return err
+}
+
+func (store S3ContentStore) Get(key string) ([]byte, error) {
+	return store.do("GET", key, nil, http.StatusOK)
+}
+
+func (store S3ContentStore) Delete(key string) error {
+	_, err := store.do("DELETE", key, nil, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+	return err
+}
+
+func (store S3ContentStore) do(method string, key string, body []byte, okStatuses ...int) (
+	[]byte, error) {
+	objectPath := "/" + store.Bucket + "/" + key
+	request, err := http.NewRequest(
+		method, strings.TrimRight(store.Endpoint, "/")+escapeS3Path(objectPath),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return nil, err
+	}
+	store.sign(request, objectPath, body, time.Now().UTC())
+
+	client := store.Client
+	if client == nil {
+		client = s3Client
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range okStatuses {
+		if response.StatusCode == status {
+			return responseBody, nil
+		}
+	}
+	return nil, fmt.Errorf("S3 %s %s failed: %s: %s", method, key, response.Status, responseBody)
+}
+
+// escapeS3Path percent-encodes everything but unreserved characters and slashes, as both request
+// URLs and AWS signatures expect.
+func escapeS3Path(path string) string {
+	var escaped bytes.Buffer
+	for _, character := range []byte(path) {
+		if 'A' <= character && character <= 'Z' || 'a' <= character && character <= 'z' ||
+			'0' <= character && character <= '9' || strings.IndexByte("-._~/", character) >= 0 {
+			escaped.WriteByte(character)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", character)
+		}
+	}
+	return escaped.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	hash := hmac.New(sha256.New, key)
+	hash.Write([]byte(data))
+	return hash.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func signingKey(secretKey string, date string, region string, service string) []byte {
+	key := hmacSha256([]byte("AWS4"+secretKey), date)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, service)
+	return hmacSha256(key, "aws4_request")
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the request.
+func (store S3ContentStore) sign(request *http.Request, objectPath string, body []byte,
+	now time.Time) {
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	payloadHash := sha256Hex(body)
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 request.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range headerNames {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join(
+		[]string{
+			request.Method, escapeS3Path(objectPath), "", canonicalHeaders.String(), signedHeaders,
+			payloadHash,
+		},
+		"\n",
+	)
+	scope := date + "/" + store.Region + "/s3/aws4_request"
+	stringToSign := strings.Join(
+		[]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n",
+	)
+	signature := hex.EncodeToString(
+		hmacSha256(signingKey(store.SecretKey, date, store.Region, "s3"), stringToSign),
+	)
+	request.Header.Set(
+		"Authorization",
+		fmt.Sprintf(
+			"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+			store.AccessKey, scope, signedHeaders, signature,
+		),
+	)
+}
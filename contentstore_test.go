@@ -0,0 +1,136 @@
+package timeturner
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenContentStore(t *testing.T) {
+	store, err := OpenContentStore("file:///var/lib/timeturner")
+	if err != nil || store != (FileContentStore{"/var/lib/timeturner"}) {
+		t.Fatalf("Unexpected file store %v (%v)", store, err)
+	}
+	store, err = OpenContentStore("s3://snapshots?endpoint=http://localhost:9000")
+	s3Store, ok := store.(S3ContentStore)
+	if err != nil || !ok || s3Store.Bucket != "snapshots" || s3Store.Region != "us-east-1" ||
+		s3Store.Endpoint != "http://localhost:9000" {
+		t.Fatalf("Unexpected S3 store %v (%v)", store, err)
+	}
+	if _, err = OpenContentStore("s3://snapshots"); err == nil {
+		t.Fatalf("Expected an error for an S3 store without an endpoint")
+	}
+	if _, err = OpenContentStore("ftp://example.com/"); err == nil {
+		t.Fatalf("Expected an error for an unknown content store")
+	}
+}
+
+func TestContentKey(t *testing.T) {
+	timestamp := time.Date(2013, 10, 6, 15, 32, 44, 0, time.Local)
+	snapshot := Snapshot{UnixTimestamp: timestamp.Unix(), Hostname: "host1", Title: "slow queries"}
+	key := contentKey(snapshot, strings.Repeat("ab", 32), GZIP_CODEC)
+	if key != "2013-10-06/host1/slow_queries/153244-abababababab.csv.gz" {
+		t.Fatalf("Unexpected key %v", key)
+	}
+}
+
+func TestFileContentStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "timeturner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store := FileContentStore{root}
+
+	if err = store.Put("2013-10-06/host1/processes/000000.csv", []byte("a,b\n")); err != nil {
+		t.Fatalf("Failed to put contents: %v", err)
+	}
+	contents, err := store.Get("2013-10-06/host1/processes/000000.csv")
+	if err != nil || string(contents) != "a,b\n" {
+		t.Fatalf("Unexpected contents %q (%v)", contents, err)
+	}
+	if err = store.Delete("2013-10-06/host1/processes/000000.csv"); err != nil {
+		t.Fatalf("Failed to delete contents: %v", err)
+	}
+	if err = store.Delete("2013-10-06/host1/processes/000000.csv"); err != nil {
+		t.Fatalf("Deleting missing contents failed: %v", err)
+	}
+	if _, err = store.Get("2013-10-06/host1/processes/000000.csv"); err == nil {
+		t.Fatalf("Got deleted contents")
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	// From the AWS Signature Version 4 documentation.
+	key := signingKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	expected := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"
+	if hex.EncodeToString(key) != expected {
+		t.Fatalf("Unexpected signing key %x", key)
+	}
+}
+
+func TestS3ContentStore(t *testing.T) {
+	objects := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter,
+		request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		authorization := request.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=key/") ||
+			request.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+			http.Error(writer, "bad signature", http.StatusForbidden)
+			return
+		}
+		switch request.Method {
+		case "PUT":
+			objects[request.URL.Path] = body
+		case "GET":
+			if object, ok := objects[request.URL.Path]; ok {
+				writer.Write(object)
+			} else {
+				http.NotFound(writer, request)
+			}
+		case "DELETE":
+			delete(objects, request.URL.Path)
+			writer.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+	store := S3ContentStore{server.URL, "snapshots", "us-east-1", "key", "secret", nil}
+
+	if err := store.Put("2013-10-06/host1/processes/000000.csv", []byte("a,b\n")); err != nil {
+		t.Fatalf("Failed to put contents: %v", err)
+	}
+	if _, ok := objects["/snapshots/2013-10-06/host1/processes/000000.csv"]; !ok {
+		t.Fatalf("Unexpected objects %v", objects)
+	}
+	contents, err := store.Get("2013-10-06/host1/processes/000000.csv")
+	if err != nil || string(contents) != "a,b\n" {
+		t.Fatalf("Unexpected contents %q (%v)", contents, err)
+	}
+	if err = store.Delete("2013-10-06/host1/processes/000000.csv"); err != nil || len(objects) != 0 {
+		t.Fatalf("Failed to delete contents: %v", err)
+	}
+	if _, err = store.Get("2013-10-06/host1/processes/000000.csv"); err == nil {
+		t.Fatalf("Got deleted contents")
+	}
+}
+
+func TestS3ContentStoreTimesOut(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter,
+		request *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	client := &http.Client{Timeout: 10 * time.Millisecond}
+	store := S3ContentStore{server.URL, "snapshots", "us-east-1", "key", "secret", client}
+	if _, err := store.Get("2013-10-06/host1/processes/000000.csv"); err == nil {
+		t.Fatal("Expected a request to a hung store to time out")
+	}
+}
@@ -0,0 +1,151 @@
+package timeturner
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+type ExportFormat struct {
+	ContentType string
+	Write       func(writer io.Writer, table [][]string) error
+}
+
+var exportFormats = map[string]ExportFormat{
+	"csv":  {"text/csv; charset=utf-8", writeCsvExport},
+	"tsv":  {"text/tab-separated-values; charset=utf-8", writeTsvExport},
+	"json": {"application/json", writeJsonExport},
+	"xlsx": {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", writeXlsxExport},
+}
+
+var exportFormatNames = []string{"csv", "tsv", "json", "xlsx"}
+
+var unsafeFilenameCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// exportFilename builds a download filename like "stevebox-processes-2013-10-05T15-32-44.csv".
+func exportFilename(snapshot Snapshot, suffix string, format string) string {
+	name := fmt.Sprintf(
+		"%s-%s%s-%s",
+		snapshot.Hostname, snapshot.Title, suffix,
+		snapshot.Timestamp().Format("2006-01-02T15-04-05"),
+	)
+	return unsafeFilenameCharacters.ReplaceAllString(name, "_") + "." + format
+}
+
+func writeCsvExport(writer io.Writer, table [][]string) error {
+	return csv.NewWriter(writer).WriteAll(table)
+}
+
+func writeTsvExport(writer io.Writer, table [][]string) error {
+	tsvWriter := csv.NewWriter(writer)
+	tsvWriter.Comma = '\t'
+	return tsvWriter.WriteAll(table)
+}
+
+// writeJsonExport writes one object per data row, keyed by column name.
+func writeJsonExport(writer io.Writer, table [][]string) error {
+	rows := make([]map[string]string, 0)
+	if len(table) > 0 {
+		for _, row := range table[1:] {
+			object := make(map[string]string)
+			for index, columnName := range table[0] {
+				object[columnName] = cellAt(row, index)
+			}
+			rows = append(rows, object)
+		}
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(rows)
+}
+
+const xlsxContentTypes = xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`
+
+const xlsxRootRelationships = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`
+
+const xlsxWorkbook = xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Snapshot" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`
+
+const xlsxWorkbookRelationships = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+</Relationships>`
+
+func xlsxColumnName(index int) string {
+	name := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		name = string(rune('A'+(index-1)%26)) + name
+	}
+	return name
+}
+
+func writeXlsxSheet(writer io.Writer, table [][]string) error {
+	_, err := io.WriteString(writer, xml.Header+
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err != nil {
+		return err
+	}
+	for rowIndex, row := range table {
+		fmt.Fprintf(writer, `<row r="%d">`, rowIndex+1)
+		for columnIndex, cell := range row {
+			reference := fmt.Sprintf("%s%d", xlsxColumnName(columnIndex), rowIndex+1)
+			// Numbers are written in canonical form, since spreadsheets reject a <v> holding
+			// anything else, like surrounding spaces.
+			if value, isNumber := parseNumber(cell); isNumber && rowIndex > 0 {
+				number := strconv.FormatFloat(value, 'g', -1, 64)
+				fmt.Fprintf(writer, `<c r="%s"><v>%s</v></c>`, reference, number)
+			} else {
+				fmt.Fprintf(writer, `<c r="%s" t="inlineStr"><is><t>`, reference)
+				xml.EscapeText(writer, []byte(cell))
+				io.WriteString(writer, `</t></is></c>`)
+			}
+		}
+		io.WriteString(writer, `</row>`)
+	}
+	_, err = io.WriteString(writer, `</sheetData></worksheet>`)
+	return err
+}
+
+// writeXlsxExport writes a minimal single-sheet workbook using inline strings, which every
+// spreadsheet we care about opens without needing a shared string table or styles.
+func writeXlsxExport(writer io.Writer, table [][]string) error {
+	archive := zip.NewWriter(writer)
+	parts := []struct {
+		name     string
+		contents string
+	}{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRelationships},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRelationships},
+	}
+	for _, part := range parts {
+		partWriter, err := archive.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(partWriter, part.contents); err != nil {
+			return err
+		}
+	}
+	sheetWriter, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	if err = writeXlsxSheet(sheetWriter, table); err != nil {
+		return err
+	}
+	return archive.Close()
+}
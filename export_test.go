@@ -0,0 +1,108 @@
+package timeturner
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var exportTestTable = [][]string{
+	{"name", "value"},
+	{"key1", "1"},
+	{"a <b>", "x"},
+}
+
+func TestExportFilename(t *testing.T) {
+	snapshot := Snapshot{UnixTimestamp: now.Unix(), Hostname: "host1", Title: "slow queries"}
+	filename := exportFilename(snapshot, "-aggregate", "csv")
+	expected := "host1-slow_queries-aggregate-2013-10-06T00-00-00.csv"
+	if filename != expected {
+		t.Fatalf("Expected %v, got %v", expected, filename)
+	}
+}
+
+func TestTsvExport(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := writeTsvExport(&buffer, exportTestTable); err != nil {
+		t.Fatalf("Got error exporting TSV: %v", err)
+	}
+	expected := "name\tvalue\nkey1\t1\na <b>\tx\n"
+	if buffer.String() != expected {
+		t.Fatalf("Unexpected TSV %q", buffer.String())
+	}
+}
+
+func TestJsonExport(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := writeJsonExport(&buffer, exportTestTable); err != nil {
+		t.Fatalf("Got error exporting JSON: %v", err)
+	}
+	expected := `[{"name":"key1","value":"1"},{"name":"a <b>","value":"x"}]` + "\n"
+	if buffer.String() != expected {
+		t.Fatalf("Unexpected JSON %q", buffer.String())
+	}
+}
+
+// xlsxSheet exports the table as XLSX and returns its worksheet.
+func xlsxSheet(t *testing.T, table [][]string) string {
+	var buffer bytes.Buffer
+	if err := writeXlsxExport(&buffer, table); err != nil {
+		t.Fatalf("Got error exporting XLSX: %v", err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatalf("XLSX export isn't a valid zip file: %v", err)
+	}
+	var sheet string
+	for _, file := range archive.File {
+		if file.Name == "xl/worksheets/sheet1.xml" {
+			reader, _ := file.Open()
+			contents, _ := ioutil.ReadAll(reader)
+			sheet = string(contents)
+		}
+	}
+	return sheet
+}
+
+func TestXlsxExport(t *testing.T) {
+	sheet := xlsxSheet(t, exportTestTable)
+	expectedCells := []string{
+		`<c r="B2"><v>1</v></c>`,
+		`<c r="A3" t="inlineStr"><is><t>a &lt;b&gt;</t></is></c>`,
+	}
+	for _, cell := range expectedCells {
+		if !strings.Contains(sheet, cell) {
+			t.Fatalf("Expected %v in sheet %v", cell, sheet)
+		}
+	}
+}
+
+func TestXlsxExportOnlyWritesFiniteNumbers(t *testing.T) {
+	sheet := xlsxSheet(t, [][]string{
+		{"a", "b", "c", "d", "e", "f"},
+		{"NaN", "Inf", "Infinity", "0x1p4", " 12 ", "1.50"},
+	})
+	expectedCells := []string{
+		`<c r="A2" t="inlineStr"><is><t>NaN</t></is></c>`,
+		`<c r="B2" t="inlineStr"><is><t>Inf</t></is></c>`,
+		`<c r="C2" t="inlineStr"><is><t>Infinity</t></is></c>`,
+		`<c r="D2" t="inlineStr"><is><t>0x1p4</t></is></c>`,
+		`<c r="E2"><v>12</v></c>`,
+		`<c r="F2"><v>1.5</v></c>`,
+	}
+	for _, cell := range expectedCells {
+		if !strings.Contains(sheet, cell) {
+			t.Fatalf("Expected %v in sheet %v", cell, sheet)
+		}
+	}
+}
+
+func TestXlsxColumnName(t *testing.T) {
+	for index, expected := range map[int]string{0: "A", 25: "Z", 26: "AA", 701: "ZZ", 702: "AAA"} {
+		if name := xlsxColumnName(index); name != expected {
+			t.Fatalf("Expected %v for column %d, got %v", expected, index, name)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package timeturner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// HealthCheck is the outcome of one of the checks behind /readyz.
+type HealthCheck struct {
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type HealthStatus struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+// runHealthCheck runs one check, treating a panic, as the database layer raises on errors, as a
+// failure.
+func runHealthCheck(name string, check func() error) (result HealthCheck) {
+	result.Name = name
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			result.Ok = false
+			result.Error = fmt.Sprint(recovered)
+		}
+	}()
+	if err := check(); err != nil {
+		result.Error = err.Error()
+		return
+	}
+	result.Ok = true
+	return
+}
+
+// CheckReadiness reports whether the app can serve requests: the database must be reachable and
+// fully migrated, and the templates loaded.
+func (app App) CheckReadiness() (ready bool, checks []HealthCheck) {
+	checks = append(checks, runHealthCheck("database", app.Database.Ping))
+	databaseReachable := checks[0].Ok
+	checks = append(checks, runHealthCheck("migrations", func() error {
+		if !databaseReachable {
+			return errors.New("database is unreachable")
+		}
+		if pending := app.Database.PendingMigrations(); len(pending) > 0 {
+			return fmt.Errorf("%d migrations pending, starting with %d (%s)",
+				len(pending), pending[0].Version, pending[0].Name)
+		}
+		return nil
+	}))
+	checks = append(checks, runHealthCheck("templates", func() error {
+		if app.Templates == nil || app.Templates.Lookup("header") == nil {
+			return errors.New("templates aren't loaded")
+		}
+		return nil
+	}))
+	ready = true
+	for _, check := range checks {
+		ready = ready && check.Ok
+	}
+	return
+}
+
+func writeHealthStatus(writer http.ResponseWriter, statusCode int, status HealthStatus) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(statusCode)
+	if err := json.NewEncoder(writer).Encode(status); err != nil {
+		log.Printf("ERROR: Failed to write health status: %v\n", err)
+	}
+}
+
+// ServeHealth answers /healthz, which only shows that the process is up and serving.
+func (app App) ServeHealth(writer http.ResponseWriter, request *http.Request) {
+	writeHealthStatus(writer, http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+// ServeReadiness answers /readyz with the result of each readiness check, and a 503 if any failed.
+func (app App) ServeReadiness(writer http.ResponseWriter, request *http.Request) {
+	ready, checks := app.CheckReadiness()
+	if ready {
+		writeHealthStatus(writer, http.StatusOK, HealthStatus{"ok", checks})
+	} else {
+		writeHealthStatus(writer, http.StatusServiceUnavailable, HealthStatus{"unavailable", checks})
+	}
+}
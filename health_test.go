@@ -0,0 +1,70 @@
+package timeturner
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getHealthStatus(t *testing.T, app App, url string) (int, HealthStatus) {
+	recorder := httptest.NewRecorder()
+	app.Router.ServeHTTP(recorder, httptest.NewRequest("GET", url, nil))
+	var status HealthStatus
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode %v: %v", url, err)
+	}
+	return recorder.Code, status
+}
+
+func assertFailedChecks(t *testing.T, checks []HealthCheck, expectedFailures ...string) {
+	failed := make(map[string]bool)
+	for _, check := range checks {
+		if !check.Ok {
+			if check.Error == "" {
+				t.Errorf("No error for failed check %v", check.Name)
+			}
+			failed[check.Name] = true
+		}
+	}
+	if len(failed) != len(expectedFailures) {
+		t.Fatalf("Expected %v to fail, got %v", expectedFailures, checks)
+	}
+	for _, name := range expectedFailures {
+		if !failed[name] {
+			t.Fatalf("Expected %v to fail, got %v", name, checks)
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	nowFunc := func() time.Time { return now }
+	app := MakeApp(InitializeDatabase(setUpConnection(), nowFunc, false), make(Authorizer))
+	code, status := getHealthStatus(t, app, "/readyz")
+	if code != http.StatusOK || status.Status != "ok" || len(status.Checks) != 3 {
+		t.Fatalf("Expected ready, got %v %v", code, status)
+	}
+	assertFailedChecks(t, status.Checks)
+
+	app = MakeApp(NewDatabase(setUpConnection(), nowFunc, false), make(Authorizer))
+	code, status = getHealthStatus(t, app, "/readyz")
+	if code != http.StatusServiceUnavailable || status.Status != "unavailable" {
+		t.Fatalf("Expected unready before migrating, got %v %v", code, status)
+	}
+	assertFailedChecks(t, status.Checks, "migrations")
+
+	connection := setUpConnection()
+	app = MakeApp(InitializeDatabase(connection, nowFunc, false), make(Authorizer))
+	connection.Close()
+	code, status = getHealthStatus(t, app, "/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected unready with a closed database, got %v %v", code, status)
+	}
+	assertFailedChecks(t, status.Checks, "database", "migrations")
+
+	code, status = getHealthStatus(t, app, "/healthz")
+	if code != http.StatusOK || status.Status != "ok" {
+		t.Fatalf("Expected healthy, got %v %v", code, status)
+	}
+}
@@ -0,0 +1,300 @@
+package timeturner
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("too many writes from this host, slow down")
+var ErrQuotaExceeded = errors.New("this host's daily quota is used up")
+
+// IngestionLimits caps how fast and how much each host can write. Each host may write
+// WritesPerMinute on average, in bursts of up to WriteBurst, and up to MaxSnapshotsPerDay snapshots
+// and MaxBytesPerDay bytes each day. A zero value turns that limit off.
+type IngestionLimits struct {
+	WritesPerMinute    float64
+	WriteBurst         int
+	MaxSnapshotsPerDay int64
+	MaxBytesPerDay     int64
+}
+
+func (limits IngestionLimits) Validate() error {
+	if limits.WritesPerMinute < 0 || limits.WriteBurst < 0 || limits.MaxSnapshotsPerDay < 0 ||
+		limits.MaxBytesPerDay < 0 {
+		return errors.New("ingestion limits can't be negative")
+	}
+	if limits.WritesPerMinute > 0 && limits.WriteBurst == 0 {
+		return errors.New("a write rate needs a burst of at least 1")
+	}
+	return nil
+}
+
+func (limits IngestionLimits) enabled() bool {
+	return limits != IngestionLimits{}
+}
+
+// HostUsage is what one host has written today.
+type HostUsage struct {
+	Hostname  string
+	Day       time.Time
+	Snapshots int64
+	Bytes     int64
+	Rejected  int64
+}
+
+// UsageStore keeps each host's usage, so quotas hold across restarts.
+type UsageStore interface {
+	// GetHostUsage returns the usage saved for the day, forgetting earlier days.
+	GetHostUsage(day time.Time) []HostUsage
+	SaveHostUsage(usage HostUsage)
+}
+
+type hostState struct {
+	usage      HostUsage
+	tokens     float64
+	lastRefill time.Time
+}
+
+// IngestionLimiter enforces IngestionLimits per hostname. Usage is kept in memory, and in the
+// UsageStore if there is one and any limit is on, so quotas hold across restarts. Each day it
+// forgets the hosts that haven't written since their write tokens refilled. It's safe for
+// concurrent use.
+type IngestionLimiter struct {
+	lock    sync.Mutex
+	limits  IngestionLimits
+	nowFunc func() time.Time
+	store   UsageStore
+	day     time.Time
+	hosts   map[string]*hostState
+	// unsaved holds the hostnames whose usage changed since it was last saved to the store.
+	unsaved map[string]bool
+	// saveLock makes saves take turns, so an earlier save can't overwrite later usage.
+	saveLock sync.Mutex
+}
+
+func NewIngestionLimiter(nowFunc func() time.Time) *IngestionLimiter {
+	return &IngestionLimiter{
+		nowFunc: nowFunc,
+		hosts:   make(map[string]*hostState),
+		unsaved: make(map[string]bool),
+	}
+}
+
+func (limiter *IngestionLimiter) UseLimits(limits IngestionLimits) error {
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.limits = limits
+	return nil
+}
+
+// UseStore saves usage to the store, starting from what it holds for today.
+func (limiter *IngestionLimiter) UseStore(store UsageStore) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.store = store
+	limiter.day = time.Time{}
+}
+
+func (limiter *IngestionLimiter) Limits() IngestionLimits {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return limiter.limits
+}
+
+func startOfDay(timestamp time.Time) time.Time {
+	year, month, day := timestamp.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, timestamp.Location())
+}
+
+// refill adds the write tokens earned since the host's tokens were last refilled.
+func (limiter *IngestionLimiter) refill(state *hostState, now time.Time) {
+	state.tokens += now.Sub(state.lastRefill).Minutes() * limiter.limits.WritesPerMinute
+	if state.tokens > float64(limiter.limits.WriteBurst) {
+		state.tokens = float64(limiter.limits.WriteBurst)
+	}
+	state.lastRefill = now
+}
+
+// startDay forgets the hosts with full write tokens and loads today's usage from the store, once
+// a day.
+func (limiter *IngestionLimiter) startDay(now time.Time) {
+	today := startOfDay(now)
+	if limiter.day.Equal(today) {
+		return
+	}
+	limiter.day = today
+	for hostname, state := range limiter.hosts {
+		limiter.refill(state, now)
+		if state.tokens >= float64(limiter.limits.WriteBurst) {
+			delete(limiter.hosts, hostname)
+		}
+	}
+	if limiter.store != nil {
+		for _, usage := range limiter.store.GetHostUsage(today) {
+			limiter.state(usage.Hostname, now).usage = usage
+		}
+	}
+}
+
+// state returns the host's state, starting its usage over on a new day and refilling its write
+// tokens for the time since they were last refilled.
+func (limiter *IngestionLimiter) state(hostname string, now time.Time) *hostState {
+	limiter.startDay(now)
+	state, ok := limiter.hosts[hostname]
+	if !ok {
+		state = &hostState{
+			usage:      HostUsage{Hostname: hostname},
+			tokens:     float64(limiter.limits.WriteBurst),
+			lastRefill: now,
+		}
+		limiter.hosts[hostname] = state
+	}
+	if today := startOfDay(now); !state.usage.Day.Equal(today) {
+		state.usage = HostUsage{Hostname: hostname, Day: today}
+	}
+	limiter.refill(state, now)
+	return state
+}
+
+// markUnsaved queues the host's usage to be saved, if there's a store and any limit is on.
+func (limiter *IngestionLimiter) markUnsaved(state *hostState) {
+	if limiter.store != nil && limiter.limits.enabled() {
+		limiter.unsaved[state.usage.Hostname] = true
+	}
+}
+
+// saveUsage writes the usage queued by markUnsaved to the store, without holding the lock while
+// it does. A save that waited for its turn writes whatever was queued meanwhile too.
+func (limiter *IngestionLimiter) saveUsage() {
+	limiter.saveLock.Lock()
+	defer limiter.saveLock.Unlock()
+	limiter.lock.Lock()
+	store := limiter.store
+	var usage []HostUsage
+	for hostname := range limiter.unsaved {
+		if state, ok := limiter.hosts[hostname]; ok {
+			usage = append(usage, state.usage)
+		}
+		delete(limiter.unsaved, hostname)
+	}
+	limiter.lock.Unlock()
+	for _, hostUsage := range usage {
+		store.SaveHostUsage(hostUsage)
+	}
+}
+
+// Admit records a write of byteCount bytes from the host, which adds a snapshot if newSnapshot,
+// or returns ErrQuotaExceeded or ErrRateLimited and how long to wait before trying again. The
+// write is charged to the host's quotas up front, so concurrent writes can't overshoot them; call
+// Refund if it then fails.
+func (limiter *IngestionLimiter) Admit(hostname string, byteCount int, newSnapshot bool) (
+	retryAfter time.Duration, err error) {
+	defer limiter.saveUsage()
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limits := limiter.limits
+	now := limiter.nowFunc()
+	state := limiter.state(hostname, now)
+
+	var snapshotCount int64
+	if newSnapshot {
+		snapshotCount = 1
+	}
+	if (limits.MaxSnapshotsPerDay > 0 &&
+		state.usage.Snapshots+snapshotCount > limits.MaxSnapshotsPerDay) ||
+		(limits.MaxBytesPerDay > 0 && state.usage.Bytes+int64(byteCount) > limits.MaxBytesPerDay) {
+		state.usage.Rejected++
+		limiter.markUnsaved(state)
+		return startOfDay(now).AddDate(0, 0, 1).Sub(now), ErrQuotaExceeded
+	}
+	if limits.WritesPerMinute > 0 {
+		if state.tokens < 1 {
+			state.usage.Rejected++
+			limiter.markUnsaved(state)
+			minutes := (1 - state.tokens) / limits.WritesPerMinute
+			return time.Duration(minutes * float64(time.Minute)), ErrRateLimited
+		}
+		state.tokens--
+	}
+	state.usage.Snapshots += snapshotCount
+	state.usage.Bytes += int64(byteCount)
+	limiter.markUnsaved(state)
+	return 0, nil
+}
+
+// Refund takes an admitted write that failed back off the host's quotas. The write still counts
+// toward the rate limit.
+func (limiter *IngestionLimiter) Refund(hostname string, byteCount int, newSnapshot bool) {
+	defer limiter.saveUsage()
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	state := limiter.state(hostname, limiter.nowFunc())
+	if newSnapshot && state.usage.Snapshots > 0 {
+		state.usage.Snapshots--
+	}
+	state.usage.Bytes -= int64(byteCount)
+	if state.usage.Bytes < 0 {
+		state.usage.Bytes = 0
+	}
+	limiter.markUnsaved(state)
+}
+
+// Usage lists what each host has written today, by hostname.
+func (limiter *IngestionLimiter) Usage() []HostUsage {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := limiter.nowFunc()
+	limiter.startDay(now)
+	today := startOfDay(now)
+	usage := make([]HostUsage, 0, len(limiter.hosts))
+	for _, state := range limiter.hosts {
+		if state.usage.Day.Equal(today) {
+			usage = append(usage, state.usage)
+		}
+	}
+	sort.Slice(usage, func(i int, j int) bool { return usage[i].Hostname < usage[j].Hostname })
+	return usage
+}
+
+// DailyUsage is a host's usage as stored in the database, for one day starting at UnixDay.
+type DailyUsage struct {
+	Hostname  string
+	UnixDay   int64
+	Snapshots int64
+	Bytes     int64
+	Rejected  int64
+}
+
+func (database *TimeturnerDatabase) GetHostUsage(day time.Time) []HostUsage {
+	if _, err := database.mapper.Exec(
+		"DELETE FROM DailyUsage WHERE UnixDay < ?", day.Unix(),
+	); err != nil {
+		panic(err)
+	}
+	var rows []DailyUsage
+	query := "SELECT * FROM DailyUsage WHERE UnixDay = ? ORDER BY Hostname"
+	if _, err := database.mapper.Select(&rows, query, day.Unix()); err != nil {
+		panic(err)
+	}
+	usage := make([]HostUsage, len(rows))
+	for index, row := range rows {
+		usage[index] = HostUsage{row.Hostname, day, row.Snapshots, row.Bytes, row.Rejected}
+	}
+	return usage
+}
+
+func (database *TimeturnerDatabase) SaveHostUsage(usage HostUsage) {
+	_, err := database.mapper.Exec(
+		"INSERT OR REPLACE INTO DailyUsage (Hostname, UnixDay, Snapshots, Bytes, Rejected) "+
+			"VALUES (?, ?, ?, ?, ?)",
+		usage.Hostname, usage.Day.Unix(), usage.Snapshots, usage.Bytes, usage.Rejected,
+	)
+	if err != nil {
+		panic(err)
+	}
+}
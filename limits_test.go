@@ -0,0 +1,239 @@
+package timeturner
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIngestionRateLimit(t *testing.T) {
+	current := time.Date(2013, 10, 5, 15, 32, 44, 0, time.Local)
+	limiter := NewIngestionLimiter(func() time.Time { return current })
+	if err := limiter.UseLimits(IngestionLimits{WritesPerMinute: 2, WriteBurst: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := limiter.Admit("host1", 10, true); err != nil {
+			t.Fatalf("Write %v within the burst was rejected: %v", i, err)
+		}
+	}
+	retryAfter, err := limiter.Admit("host1", 10, true)
+	if err != ErrRateLimited || retryAfter != 30*time.Second {
+		t.Fatalf("Expected to be rate limited for 30s, got %v %v", retryAfter, err)
+	}
+	if _, err := limiter.Admit("host2", 10, true); err != nil {
+		t.Fatalf("Another host was rate limited: %v", err)
+	}
+	current = current.Add(30 * time.Second)
+	if _, err := limiter.Admit("host1", 10, true); err != nil {
+		t.Fatalf("Write after waiting was rejected: %v", err)
+	}
+
+	usage := limiter.Usage()
+	if len(usage) != 2 || usage[0].Hostname != "host1" || usage[0].Snapshots != 3 ||
+		usage[0].Bytes != 30 || usage[0].Rejected != 1 {
+		t.Fatalf("Unexpected usage %v", usage)
+	}
+}
+
+func TestIngestionQuotas(t *testing.T) {
+	current := time.Date(2013, 10, 5, 18, 0, 0, 0, time.Local)
+	limiter := NewIngestionLimiter(func() time.Time { return current })
+	limiter.UseLimits(IngestionLimits{MaxSnapshotsPerDay: 2, MaxBytesPerDay: 100})
+
+	limiter.Admit("host1", 40, true)
+	if _, err := limiter.Admit("host1", 70, false); err != ErrQuotaExceeded {
+		t.Fatalf("Expected the byte quota to be exceeded, got %v", err)
+	}
+	if _, err := limiter.Admit("host1", 50, false); err != nil {
+		t.Fatalf("Appending within the quota was rejected: %v", err)
+	}
+	limiter.Admit("host1", 1, true)
+	retryAfter, err := limiter.Admit("host1", 1, true)
+	if err != ErrQuotaExceeded || retryAfter != 6*time.Hour {
+		t.Fatalf("Expected the snapshot quota to be exceeded until midnight, got %v %v",
+			retryAfter, err)
+	}
+
+	current = current.Add(6 * time.Hour)
+	if _, err := limiter.Admit("host1", 100, true); err != nil {
+		t.Fatalf("Quota wasn't reset the next day: %v", err)
+	}
+	if usage := limiter.Usage(); len(usage) != 1 || usage[0].Bytes != 100 {
+		t.Fatalf("Unexpected usage %v", usage)
+	}
+
+	if err := limiter.UseLimits(IngestionLimits{WritesPerMinute: 1}); err == nil {
+		t.Fatal("No error for a write rate without a burst")
+	}
+}
+
+func TestIngestionLimitResponses(t *testing.T) {
+	authorizer := Authorizer{
+		"secret": {"admin", map[Permission]bool{WritePermission: true, AdminPermission: true}},
+	}
+	app := MakeApp(setUp(), authorizer)
+	app.Limiter.UseLimits(IngestionLimits{WritesPerMinute: 1, WriteBurst: 1})
+	putAt := func(clock string, hostname string, contents string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(
+			"PUT", "/2013-10-05/"+clock+"/"+hostname+"/quotes/", strings.NewReader(contents),
+		)
+		request.Header.Set("Authorization", "Bearer secret")
+		app.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+	put := func(hostname string) *httptest.ResponseRecorder {
+		return putAt("15:32:44", hostname, "name\nsteve\n")
+	}
+	if response := put("host1"); response.Code != http.StatusOK {
+		t.Fatalf("First write was rejected: %v %v", response.Code, response.Body)
+	}
+	response := put("host1")
+	if response.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %v", response.Code)
+	}
+	if retryAfter := response.Header().Get("Retry-After"); retryAfter != "60" &&
+		retryAfter != "59" {
+		t.Fatalf("Unexpected Retry-After %q", retryAfter)
+	}
+	if response = put("host2"); response.Code != http.StatusOK {
+		t.Fatalf("Another host's write was rejected: %v %v", response.Code, response.Body)
+	}
+
+	app.Limiter.UseLimits(IngestionLimits{MaxSnapshotsPerDay: 2})
+	response = putAt("15:33:44", "host2", "name\n\"harry\n")
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %v", response.Code)
+	}
+	if response = putAt("15:33:44", "host2", "name\nsteve\n"); response.Code != http.StatusOK {
+		t.Fatalf("Failed write counted toward the quota: %v %v", response.Code, response.Body)
+	}
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/admin/usage/", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	app.Router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "host2") {
+		t.Fatalf("Usage page didn't list host2: %v %v", recorder.Code, recorder.Body)
+	}
+}
+
+func TestIngestionRefunds(t *testing.T) {
+	current := time.Date(2013, 10, 5, 18, 0, 0, 0, time.Local)
+	limiter := NewIngestionLimiter(func() time.Time { return current })
+	limiter.UseLimits(IngestionLimits{MaxSnapshotsPerDay: 1, MaxBytesPerDay: 100})
+
+	limiter.Admit("host1", 60, true)
+	limiter.Refund("host1", 60, true)
+	if _, err := limiter.Admit("host1", 100, true); err != nil {
+		t.Fatalf("Refunded write still counted toward the quota: %v", err)
+	}
+	if usage := limiter.Usage(); len(usage) != 1 || usage[0].Snapshots != 1 ||
+		usage[0].Bytes != 100 {
+		t.Fatalf("Unexpected usage %v", usage)
+	}
+}
+
+// panickingDatabase panics on every write.
+type panickingDatabase struct {
+	Database
+}
+
+func (database panickingDatabase) AddSnapshot(timestamp time.Time, hostname string,
+	title string, contents [][]string, onConflict ConflictMode, actor Actor) (int64, error) {
+	panic("oops")
+}
+
+func TestIngestionRefundsPanickedWrites(t *testing.T) {
+	app := MakeApp(panickingDatabase{setUp()}, make(Authorizer))
+	app.Limiter.UseLimits(IngestionLimits{MaxSnapshotsPerDay: 1})
+	recorder := httptest.NewRecorder()
+	app.Router.ServeHTTP(recorder, httptest.NewRequest(
+		"PUT", "/2013-10-05/15:32:44/host1/quotes/", strings.NewReader("name\nsteve\n"),
+	))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected a 500, got %v %v", recorder.Code, recorder.Body)
+	}
+	if usage := app.Limiter.Usage(); len(usage) != 1 || usage[0].Snapshots != 0 ||
+		usage[0].Bytes != 0 {
+		t.Fatalf("Panicked write wasn't refunded: %v", usage)
+	}
+}
+
+// countingUsageStore counts the usage saved to it.
+type countingUsageStore struct {
+	saves int
+}
+
+func (store *countingUsageStore) GetHostUsage(day time.Time) []HostUsage { return nil }
+func (store *countingUsageStore) SaveHostUsage(usage HostUsage)          { store.saves++ }
+
+func TestIngestionUsageSavedOnlyWithLimits(t *testing.T) {
+	current := time.Date(2013, 10, 5, 18, 0, 0, 0, time.Local)
+	limiter := NewIngestionLimiter(func() time.Time { return current })
+	store := &countingUsageStore{}
+	limiter.UseStore(store)
+	limiter.Admit("host1", 10, true)
+	limiter.Refund("host1", 10, true)
+	if store.saves != 0 {
+		t.Fatalf("Saved usage %v times with no limits", store.saves)
+	}
+
+	limiter.UseLimits(IngestionLimits{MaxSnapshotsPerDay: 2})
+	limiter.Admit("host1", 10, true)
+	limiter.Admit("host2", 10, true)
+	if store.saves != 2 {
+		t.Fatalf("Expected 2 saves, got %v", store.saves)
+	}
+}
+
+func TestIngestionUsagePersists(t *testing.T) {
+	current := time.Date(2013, 10, 5, 18, 0, 0, 0, time.Local)
+	database := setUp().(*TimeturnerDatabase)
+	limiter := NewIngestionLimiter(func() time.Time { return current })
+	limiter.UseLimits(IngestionLimits{MaxSnapshotsPerDay: 2})
+	limiter.UseStore(database)
+	limiter.Admit("host1", 10, true)
+	limiter.Admit("host1", 10, true)
+
+	restarted := NewIngestionLimiter(func() time.Time { return current })
+	restarted.UseLimits(IngestionLimits{MaxSnapshotsPerDay: 2})
+	restarted.UseStore(database)
+	if _, err := restarted.Admit("host1", 10, true); err != ErrQuotaExceeded {
+		t.Fatalf("Expected the quota to hold across a restart, got %v", err)
+	}
+	if usage := restarted.Usage(); len(usage) != 1 || usage[0].Snapshots != 2 ||
+		usage[0].Bytes != 20 || usage[0].Rejected != 1 {
+		t.Fatalf("Unexpected usage %v", usage)
+	}
+
+	current = current.Add(6 * time.Hour)
+	if _, err := restarted.Admit("host1", 10, true); err != nil {
+		t.Fatalf("Quota wasn't reset the next day: %v", err)
+	}
+	if usage := database.GetHostUsage(startOfDay(current)); len(usage) != 1 ||
+		usage[0].Snapshots != 1 {
+		t.Fatalf("Unexpected stored usage %v", usage)
+	}
+}
+
+func TestIngestionLimiterForgetsIdleHosts(t *testing.T) {
+	current := time.Date(2013, 10, 5, 23, 59, 0, 0, time.Local)
+	limiter := NewIngestionLimiter(func() time.Time { return current })
+	limiter.UseLimits(IngestionLimits{WritesPerMinute: 1, WriteBurst: 5})
+	limiter.Admit("host1", 10, true)
+	limiter.Admit("host2", 10, true)
+
+	current = current.Add(2 * time.Minute)
+	limiter.Admit("host2", 10, true)
+	if _, ok := limiter.hosts["host1"]; ok || len(limiter.hosts) != 1 {
+		t.Fatalf("Idle host wasn't forgotten: %v", limiter.hosts)
+	}
+	if usage := limiter.Usage(); len(usage) != 1 || usage[0].Hostname != "host2" ||
+		usage[0].Snapshots != 1 {
+		t.Fatalf("Unexpected usage %v", usage)
+	}
+}
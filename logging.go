@@ -0,0 +1,116 @@
+package timeturner
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// REQUEST_ID_HEADER carries the ID generated for each request in its response, to match it up with
+// the access log.
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+// AccessLog receives a logfmt line for every request handled, except health checks.
+var AccessLog = log.New(os.Stderr, "", 0)
+
+func newRequestId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+func clientAddress(request *http.Request) string {
+	address, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return address
+}
+
+// httpError responds with an error page or JSON error that includes the request ID, like the
+// app's other errors.
+func (app App) httpError(writer http.ResponseWriter, request *http.Request,
+	requestId string, message string, statusCode int) {
+	renderError(app.Templates, writer, request.Header, requestId, statusCode, message)
+}
+
+// loggedResponse records the status and size of a response for the access log.
+type loggedResponse struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (response *loggedResponse) WriteHeader(status int) {
+	if response.status == 0 {
+		response.status = status
+	}
+	response.ResponseWriter.WriteHeader(status)
+}
+
+func (response *loggedResponse) Write(data []byte) (int, error) {
+	if response.status == 0 {
+		response.status = http.StatusOK
+	}
+	written, err := response.ResponseWriter.Write(data)
+	response.bytes += written
+	return written, err
+}
+
+// AccessLogEntry describes one handled request.
+type AccessLogEntry struct {
+	Time      time.Time
+	RequestId string
+	Method    string
+	Route     string
+	Path      string
+	Status    int
+	Bytes     int
+	Duration  time.Duration
+	Client    string
+	Identity  string
+	Hostname  string
+	Title     string
+}
+
+// formatLogfmtValue quotes values that would otherwise be ambiguous in logfmt.
+func formatLogfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\\t\r\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// Logfmt renders the entry as key=value pairs, leaving out the host and title for requests that
+// aren't about a snapshot.
+func (entry AccessLogEntry) Logfmt() string {
+	pairs := []string{
+		"time=" + entry.Time.Format(time.RFC3339Nano),
+		"request_id=" + entry.RequestId,
+		"method=" + formatLogfmtValue(entry.Method),
+		"route=" + formatLogfmtValue(entry.Route),
+		"path=" + formatLogfmtValue(entry.Path),
+		"status=" + strconv.Itoa(entry.Status),
+		"bytes=" + strconv.Itoa(entry.Bytes),
+		"duration_ms=" + strconv.FormatFloat(entry.Duration.Seconds()*1000, 'f', 3, 64),
+		"client=" + formatLogfmtValue(entry.Client),
+	}
+	if entry.Identity != "" {
+		pairs = append(pairs, "identity="+formatLogfmtValue(entry.Identity))
+	}
+	if entry.Hostname != "" {
+		pairs = append(pairs, "hostname="+formatLogfmtValue(entry.Hostname))
+	}
+	if entry.Title != "" {
+		pairs = append(pairs, "title="+formatLogfmtValue(entry.Title))
+	}
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,81 @@
+package timeturner
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogEntryLogfmt(t *testing.T) {
+	entry := AccessLogEntry{
+		Time:      time.Date(2013, 10, 5, 15, 32, 44, 0, time.UTC),
+		RequestId: "0123456789abcdef",
+		Method:    "PUT",
+		Route:     "add snapshot",
+		Path:      "/2013-10-05/15:32:44/host1/quotes/",
+		Status:    200,
+		Bytes:     18,
+		Duration:  1500 * time.Microsecond,
+		Client:    "10.0.0.1",
+		Hostname:  "host1",
+		Title:     `say "hi"`,
+	}
+	expected := `time=2013-10-05T15:32:44Z request_id=0123456789abcdef method=PUT ` +
+		`route="add snapshot" path=/2013-10-05/15:32:44/host1/quotes/ status=200 bytes=18 ` +
+		`duration_ms=1.500 client=10.0.0.1 hostname=host1 title="say \"hi\""`
+	if logfmt := entry.Logfmt(); logfmt != expected {
+		t.Fatalf("Expected\n%v\ngot\n%v", expected, logfmt)
+	}
+}
+
+func TestRequestIdsAndAccessLog(t *testing.T) {
+	var accessLog bytes.Buffer
+	AccessLog.SetOutput(&accessLog)
+	defer AccessLog.SetOutput(os.Stderr)
+
+	authorizer := Authorizer{"token": {"collector", map[Permission]bool{WritePermission: true}}}
+	app := MakeApp(setUp(), authorizer)
+	serve := func(method string, url string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, url, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer token")
+		app.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	response := serve("PUT", "/2013-10-05/15:32:44/host1/quotes/", "name\nsteve\n")
+	requestId := response.Header().Get(REQUEST_ID_HEADER)
+	if response.Code != http.StatusOK || len(requestId) != 16 {
+		t.Fatalf("Expected a request ID, got %v %v", response.Code, response.Header())
+	}
+	line := strings.TrimSpace(accessLog.String())
+	for _, expected := range []string{
+		"request_id=" + requestId, "method=PUT", `route="add snapshot"`, "status=200",
+		"bytes=17", "identity=collector", "hostname=host1", "title=quotes",
+	} {
+		if !strings.Contains(line, expected) {
+			t.Errorf("Missing %v in access log line %v", expected, line)
+		}
+	}
+
+	accessLog.Reset()
+	response = serve("PATCH", "/2013-10-05/15:32:44/host1/quotes/", "nickname\nhoward\n")
+	requestId = response.Header().Get(REQUEST_ID_HEADER)
+	if response.Code != http.StatusConflict ||
+		!strings.Contains(response.Body.String(), `"request_id":"`+requestId+`"`) {
+		t.Fatalf("Expected the request ID in the error, got %v %v", response.Code, response.Body)
+	}
+	if !strings.Contains(accessLog.String(), "status=409") {
+		t.Fatalf("Expected a 409 in the access log, got %v", accessLog.String())
+	}
+
+	accessLog.Reset()
+	serve("GET", "/healthz", "")
+	if accessLog.Len() != 0 {
+		t.Fatalf("Expected health checks to be left out of the access log: %v", accessLog.String())
+	}
+}
@@ -1,27 +1,360 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/gostevehoward/timeturner"
+	"github.com/gostevehoward/timeturner/timeturnertest"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 var enableSqlLogging = flag.Bool("sql-logging", false, "Log all SQL queries")
+var rowStorageTitles = flag.String(
+	"row-storage-titles", "",
+	"Comma-separated titles to store row by row, for querying in SQL; remembered in the database",
+)
+var contentStoreUrl = flag.String(
+	"content-store", "",
+	"Keep snapshot contents in file:///path or s3://bucket?endpoint=URL instead of the database",
+)
+var ephemeral = flag.Bool(
+	"ephemeral", false, "Keep snapshots in memory instead of timeturner.sqlite, losing them on exit",
+)
+var keepAllHours = flag.Int("keep-all-hours", 0, "Keep every snapshot for this many hours")
+var keepTenMinutelyDays = flag.Int(
+	"keep-ten-minutely-days", 0,
+	"Keep one snapshot per 10 minutes for this many days, then one per hour; if 0, keep them all",
+)
+var retentionDays = flag.Int(
+	"retention-days", 14, "Delete unpinned snapshots after this many days; if 0, keep them forever",
+)
+var compactionInterval = flag.Duration(
+	"compaction-interval", 10*time.Minute, "How often to downsample and delete old snapshots",
+)
+var listenAddress = flag.String("listen", ":8080", "Address to serve on")
+var tlsCertFile = flag.String("tls-cert", "", "PEM certificate to serve HTTPS with")
+var tlsKeyFile = flag.String("tls-key", "", "PEM private key for -tls-cert")
+var tlsClientCaFile = flag.String(
+	"tls-client-ca", "",
+	"PEM CAs for client certificates; if set, only clients with one may write snapshots",
+)
+var clientHostnamesFile = flag.String(
+	"client-hostnames-file", "",
+	"File of \"<common name> <hostname>,<hostname>\" lines; if unset, a client's CN is its hostname",
+)
+var shutdownTimeout = flag.Duration(
+	"shutdown-timeout", 30*time.Second, "How long to wait for in-flight requests on shutdown",
+)
+var writesPerMinute = flag.Float64(
+	"writes-per-minute", 0, "Average writes allowed per host per minute; if 0, unlimited",
+)
+var writeBurst = flag.Int(
+	"write-burst", 10, "Writes a host may make at once under -writes-per-minute",
+)
+var maxSnapshotsPerDay = flag.Int64(
+	"max-snapshots-per-day", 0, "Snapshots each host may write per day; if 0, unlimited",
+)
+var maxBytesPerDay = flag.Int64(
+	"max-bytes-per-day", 0, "Bytes of snapshots each host may write per day; if 0, unlimited",
+)
+var tokensFile = flag.String(
+	"tokens-file", "",
+	"File of \"<identity> <token> <permissions>\" lines; if unset, allow writes but not deletes",
+)
 
-func main() {
+func migrate(connection *sql.DB, arguments []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "List pending migrations without applying them")
+	flags.Parse(arguments)
+
+	database := timeturner.NewDatabase(connection, time.Now, *enableSqlLogging)
+	pending := database.PendingMigrations()
+	if *dryRun {
+		for _, migration := range pending {
+			fmt.Printf("Pending migration %d: %s\n", migration.Version, migration.Name)
+		}
+		fmt.Printf("%d pending migrations\n", len(pending))
+		return
+	}
+	applied := database.Migrate()
+	fmt.Printf("Applied %d migrations\n", len(applied))
+}
+
+func export(database timeturner.Database, arguments []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	start := flags.String("start", "", "Export snapshots from this date or \"date time\" on")
+	end := flags.String("end", "", "Export snapshots before this date or \"date time\"")
+	hostnames := flags.String("hosts", "", "Comma-separated hosts to export; if unset, all of them")
+	output := flags.String("o", "", "File to write the archive to; if unset, standard output")
+	flags.Parse(arguments)
+
+	filter, err := timeturner.ParseArchiveFilter(*start, *end, *hostnames)
+	if err != nil {
+		log.Fatalf("Invalid filter: %v", err)
+	}
+	writer := os.Stdout
+	if *output != "" {
+		if writer, err = os.Create(*output); err != nil {
+			log.Fatalf("Failed to create archive: %v", err)
+		}
+	}
+	snapshotCount, err := timeturner.ExportArchive(database, writer, filter, time.Now())
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		log.Fatalf("Failed to export: %v", err)
+	}
+	log.Printf("Exported %d snapshots\n", snapshotCount)
+}
+
+func importArchives(database timeturner.Database, arguments []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	pin := flags.Bool(
+		"pin", false, "Pin each host and title's imported times, so retention keeps them",
+	)
+	flags.Parse(arguments)
+	for _, path := range flags.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to open archive: %v", err)
+		}
+		imported, skipped, err := timeturner.ImportArchive(database, file, path, *pin)
+		file.Close()
+		if err != nil {
+			log.Fatalf("Failed to import %s after %d snapshots: %v", path, imported, err)
+		}
+		fmt.Printf("Imported %d snapshots from %s, skipped %d that already existed\n",
+			imported, path, skipped)
+	}
+}
+
+func openConnection() *sql.DB {
 	connection, err := sql.Open("sqlite3", "./timeturner.sqlite")
 	if err != nil {
 		panic(err)
 	}
-	defer connection.Close()
+	return connection
+}
 
+func openDatabase(connection *sql.DB) *timeturner.TimeturnerDatabase {
 	database := timeturner.InitializeDatabase(connection, time.Now, *enableSqlLogging)
-	app := timeturner.MakeApp(database)
-	http.Handle("/", app.Router)
-	log.Print("Running on localhost:8080")
-	http.ListenAndServe(":8080", nil)
+	if *contentStoreUrl != "" {
+		store, err := timeturner.OpenContentStore(*contentStoreUrl)
+		if err != nil {
+			log.Fatalf("Failed to open content store: %v", err)
+		}
+		database.UseContentStore(store)
+	}
+	if *rowStorageTitles != "" {
+		database.UseRowStorage(strings.Split(*rowStorageTitles, ","))
+	}
+	useRetentionPolicy(database)
+	return database
+}
+
+// compactingDatabase is a database that applies a retention policy.
+type compactingDatabase interface {
+	timeturner.Database
+	UseRetentionPolicy(policy timeturner.RetentionPolicy) error
+	UseMetrics(metrics *timeturner.Metrics)
+	Compact() int64
+}
+
+func useRetentionPolicy(database compactingDatabase) {
+	err := database.UseRetentionPolicy(timeturner.RetentionPolicy{
+		KeepAllFor:         time.Duration(*keepAllHours) * time.Hour,
+		KeepTenMinutelyFor: time.Duration(*keepTenMinutelyDays) * 24 * time.Hour,
+		MaxAge:             time.Duration(*retentionDays) * 24 * time.Hour,
+	})
+	if err != nil {
+		log.Fatalf("Invalid retention policy: %v", err)
+	}
+}
+
+// compactPeriodically applies the retention policy every interval until the context is done.
+func compactPeriodically(ctx context.Context, database compactingDatabase,
+	interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if deleted := database.Compact(); deleted > 0 {
+				log.Printf("Compaction deleted %d snapshots\n", deleted)
+			}
+		}
+	}
+}
+
+// serve handles requests until the context is done, then waits up to -shutdown-timeout for
+// in-flight requests to finish.
+func serve(ctx context.Context, handler http.Handler, tlsConfig *tls.Config) error {
+	server := &http.Server{
+		Addr:              *listenAddress,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		// Long enough to upload a large snapshot over a slow link.
+		ReadTimeout:  5 * time.Minute,
+		WriteTimeout: 5 * time.Minute,
+		IdleTimeout:  2 * time.Minute,
+	}
+	serverErrors := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			log.Printf("Running on https://%s\n", *listenAddress)
+			serverErrors <- server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Running on http://%s\n", *listenAddress)
+			serverErrors <- server.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-serverErrors:
+		return err
+	case <-ctx.Done():
+	}
+	log.Print("Shutting down, waiting for in-flight requests")
+	shutdownContext, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownContext)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			"Usage: %s [flags] [migrate [-dry-run] | export [export flags] | import archive.tar...]\n",
+			os.Args[0],
+		)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	authorizer := make(timeturner.Authorizer)
+	if *tokensFile != "" {
+		var err error
+		authorizer, err = timeturner.LoadAuthorizerFile(*tokensFile)
+		if err != nil {
+			log.Fatalf("Failed to load tokens: %v", err)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if *tlsCertFile != "" || *tlsKeyFile != "" {
+		var err error
+		tlsConfig, err = timeturner.LoadTLSConfig(*tlsCertFile, *tlsKeyFile, *tlsClientCaFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS configuration: %v", err)
+		}
+	} else if *tlsClientCaFile != "" {
+		log.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+	clientHostnames := make(map[string][]string)
+	if *clientHostnamesFile != "" {
+		if *tlsClientCaFile == "" {
+			log.Fatal("-client-hostnames-file requires -tls-client-ca")
+		}
+		var err error
+		clientHostnames, err = timeturner.LoadClientHostnamesFile(*clientHostnamesFile)
+		if err != nil {
+			log.Fatalf("Failed to load client hostnames: %v", err)
+		}
+	}
+
+	if *ephemeral && (*contentStoreUrl != "" || *rowStorageTitles != "") {
+		log.Fatal("-content-store and -row-storage-titles can't be used with -ephemeral")
+	}
+	if flag.NArg() > 0 {
+		if *ephemeral {
+			flag.Usage()
+			os.Exit(2)
+		}
+		connection := openConnection()
+		defer connection.Close()
+		switch flag.Arg(0) {
+		case "migrate":
+			migrate(connection, flag.Args()[1:])
+		case "export":
+			export(openDatabase(connection), flag.Args()[1:])
+		case "import":
+			importArchives(openDatabase(connection), flag.Args()[1:])
+		default:
+			flag.Usage()
+			os.Exit(2)
+		}
+		return
+	}
+
+	signalContext, stopSignals := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM,
+	)
+	defer stopSignals()
+
+	var connection *sql.DB
+	var janitor sync.WaitGroup
+	janitorContext, stopJanitor := context.WithCancel(context.Background())
+	var database compactingDatabase
+	if *ephemeral {
+		memoryDatabase := timeturnertest.NewMemoryDatabase(time.Now)
+		useRetentionPolicy(memoryDatabase)
+		database = memoryDatabase
+	} else {
+		connection = openConnection()
+		database = openDatabase(connection)
+	}
+	app := timeturner.MakeApp(database, authorizer)
+	database.UseMetrics(app.Metrics)
+	janitor.Add(1)
+	go func() {
+		defer janitor.Done()
+		compactPeriodically(janitorContext, database, *compactionInterval)
+	}()
+
+	err := app.Limiter.UseLimits(timeturner.IngestionLimits{
+		WritesPerMinute:    *writesPerMinute,
+		WriteBurst:         *writeBurst,
+		MaxSnapshotsPerDay: *maxSnapshotsPerDay,
+		MaxBytesPerDay:     *maxBytesPerDay,
+	})
+	if err != nil {
+		log.Fatalf("Invalid ingestion limits: %v", err)
+	}
+	app.ClientCerts.Required = *tlsClientCaFile != ""
+	app.ClientCerts.Hostnames = clientHostnames
+
+	err = serve(signalContext, app.Handler(), tlsConfig)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// Requests still running may be using the database, so leave it for the OS to close.
+		log.Fatal("ERROR: Requests were still running after -shutdown-timeout, exiting anyway")
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+	}
+	stopJanitor()
+	janitor.Wait()
+	if connection != nil {
+		if closeErr := connection.Close(); closeErr != nil {
+			log.Printf("ERROR: Failed to close the database: %v\n", closeErr)
+			err = closeErr
+		}
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+	log.Print("Shut down cleanly")
 }
@@ -0,0 +1,223 @@
+package timeturner
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// REQUEST_DURATION_BUCKETS are the upper bounds, in seconds, of the request latency histograms.
+var REQUEST_DURATION_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// UNNAMED_ROUTE labels the latency of requests that didn't match a named route.
+const UNNAMED_ROUTE = "unnamed"
+
+// STORAGE_STATS_TTL is how long /metrics serves the same storage stats before summarizing the
+// database again.
+const STORAGE_STATS_TTL = time.Minute
+
+// Metrics counts what the server has done since it started. WriteText exposes the counts in the
+// Prometheus text format, which is served at /metrics. It's safe for concurrent use.
+type Metrics struct {
+	lock               sync.Mutex
+	snapshotsIngested  map[snapshotLabels]int64
+	bytesIngested      map[snapshotLabels]int64
+	requestDurations   map[string]*histogram
+	retentionDeletions int64
+	panicsRecovered    int64
+
+	// storageLock is separate so that loading storage stats doesn't hold up the counters.
+	storageLock     sync.Mutex
+	storageStats    []StorageStats
+	storageLoadedAt time.Time
+	nowFunc         func() time.Time
+}
+
+type snapshotLabels struct {
+	Hostname string
+	Title    string
+}
+
+// histogram counts observations in each of REQUEST_DURATION_BUCKETS, non-cumulatively, plus
+// those past the last bucket.
+type histogram struct {
+	bucketCounts []int64
+	sum          float64
+	count        int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		snapshotsIngested: make(map[snapshotLabels]int64),
+		bytesIngested:     make(map[snapshotLabels]int64),
+		requestDurations:  make(map[string]*histogram),
+		nowFunc:           time.Now,
+	}
+}
+
+// CachedStorageStats returns the storage stats last returned by load, calling it again only once
+// they're older than STORAGE_STATS_TTL, so that scrapes don't each scan every snapshot.
+func (metrics *Metrics) CachedStorageStats(load func() []StorageStats) []StorageStats {
+	metrics.storageLock.Lock()
+	defer metrics.storageLock.Unlock()
+	now := metrics.nowFunc()
+	if metrics.storageLoadedAt.IsZero() || now.Sub(metrics.storageLoadedAt) >= STORAGE_STATS_TTL {
+		metrics.storageStats = load()
+		metrics.storageLoadedAt = now
+	}
+	return metrics.storageStats
+}
+
+// SnapshotIngested counts a snapshot added, or rows appended to one, through the API.
+func (metrics *Metrics) SnapshotIngested(hostname string, title string, byteCount int) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	labels := snapshotLabels{hostname, title}
+	metrics.snapshotsIngested[labels]++
+	metrics.bytesIngested[labels] += int64(byteCount)
+}
+
+func (metrics *Metrics) ObserveRequest(routeName string, duration time.Duration) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	durations, ok := metrics.requestDurations[routeName]
+	if !ok {
+		durations = &histogram{bucketCounts: make([]int64, len(REQUEST_DURATION_BUCKETS)+1)}
+		metrics.requestDurations[routeName] = durations
+	}
+	seconds := duration.Seconds()
+	durations.bucketCounts[sort.SearchFloat64s(REQUEST_DURATION_BUCKETS, seconds)]++
+	durations.sum += seconds
+	durations.count++
+}
+
+func (metrics *Metrics) RetentionDeleted(count int64) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.retentionDeletions += count
+}
+
+func (metrics *Metrics) PanicRecovered() {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.panicsRecovered++
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders alternating label names and values as {name="value",...}.
+func formatLabels(namesAndValues ...string) string {
+	pairs := make([]string, 0, len(namesAndValues)/2)
+	for i := 0; i+1 < len(namesAndValues); i += 2 {
+		pairs = append(
+			pairs, namesAndValues[i]+`="`+labelValueEscaper.Replace(namesAndValues[i+1])+`"`,
+		)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeMetricHeader(writer io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeSnapshotCounter(writer io.Writer, name string, help string,
+	counts map[snapshotLabels]int64) {
+	writeMetricHeader(writer, name, "counter", help)
+	labels := make([]snapshotLabels, 0, len(counts))
+	for label := range counts {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].Hostname != labels[j].Hostname {
+			return labels[i].Hostname < labels[j].Hostname
+		}
+		return labels[i].Title < labels[j].Title
+	})
+	for _, label := range labels {
+		fmt.Fprintf(
+			writer, "%s%s %d\n",
+			name, formatLabels("hostname", label.Hostname, "title", label.Title), counts[label],
+		)
+	}
+}
+
+func writeStorageGauge(writer io.Writer, name string, help string, stats []StorageStats,
+	value func(StorageStats) int64) {
+	writeMetricHeader(writer, name, "gauge", help)
+	for _, codecStats := range stats {
+		fmt.Fprintf(writer, "%s%s %d\n", name, formatLabels("codec", codecStats.Codec), value(codecStats))
+	}
+}
+
+// WriteText writes every metric in the Prometheus text format, along with gauges for the given
+// storage stats, which are too expensive to keep up to date on every write; see
+// CachedStorageStats.
+func (metrics *Metrics) WriteText(writer io.Writer, storage []StorageStats) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+
+	writeSnapshotCounter(
+		writer, "timeturner_snapshots_ingested_total",
+		"Snapshots added or appended to through the API.", metrics.snapshotsIngested,
+	)
+	writeSnapshotCounter(
+		writer, "timeturner_ingested_bytes_total",
+		"Bytes of snapshot contents received through the API.", metrics.bytesIngested,
+	)
+
+	writeStorageGauge(
+		writer, "timeturner_stored_snapshots", "Snapshots stored, by codec.", storage,
+		func(stats StorageStats) int64 { return stats.SnapshotCount },
+	)
+	writeStorageGauge(
+		writer, "timeturner_content_bytes", "Uncompressed size of stored snapshots, by codec.",
+		storage, func(stats StorageStats) int64 { return stats.ContentBytes },
+	)
+	writeStorageGauge(
+		writer, "timeturner_stored_bytes", "Bytes taken up by stored snapshots, by codec.",
+		storage, func(stats StorageStats) int64 { return stats.StoredBytes },
+	)
+
+	name := "timeturner_request_duration_seconds"
+	writeMetricHeader(writer, name, "histogram", "Time taken to handle requests, by route.")
+	routeNames := make([]string, 0, len(metrics.requestDurations))
+	for routeName := range metrics.requestDurations {
+		routeNames = append(routeNames, routeName)
+	}
+	sort.Strings(routeNames)
+	for _, routeName := range routeNames {
+		durations := metrics.requestDurations[routeName]
+		var cumulativeCount int64
+		for i, upperBound := range REQUEST_DURATION_BUCKETS {
+			cumulativeCount += durations.bucketCounts[i]
+			fmt.Fprintf(
+				writer, "%s_bucket%s %d\n",
+				name, formatLabels("route", routeName, "le", formatFloat(upperBound)), cumulativeCount,
+			)
+		}
+		fmt.Fprintf(
+			writer, "%s_bucket%s %d\n", name, formatLabels("route", routeName, "le", "+Inf"),
+			durations.count,
+		)
+		fmt.Fprintf(
+			writer, "%s_sum%s %s\n", name, formatLabels("route", routeName), formatFloat(durations.sum),
+		)
+		fmt.Fprintf(writer, "%s_count%s %d\n", name, formatLabels("route", routeName), durations.count)
+	}
+
+	name = "timeturner_retention_deleted_snapshots_total"
+	writeMetricHeader(writer, name, "counter", "Snapshots deleted by the retention policy.")
+	fmt.Fprintf(writer, "%s %d\n", name, metrics.retentionDeletions)
+
+	name = "timeturner_panics_recovered_total"
+	writeMetricHeader(writer, name, "counter", "Panics recovered while handling requests.")
+	fmt.Fprintf(writer, "%s %d\n", name, metrics.panicsRecovered)
+}
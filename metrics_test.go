@@ -0,0 +1,118 @@
+package timeturner
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assertMetricLines(t *testing.T, text string, expectedLines ...string) {
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(text, "\n") {
+		lines[line] = true
+	}
+	for _, expected := range expectedLines {
+		if !lines[expected] {
+			t.Errorf("Missing %q in metrics:\n%s", expected, text)
+		}
+	}
+}
+
+func TestMetricsText(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.SnapshotIngested("host1", "processes", 100)
+	metrics.SnapshotIngested("host1", "processes", 50)
+	metrics.SnapshotIngested("host\"2", "mounts", 10)
+	metrics.ObserveRequest("view snapshot", 20*time.Millisecond)
+	metrics.ObserveRequest("view snapshot", 3*time.Second)
+	metrics.RetentionDeleted(4)
+	metrics.PanicRecovered()
+
+	var text bytes.Buffer
+	metrics.WriteText(&text, []StorageStats{{GZIP_CODEC, 2, 1000, 300}})
+	assertMetricLines(
+		t, text.String(),
+		"# TYPE timeturner_snapshots_ingested_total counter",
+		`timeturner_snapshots_ingested_total{hostname="host1",title="processes"} 2`,
+		`timeturner_snapshots_ingested_total{hostname="host\"2",title="mounts"} 1`,
+		`timeturner_ingested_bytes_total{hostname="host1",title="processes"} 150`,
+		`timeturner_stored_snapshots{codec="gzip"} 2`,
+		`timeturner_content_bytes{codec="gzip"} 1000`,
+		`timeturner_stored_bytes{codec="gzip"} 300`,
+		"# TYPE timeturner_request_duration_seconds histogram",
+		`timeturner_request_duration_seconds_bucket{route="view snapshot",le="0.01"} 0`,
+		`timeturner_request_duration_seconds_bucket{route="view snapshot",le="0.025"} 1`,
+		`timeturner_request_duration_seconds_bucket{route="view snapshot",le="2.5"} 1`,
+		`timeturner_request_duration_seconds_bucket{route="view snapshot",le="5"} 2`,
+		`timeturner_request_duration_seconds_bucket{route="view snapshot",le="+Inf"} 2`,
+		`timeturner_request_duration_seconds_sum{route="view snapshot"} 3.02`,
+		`timeturner_request_duration_seconds_count{route="view snapshot"} 2`,
+		"timeturner_retention_deleted_snapshots_total 4",
+		"timeturner_panics_recovered_total 1",
+	)
+}
+
+func TestCachedStorageStats(t *testing.T) {
+	current := time.Unix(1381017600, 0)
+	metrics := NewMetrics()
+	metrics.nowFunc = func() time.Time { return current }
+	loads := 0
+	load := func() []StorageStats {
+		loads++
+		return []StorageStats{{GZIP_CODEC, int64(loads), 0, 0}}
+	}
+
+	metrics.CachedStorageStats(load)
+	current = current.Add(STORAGE_STATS_TTL - time.Second)
+	if stats := metrics.CachedStorageStats(load); loads != 1 || stats[0].SnapshotCount != 1 {
+		t.Errorf("Expected cached stats within the TTL, got %v after %v loads", stats, loads)
+	}
+	current = current.Add(time.Second)
+	if stats := metrics.CachedStorageStats(load); loads != 2 || stats[0].SnapshotCount != 2 {
+		t.Errorf("Expected fresh stats after the TTL, got %v after %v loads", stats, loads)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	current := time.Unix(1381017600, 0)
+	database := InitializeDatabase(setUpConnection(), func() time.Time { return current }, false)
+	app := MakeApp(database, make(Authorizer))
+	database.UseMetrics(app.Metrics)
+	app.Router.HandleFunc("/panic", app.WrapHandler(func(View) { panic("oops") })).Name("panic")
+
+	serve := func(method string, url string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		app.Router.ServeHTTP(recorder, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return recorder
+	}
+	snapshotUrl := "/2013-10-05/15:32:44/host1/quotes/"
+	if response := serve("PUT", snapshotUrl, "name\nsteve\n"); response.Code != http.StatusOK {
+		t.Fatalf("Failed to add snapshot: %v %v", response.Code, response.Body)
+	}
+	serve("PATCH", snapshotUrl, "name\nhoward\n")
+	serve("GET", snapshotUrl, "")
+	if response := serve("GET", "/panic", ""); response.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected a 500 after a panic, got %v", response.Code)
+	}
+	current = current.Add(15 * 24 * time.Hour)
+	database.Compact()
+
+	response := serve("GET", "/metrics", "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("Failed to get metrics: %v %v", response.Code, response.Body)
+	}
+	assertMetricLines(
+		t, response.Body.String(),
+		`timeturner_snapshots_ingested_total{hostname="host1",title="quotes"} 2`,
+		`timeturner_ingested_bytes_total{hostname="host1",title="quotes"} 23`,
+		`timeturner_request_duration_seconds_count{route="add snapshot"} 1`,
+		`timeturner_request_duration_seconds_count{route="append rows"} 1`,
+		`timeturner_request_duration_seconds_count{route="view snapshot"} 1`,
+		`timeturner_request_duration_seconds_count{route="panic"} 1`,
+		"timeturner_retention_deleted_snapshots_total 1",
+		"timeturner_panics_recovered_total 1",
+	)
+}
@@ -0,0 +1,290 @@
+package timeturner
+
+import (
+	"fmt"
+	"github.com/coopernurse/gorp"
+	"log"
+)
+
+// Migration is one versioned change to the database schema. Migrations run in order of Version,
+// each in its own transaction along with the SchemaMigration row recording it.
+//
+// Databases created before migrations were tracked have no SchemaMigration rows but may already
+// have some of these changes, so every migration must be safe to apply to a schema that already
+// contains it. Migrations also mustn't depend on code that assumes the latest schema.
+type Migration struct {
+	Version int64
+	Name    string
+	apply   func(executor gorp.SqlExecutor) error
+}
+
+// SchemaMigration records a migration that has been applied to the database.
+type SchemaMigration struct {
+	MigrationNumber int64
+	Name            string
+	UnixTimestamp   int64
+}
+
+const SCHEMA_MIGRATION_TABLE = `
+CREATE TABLE IF NOT EXISTS SchemaMigration (
+    MigrationNumber INTEGER NOT NULL PRIMARY KEY,
+    Name VARCHAR(255) NOT NULL,
+    UnixTimestamp INTEGER NOT NULL
+);
+`
+
+var migrations = []Migration{
+	{1, "create snapshot table", execMigration(`
+CREATE TABLE IF NOT EXISTS Snapshot (
+    Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    UnixTimestamp INTEGER NOT NULL,
+    Hostname VARCHAR(255) NOT NULL,
+    Title VARCHAR(255) NOT NULL,
+    CsvContents TEXT NOT NULL
+);
+`)},
+	{2, "create audit log", execMigration(`
+CREATE TABLE IF NOT EXISTS AuditEntry (
+    Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    UnixTimestamp INTEGER NOT NULL,
+    Action VARCHAR(16) NOT NULL,
+    SnapshotUnixTimestamp INTEGER NOT NULL,
+    Hostname VARCHAR(255) NOT NULL,
+    Title VARCHAR(255) NOT NULL,
+    SourceAddress VARCHAR(255) NOT NULL,
+    Identity VARCHAR(255) NOT NULL,
+    ContentHash VARCHAR(64) NOT NULL,
+    PreviousContentHash VARCHAR(64) NOT NULL
+);
+`)},
+	{3, "create snapshot revisions", execMigration(`
+CREATE TABLE IF NOT EXISTS SnapshotRevision (
+    Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    SnapshotId INTEGER NOT NULL,
+    VersionNumber INTEGER NOT NULL,
+    CsvContents TEXT NOT NULL
+);
+`)},
+	{4, "compress snapshot contents", migrateCompression},
+	{5, "deduplicate snapshot contents", migrateContentBlobs},
+	{6, "index snapshots", migrateSnapshotIndexes},
+	{7, "create snapshot rows", execMigration(`
+CREATE TABLE IF NOT EXISTS SnapshotRow (
+    SnapshotId INTEGER NOT NULL,
+    RowNumber INTEGER NOT NULL,
+    Cells TEXT NOT NULL,
+    PRIMARY KEY (SnapshotId, RowNumber)
+);
+`)},
+	{8, "add content store keys", func(executor gorp.SqlExecutor) error {
+		return addColumn(executor, "ContentBlob", "StorageKey", "VARCHAR(255) NOT NULL DEFAULT ''")
+	}},
+	{9, "create pins", execMigration(`
+CREATE TABLE IF NOT EXISTS Pin (
+    Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    UnixTimestamp INTEGER NOT NULL,
+    StartUnixTimestamp INTEGER NOT NULL,
+    EndUnixTimestamp INTEGER NOT NULL,
+    Hostname VARCHAR(255) NOT NULL,
+    Title VARCHAR(255) NOT NULL,
+    Note TEXT NOT NULL,
+    Identity VARCHAR(255) NOT NULL
+);
+`)},
+	{10, "create annotations", execMigration(`
+CREATE TABLE IF NOT EXISTS Annotation (
+    Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    UnixTimestamp INTEGER NOT NULL,
+    StartUnixTimestamp INTEGER NOT NULL,
+    EndUnixTimestamp INTEGER NOT NULL,
+    Text TEXT NOT NULL,
+    Identity VARCHAR(255) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS AnnotationWindow ON Annotation (StartUnixTimestamp, EndUnixTimestamp);
+`)},
+	{11, "create row storage titles", execMigration(`
+CREATE TABLE IF NOT EXISTS RowStorageTitle (
+    Title VARCHAR(255) NOT NULL PRIMARY KEY
+);
+`)},
+	{12, "create daily usage", execMigration(`
+CREATE TABLE IF NOT EXISTS DailyUsage (
+    Hostname VARCHAR(255) NOT NULL,
+    UnixDay INTEGER NOT NULL,
+    Snapshots INTEGER NOT NULL,
+    Bytes INTEGER NOT NULL,
+    Rejected INTEGER NOT NULL,
+    PRIMARY KEY (Hostname, UnixDay)
+);
+`)},
+}
+
+func execMigration(statements string) func(gorp.SqlExecutor) error {
+	return func(executor gorp.SqlExecutor) error {
+		_, err := executor.Exec(statements)
+		return err
+	}
+}
+
+func hasColumn(executor gorp.SqlExecutor, table string, column string) (bool, error) {
+	count, err := executor.SelectInt(
+		"SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column,
+	)
+	return count > 0, err
+}
+
+// addColumn adds a column unless the table already has it.
+func addColumn(executor gorp.SqlExecutor, table string, column string, definition string) error {
+	exists, err := hasColumn(executor, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = executor.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+const compressionMigrationBatchSize = 100
+
+// migrateCompression adds the compression columns and compresses the snapshots stored before
+// compression existed, which have LEGACY_CODEC.
+func migrateCompression(executor gorp.SqlExecutor) error {
+	err := addColumn(executor, "Snapshot", "Codec", "VARCHAR(16) NOT NULL DEFAULT ''")
+	if err == nil {
+		err = addColumn(executor, "Snapshot", "ContentLength", "INTEGER NOT NULL DEFAULT 0")
+	}
+	query := "SELECT Id, UnixTimestamp, Hostname, Title, CsvContents, Codec, ContentLength " +
+		"FROM Snapshot WHERE Codec = ? ORDER BY Id LIMIT ?"
+	for err == nil {
+		var rows []Snapshot
+		_, err = executor.Select(&rows, query, LEGACY_CODEC, compressionMigrationBatchSize)
+		if err != nil || len(rows) == 0 {
+			break
+		}
+		log.Printf("Compressing %d snapshots\n", len(rows))
+		for index := range rows {
+			rows[index].encodeContents()
+			_, err = executor.Exec(
+				"UPDATE Snapshot SET CsvContents = ?, Codec = ?, ContentLength = ? WHERE Id = ?",
+				rows[index].CsvContents, rows[index].Codec, rows[index].ContentLength, rows[index].Id,
+			)
+			if err != nil {
+				break
+			}
+		}
+	}
+	return err
+}
+
+func migrateContentBlobs(executor gorp.SqlExecutor) error {
+	err := addColumn(executor, "Snapshot", "ContentHash", "VARCHAR(64) NOT NULL DEFAULT ''")
+	if err == nil {
+		err = addColumn(
+			executor, "SnapshotRevision", "ContentHash", "VARCHAR(64) NOT NULL DEFAULT ''",
+		)
+	}
+	if err == nil {
+		err = execMigration(`
+CREATE TABLE IF NOT EXISTS ContentBlob (
+    Hash VARCHAR(64) NOT NULL PRIMARY KEY,
+    Codec VARCHAR(16) NOT NULL,
+    ContentLength INTEGER NOT NULL,
+    Contents BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS SnapshotContentHash ON Snapshot (ContentHash);
+CREATE INDEX IF NOT EXISTS SnapshotRevisionContentHash ON SnapshotRevision (ContentHash);
+`)(executor)
+	}
+	return err
+}
+
+// migrateSnapshotIndexes makes (UnixTimestamp, Hostname, Title) unique, keeping the most recently
+// stored of any duplicates, and adds indexes for listing a host's snapshots and revisions. It
+// deletes duplicates with its own SQL rather than deleteWhere, which touches tables added by later
+// migrations.
+func migrateSnapshotIndexes(executor gorp.SqlExecutor) error {
+	duplicates := "SELECT Id FROM Snapshot WHERE Id NOT IN " +
+		"(SELECT MAX(Id) FROM Snapshot GROUP BY UnixTimestamp, Hostname, Title)"
+	duplicateCount, err := executor.SelectInt("SELECT COUNT(*) FROM (" + duplicates + ")")
+	if err == nil && duplicateCount > 0 {
+		log.Printf("Deleting %d duplicate snapshots\n", duplicateCount)
+		err = execMigration(`
+DELETE FROM SnapshotRevision WHERE SnapshotId IN (` + duplicates + `);
+DELETE FROM Snapshot WHERE Id IN (` + duplicates + `);
+DELETE FROM ContentBlob WHERE
+    NOT EXISTS (SELECT 1 FROM Snapshot WHERE ContentHash = Hash) AND
+    NOT EXISTS (SELECT 1 FROM SnapshotRevision WHERE ContentHash = Hash);
+`)(executor)
+	}
+	if err == nil {
+		err = execMigration(`
+CREATE UNIQUE INDEX IF NOT EXISTS SnapshotIdentity ON Snapshot (UnixTimestamp, Hostname, Title);
+CREATE INDEX IF NOT EXISTS SnapshotHost ON Snapshot (Hostname, Title, UnixTimestamp, ContentHash);
+CREATE INDEX IF NOT EXISTS SnapshotRevisionVersion ON SnapshotRevision (SnapshotId, VersionNumber);
+`)(executor)
+	}
+	return err
+}
+
+func (database *TimeturnerDatabase) appliedMigrationVersions() map[int64]bool {
+	tableCount, err := database.mapper.SelectInt(
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'SchemaMigration'",
+	)
+	if err != nil {
+		panic(err)
+	}
+	versions := make(map[int64]bool)
+	if tableCount == 0 {
+		return versions
+	}
+	var applied []SchemaMigration
+	if _, err = database.mapper.Select(&applied, "SELECT * FROM SchemaMigration"); err != nil {
+		panic(err)
+	}
+	for _, migration := range applied {
+		versions[migration.MigrationNumber] = true
+	}
+	return versions
+}
+
+// PendingMigrations lists the migrations that haven't been applied yet, in the order they'll run.
+// It doesn't modify the database.
+func (database *TimeturnerDatabase) PendingMigrations() []Migration {
+	applied := database.appliedMigrationVersions()
+	pending := make([]Migration, 0)
+	for _, migration := range migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending
+}
+
+// Migrate applies every pending migration and returns the ones it applied. A migration that fails
+// is rolled back and panics, leaving the migrations before it applied.
+func (database *TimeturnerDatabase) Migrate() []Migration {
+	if _, err := database.mapper.Exec(SCHEMA_MIGRATION_TABLE); err != nil {
+		panic(err)
+	}
+	pending := database.PendingMigrations()
+	for _, migration := range pending {
+		log.Printf("Applying migration %d: %s\n", migration.Version, migration.Name)
+		transaction, err := database.mapper.Begin()
+		if err != nil {
+			panic(err)
+		}
+		err = migration.apply(transaction)
+		if err == nil {
+			err = transaction.Insert(
+				&SchemaMigration{migration.Version, migration.Name, database.nowFunc().Unix()},
+			)
+		}
+		if err != nil {
+			transaction.Rollback()
+			panic(fmt.Sprintf("Migration %d (%s) failed: %v", migration.Version, migration.Name, err))
+		}
+		if err = transaction.Commit(); err != nil {
+			panic(err)
+		}
+	}
+	return pending
+}
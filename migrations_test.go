@@ -0,0 +1,110 @@
+package timeturner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMigrationsAreRecorded(t *testing.T) {
+	database := setUp().(*TimeturnerDatabase)
+	if pending := database.PendingMigrations(); len(pending) != 0 {
+		t.Fatalf("Migrations still pending after initialization: %v", pending)
+	}
+	count, err := database.mapper.SelectInt("SELECT COUNT(*) FROM SchemaMigration")
+	if err != nil || count != int64(len(migrations)) {
+		t.Fatalf("Expected %d recorded migrations, got %d (%v)", len(migrations), count, err)
+	}
+	if applied := database.Migrate(); len(applied) != 0 {
+		t.Fatalf("Migrations applied twice: %v", applied)
+	}
+}
+
+func TestPendingMigrationsDoesNotModifyDatabase(t *testing.T) {
+	database := NewDatabase(setUpConnection(), func() time.Time { return now }, false)
+	if pending := database.PendingMigrations(); len(pending) != len(migrations) {
+		t.Fatalf("Expected every migration to be pending, got %v", pending)
+	}
+	count, err := database.mapper.SelectInt("SELECT COUNT(*) FROM sqlite_master")
+	if err != nil || count != 0 {
+		t.Fatalf("Listing pending migrations created %d tables (%v)", count, err)
+	}
+}
+
+func TestMigrateUntrackedDatabase(t *testing.T) {
+	connection := setUpConnection()
+	untrackedSchema := "CREATE TABLE Snapshot (Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, " +
+		"UnixTimestamp INTEGER NOT NULL, Hostname VARCHAR(255) NOT NULL, " +
+		"Title VARCHAR(255) NOT NULL, CsvContents TEXT NOT NULL, " +
+		"Codec VARCHAR(16) NOT NULL DEFAULT '', ContentLength INTEGER NOT NULL DEFAULT 0)"
+	if _, err := connection.Exec(untrackedSchema); err != nil {
+		t.Fatalf("Failed to create untracked schema: %v", err)
+	}
+
+	database := InitializeDatabase(connection, func() time.Time { return now }, false)
+	database.AddSnapshot(now, "host1", "processes", wrapSimpleContents("x"), OverwriteOnConflict,
+		Actor{})
+	snapshot, ok := database.GetSnapshotWithContents(now, "host1", "processes")
+	if !ok || snapshot.ContentHash == "" {
+		t.Fatalf("Unexpected snapshot after migrating %v", snapshot)
+	}
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+	database := NewDatabase(setUpConnection(), func() time.Time { return now }, false)
+	savedMigrations := migrations
+	defer func() { migrations = savedMigrations }()
+	migrations = []Migration{
+		{1, "create table", execMigration("CREATE TABLE Example (Id INTEGER)")},
+		{2, "broken", execMigration("CREATE TABLE Broken (Id INTEGER); SELECT * FROM Missing")},
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("Broken migration didn't panic")
+			}
+		}()
+		database.Migrate()
+	}()
+	pending := database.PendingMigrations()
+	if len(pending) != 1 || pending[0].Version != 2 {
+		t.Fatalf("Unexpected pending migrations %v", pending)
+	}
+	count, _ := database.mapper.SelectInt(
+		"SELECT COUNT(*) FROM sqlite_master WHERE name IN ('Example', 'Broken')",
+	)
+	if count != 1 {
+		t.Fatalf("Expected only the successful migration's table, found %d", count)
+	}
+}
+
+func TestSnapshotIndexesMigrationRemovesDuplicates(t *testing.T) {
+	database := NewDatabase(setUpConnection(), func() time.Time { return now }, false)
+	savedMigrations := migrations
+	migrations = savedMigrations[:5]
+	database.Migrate()
+	migrations = savedMigrations
+	for _, contents := range []string{"old", "new"} {
+		_, err := database.mapper.Exec(
+			"INSERT INTO Snapshot (UnixTimestamp, Hostname, Title, CsvContents, Codec) "+
+				"VALUES (?, ?, ?, ?, ?)",
+			now.Unix(), "host1", "processes", dumpCsv(wrapSimpleContents(contents)), NO_CODEC,
+		)
+		if err != nil {
+			t.Fatalf("Failed to insert duplicate: %v", err)
+		}
+	}
+
+	database.Migrate()
+	snapshot, ok := database.GetSnapshotWithContents(now, "host1", "processes")
+	if !ok || snapshot.Contents()[1][0] != "new" {
+		t.Fatalf("Expected the newest duplicate to be kept, got %v", snapshot)
+	}
+	_, err := database.mapper.Exec(
+		"INSERT INTO Snapshot (UnixTimestamp, Hostname, Title, CsvContents) VALUES (?, ?, ?, '')",
+		now.Unix(), "host1", "processes",
+	)
+	if err == nil {
+		t.Fatalf("Inserted a duplicate snapshot despite the unique index")
+	}
+}
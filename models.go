@@ -2,18 +2,25 @@ package timeturner
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/csv"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/coopernurse/gorp"
+	"io"
 	"log"
 	"os"
 	"time"
 )
 
+func readCsv(csvContents string) ([][]string, error) {
+	return csv.NewReader(bytes.NewBufferString(csvContents)).ReadAll()
+}
+
 func parseCsv(csvContents string) [][]string {
-	reader := csv.NewReader(bytes.NewBufferString(csvContents))
-	contents, err := reader.ReadAll()
+	contents, err := readCsv(csvContents)
 	if err != nil {
 		panic(err)
 	} else {
@@ -30,22 +37,38 @@ func dumpCsv(contents [][]string) string {
 	return csvContentsBuffer.String()
 }
 
-const SCHEMA = `
-CREATE TABLE IF NOT EXISTS Snapshot (
-    Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-    UnixTimestamp INTEGER NOT NULL,
-    Hostname VARCHAR(255) NOT NULL,
-    Title VARCHAR(255) NOT NULL,
-    CsvContents TEXT NOT NULL
-);
-`
-
+// Snapshot holds decoded CsvContents everywhere outside of TimeturnerDatabase, which encodes them
+// with Codec on the way into the database. ContentLength is the size of the decoded contents.
+//
+// Contents written with AddSnapshot are stored once per distinct value in the ContentBlob table,
+// keyed by ContentHash, so a snapshot that's identical to the last one costs a single row.
+// Contents streamed in with AppendRows are instead stored inline in the row, with an empty
+// ContentHash, so that appending doesn't rewrite them. Snapshots of titles using row storage keep
+// their data rows in the SnapshotRow table instead; see ROWS_CODEC.
 type Snapshot struct {
 	Id            int64
 	UnixTimestamp int64
 	Hostname      string
 	Title         string
 	CsvContents   string
+	Codec         string
+	ContentLength int64
+	ContentHash   string
+}
+
+func (snapshot *Snapshot) encodeContents() {
+	snapshot.ContentLength = int64(len(snapshot.CsvContents))
+	snapshot.Codec, snapshot.CsvContents = encodeContents(snapshot.CsvContents)
+}
+
+func (snapshot *Snapshot) decodeContents() {
+	snapshot.CsvContents = decodeContents(snapshot.Codec, snapshot.CsvContents)
+}
+
+// inContentStore reports whether a snapshot read with snapshotQuery came back without contents
+// because they're in a ContentStore.
+func (snapshot Snapshot) inContentStore() bool {
+	return snapshot.ContentHash != "" && snapshot.CsvContents == "" && snapshot.ContentLength > 0
 }
 
 func (snapshot Snapshot) Timestamp() time.Time {
@@ -56,74 +79,594 @@ func (snapshot Snapshot) Contents() [][]string {
 	return parseCsv(snapshot.CsvContents)
 }
 
+// SnapshotRevision holds the contents of a snapshot before it was overwritten or appended to. A
+// snapshot's first contents are version 1, and its current contents are one more than its latest
+// revision. Revisions reference a ContentBlob, except ones written before blobs existed, which
+// hold their CsvContents directly.
+type SnapshotRevision struct {
+	Id            int64
+	SnapshotId    int64
+	VersionNumber int64
+	CsvContents   string
+	ContentHash   string
+}
+
+// ContentBlob holds encoded contents, unless they're in a ContentStore under StorageKey. Contents
+// are kept until they've been uploaded there.
+type ContentBlob struct {
+	Hash          string
+	Codec         string
+	ContentLength int64
+	Contents      []byte
+	StorageKey    string
+}
+
+// inContentStoreSql is true for blobs whose contents have been moved to a ContentStore. Blobs
+// with a StorageKey that still have their contents are waiting for uploadBlobs.
+const inContentStoreSql = "(ContentBlob.StorageKey != '' AND length(ContentBlob.Contents) = 0)"
+
+// snapshotQuery selects snapshots along with their contents, wherever those are stored in the
+// database. Contents in a ContentStore are left empty for selectSnapshots to fetch.
+const snapshotQuery = "SELECT Snapshot.Id, Snapshot.UnixTimestamp, Snapshot.Hostname, " +
+	"Snapshot.Title, CASE WHEN " + inContentStoreSql + " THEN '' " +
+	"ELSE COALESCE(ContentBlob.Contents, Snapshot.CsvContents) END AS CsvContents, " +
+	"COALESCE(ContentBlob.Codec, Snapshot.Codec) AS Codec, Snapshot.ContentLength, " +
+	"Snapshot.ContentHash FROM Snapshot LEFT JOIN ContentBlob ON ContentBlob.Hash = " +
+	"Snapshot.ContentHash"
+
+type ConflictMode string
+
+const (
+	OverwriteOnConflict ConflictMode = "overwrite"
+	AppendOnConflict    ConflictMode = "append"
+	RejectOnConflict    ConflictMode = "reject"
+)
+
+var ErrSnapshotExists = errors.New("Snapshot already exists")
+var ErrHeaderMismatch = errors.New("Header doesn't match existing snapshot")
+
+func csvHeader(csvContents string) []string {
+	header, err := csv.NewReader(bytes.NewBufferString(csvContents)).Read()
+	if err != nil && err != io.EOF {
+		panic(err)
+	}
+	return header
+}
+
+func isSameHeader(header1 []string, header2 []string) bool {
+	if len(header1) != len(header2) {
+		return false
+	}
+	for index, columnName := range header1 {
+		if columnName != header2[index] {
+			return false
+		}
+	}
+	return true
+}
+
+// appendRows adds data rows (without a header) to stored CSV contents.
+func appendRows(csvContents string, rows [][]string) string {
+	return csvContents + dumpCsv(rows)
+}
+
+func hashContents(csvContents string) string {
+	hash := sha256.Sum256([]byte(csvContents))
+	return hex.EncodeToString(hash[:])
+}
+
+const (
+	CreateAction    = "create"
+	OverwriteAction = "overwrite"
+	AppendAction    = "append"
+	DeleteAction    = "delete"
+	ImportAction    = "import"
+)
+
+// AuditEntry records one change to a snapshot. PreviousContentHash is the hash of the contents
+// before the change and ContentHash the hash after it, so either may be empty. Rows streamed in
+// with AppendRows record the hash of just those rows instead, since hashing the whole snapshot
+// would mean reading it back. Entries are written in the same transaction as the change they
+// record.
+// Snapshots removed by retention and compaction aren't audited; metrics count them instead.
+type AuditEntry struct {
+	Id                    int64
+	UnixTimestamp         int64
+	Action                string
+	SnapshotUnixTimestamp int64
+	Hostname              string
+	Title                 string
+	SourceAddress         string
+	Identity              string
+	ContentHash           string
+	PreviousContentHash   string
+}
+
+func (entry AuditEntry) Timestamp() time.Time {
+	return time.Unix(entry.UnixTimestamp, 0)
+}
+
+func (entry AuditEntry) SnapshotTimestamp() time.Time {
+	return time.Unix(entry.SnapshotUnixTimestamp, 0)
+}
+
+// Actor identifies who is changing snapshots, for the audit log. Snapshots created by an actor
+// that is Importing are audited as imports, and don't trigger the retention policy.
+type Actor struct {
+	Identity      string
+	SourceAddress string
+	Importing     bool
+}
+
+// Audit starts an entry recording the actor's action on a snapshot.
+func (actor Actor) Audit(action string, snapshot Snapshot) AuditEntry {
+	if action == CreateAction && actor.Importing {
+		action = ImportAction
+	}
+	return AuditEntry{
+		Action:                action,
+		SnapshotUnixTimestamp: snapshot.UnixTimestamp,
+		Hostname:              snapshot.Hostname,
+		Title:                 snapshot.Title,
+		SourceAddress:         actor.SourceAddress,
+		Identity:              actor.Identity,
+	}
+}
+
 type TimeturnerDatabase struct {
-	mapper  gorp.DbMap
-	nowFunc func() time.Time
+	mapper       gorp.DbMap
+	nowFunc      func() time.Time
+	contentStore ContentStore
+	retention    RetentionPolicy
+	metrics      *Metrics
 }
 
-func InitializeDatabase(connection *sql.DB, nowFunc func() time.Time, enableLogging bool,
+// NewDatabase wraps a connection without touching the schema; see Migrate.
+func NewDatabase(connection *sql.DB, nowFunc func() time.Time, enableLogging bool,
 ) *TimeturnerDatabase {
 	mapper := gorp.DbMap{Db: connection, Dialect: gorp.SqliteDialect{}}
 	if enableLogging {
 		mapper.TraceOn("[gorp]", log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile))
 	}
 	mapper.AddTable(Snapshot{}).SetKeys(true, "Id")
+	mapper.AddTable(AuditEntry{}).SetKeys(true, "Id")
+	mapper.AddTable(SnapshotRevision{}).SetKeys(true, "Id")
+	mapper.AddTable(ContentBlob{}).SetKeys(false, "Hash")
+	mapper.AddTable(SchemaMigration{}).SetKeys(false, "MigrationNumber")
+	mapper.AddTable(SnapshotRow{}).SetKeys(false, "SnapshotId", "RowNumber")
+	mapper.AddTable(Pin{}).SetKeys(true, "Id")
+	mapper.AddTable(Annotation{}).SetKeys(true, "Id")
+	mapper.AddTable(RowStorageTitle{}).SetKeys(false, "Title")
+	mapper.AddTable(DailyUsage{}).SetKeys(false, "Hostname", "UnixDay")
+	return &TimeturnerDatabase{mapper, nowFunc, nil, DefaultRetentionPolicy, NewMetrics()}
+}
+
+// UseContentStore writes new content blobs to the given store instead of the database. Blobs
+// already in the database stay there.
+func (database *TimeturnerDatabase) UseContentStore(store ContentStore) {
+	database.contentStore = store
+}
+
+// UseRowStorage stores snapshots with the given titles a row at a time, so they can be queried
+// with SQL. It applies to snapshots written from then on. The titles are recorded in the
+// RowStorageTitle table, so they keep using row storage after a restart.
+func (database *TimeturnerDatabase) UseRowStorage(titles []string) {
+	for _, title := range titles {
+		_, err := database.mapper.Exec(
+			"INSERT OR IGNORE INTO RowStorageTitle (Title) VALUES (?)", title,
+		)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// UseMetrics counts the snapshots deleted by the retention policy in the given metrics.
+func (database *TimeturnerDatabase) UseMetrics(metrics *Metrics) {
+	database.metrics = metrics
+}
+
+// Ping checks that the database connection is usable.
+func (database *TimeturnerDatabase) Ping() error {
+	return database.mapper.Db.Ping()
+}
 
-	_, err := mapper.Exec(SCHEMA)
+// InitializeDatabase wraps a connection and brings its schema up to date.
+func InitializeDatabase(connection *sql.DB, nowFunc func() time.Time, enableLogging bool,
+) *TimeturnerDatabase {
+	database := NewDatabase(connection, nowFunc, enableLogging)
+	database.Migrate()
+	return database
+}
+
+// putBlob stores contents as a blob, unless they're already stored, and returns their hash and
+// codec. With a ContentStore, the blob is given a key named after the snapshot, but its contents
+// stay in the database until uploadBlobs moves them once the transaction has committed, so a
+// rollback leaves nothing behind in the store.
+func (database *TimeturnerDatabase) putBlob(executor gorp.SqlExecutor, snapshot Snapshot,
+	csvContents string) (hash string, codec string) {
+	hash = hashContents(csvContents)
+	existingCodec, err := executor.SelectNullStr("SELECT Codec FROM ContentBlob WHERE Hash = ?", hash)
 	if err != nil {
 		panic(err)
 	}
+	if existingCodec.Valid {
+		return hash, existingCodec.String
+	}
 
-	return &TimeturnerDatabase{mapper, nowFunc}
+	codec, encoded := encodeContents(csvContents)
+	blob := &ContentBlob{hash, codec, int64(len(csvContents)), []byte(encoded), ""}
+	if database.contentStore != nil && len(encoded) > 0 {
+		blob.StorageKey = contentKey(snapshot, hash, codec)
+	}
+	if err = executor.Insert(blob); err != nil {
+		panic(err)
+	}
+	return hash, codec
 }
 
-func (database *TimeturnerDatabase) cleanOldSnapshots() {
-	oldestAllowedTimestamp := database.nowFunc().AddDate(0, 0, -14)
-	query := "DELETE FROM Snapshot WHERE UnixTimestamp < ?"
-	_, err := database.mapper.Exec(query, oldestAllowedTimestamp.Unix())
+// uploadBlobs moves the contents of blobs waiting for the ContentStore there, for the blobs whose
+// hashes hashQuery selects. Blobs that fail to upload keep their contents in the database, and
+// Compact tries them again.
+func (database *TimeturnerDatabase) uploadBlobs(hashQuery string, args ...interface{}) {
+	if database.contentStore == nil {
+		return
+	}
+	var blobs []ContentBlob
+	_, err := database.mapper.Select(
+		&blobs,
+		"SELECT * FROM ContentBlob WHERE StorageKey != '' AND length(Contents) > 0 AND Hash IN ("+
+			hashQuery+")",
+		args...,
+	)
 	if err != nil {
 		panic(err)
 	}
+	for _, blob := range blobs {
+		if err := database.contentStore.Put(blob.StorageKey, blob.Contents); err != nil {
+			log.Printf("Failed to put %v in content store: %v\n", blob.StorageKey, err)
+			continue
+		}
+		result, err := database.mapper.Exec(
+			"UPDATE ContentBlob SET Contents = x'' WHERE Hash = ? AND StorageKey = ?",
+			blob.Hash, blob.StorageKey,
+		)
+		if err != nil {
+			panic(err)
+		}
+		if updated, _ := result.RowsAffected(); updated == 0 {
+			// The blob was deleted while it was being uploaded.
+			database.deleteStoredContents([]string{blob.StorageKey})
+		}
+	}
 }
 
-func (database *TimeturnerDatabase) AddSnapshot(timestamp time.Time, hostname string, title string,
-	contents [][]string) {
-	csvContents := dumpCsv(contents)
+// uploadSnapshotBlobs uploads the blobs of a snapshot and its revisions with uploadBlobs.
+func (database *TimeturnerDatabase) uploadSnapshotBlobs(timestamp time.Time, hostname string,
+	title string) {
+	where := "UnixTimestamp = ? AND Hostname = ? AND Title = ?"
+	database.uploadBlobs(
+		"SELECT ContentHash FROM Snapshot WHERE "+where+" UNION "+
+			"SELECT SnapshotRevision.ContentHash FROM SnapshotRevision "+
+			"JOIN Snapshot ON Snapshot.Id = SnapshotRevision.SnapshotId WHERE "+where,
+		timestamp.Unix(), hostname, title, timestamp.Unix(), hostname, title,
+	)
+}
 
-	snapshot, alreadyExists := database.GetSnapshotWithContents(timestamp, hostname, title)
-	if alreadyExists {
-		snapshot.CsvContents = csvContents
-		numUpdated, err := database.mapper.Update(&snapshot)
-		if err != nil {
+func (database *TimeturnerDatabase) getBlob(executor gorp.SqlExecutor, hash string) string {
+	result, err := executor.Get(ContentBlob{}, hash)
+	if err != nil {
+		panic(err)
+	}
+	if result == nil {
+		panic(fmt.Sprintf("Missing content blob %v", hash))
+	}
+	blob := result.(*ContentBlob)
+	if blob.StorageKey != "" && len(blob.Contents) == 0 {
+		if database.contentStore == nil {
+			panic(fmt.Sprintf("Content blob %v is in a content store, but none is configured", hash))
+		}
+		if blob.Contents, err = database.contentStore.Get(blob.StorageKey); err != nil {
 			panic(err)
 		}
-		if numUpdated != 1 {
-			panic(
-				fmt.Sprintf(
-					"Updated %d rows overwriting snapshot: timestamp=%v, hostname=%v, title=%v",
-					timestamp, hostname, title,
-				),
-			)
+	}
+	return decodeContents(blob.Codec, string(blob.Contents))
+}
+
+// deleteOrphanedBlobs deletes the blobs with the given hashes that nothing refers to anymore,
+// which uses the content hash indexes instead of scanning every blob, and returns the keys of those
+// that were in a ContentStore, to be deleted with deleteStoredContents once the deletion commits.
+func deleteOrphanedBlobs(executor gorp.SqlExecutor, hashes []string) (storageKeys []string,
+	err error) {
+	orphaned := "Hash = ? AND " +
+		"NOT EXISTS (SELECT 1 FROM Snapshot WHERE ContentHash = Hash) AND " +
+		"NOT EXISTS (SELECT 1 FROM SnapshotRevision WHERE ContentHash = Hash)"
+	for _, hash := range hashes {
+		var keys []string
+		_, err = executor.Select(
+			&keys, "SELECT StorageKey FROM ContentBlob WHERE StorageKey != '' AND "+orphaned, hash,
+		)
+		if err == nil {
+			_, err = executor.Exec("DELETE FROM ContentBlob WHERE "+orphaned, hash)
 		}
-	} else {
-		snapshot := &Snapshot{-1, timestamp.Unix(), hostname, title, csvContents}
-		err := database.mapper.Insert(snapshot)
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		storageKeys = append(storageKeys, keys...)
+	}
+	return storageKeys, nil
+}
+
+func (database *TimeturnerDatabase) deleteStoredContents(storageKeys []string) {
+	for _, storageKey := range storageKeys {
+		if database.contentStore == nil {
+			log.Printf("Can't delete %v without a content store\n", storageKey)
+		} else if err := database.contentStore.Delete(storageKey); err != nil {
+			log.Printf("Failed to delete %v from content store: %v\n", storageKey, err)
+		}
+	}
+}
+
+// deleteWhere deletes the snapshots matching the WHERE clause along with their revisions, and
+// returns the hashes of the content blobs they referred to, for collectGarbage to delete once the
+// deletion commits.
+func deleteWhere(executor gorp.SqlExecutor, where string, args ...interface{}) (
+	hashes []string, err error) {
+	// Only the blobs these snapshots refer to can be orphaned by deleting them.
+	_, err = executor.Select(
+		&hashes,
+		"SELECT ContentHash FROM Snapshot WHERE ("+where+") AND ContentHash != '' UNION "+
+			"SELECT ContentHash FROM SnapshotRevision WHERE ContentHash != '' AND SnapshotId IN "+
+			"(SELECT Id FROM Snapshot WHERE "+where+")",
+		append(append([]interface{}{}, args...), args...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	_, err = executor.Exec(
+		"DELETE FROM SnapshotRevision WHERE SnapshotId IN (SELECT Id FROM Snapshot WHERE "+where+")",
+		args...,
+	)
+	if err == nil {
+		_, err = executor.Exec(
+			"DELETE FROM SnapshotRow WHERE SnapshotId IN (SELECT Id FROM Snapshot WHERE "+where+")",
+			args...,
+		)
+	}
+	if err == nil {
+		_, err = executor.Exec("DELETE FROM Snapshot WHERE "+where, args...)
+	}
+	return hashes, err
+}
+
+// collectGarbage deletes the blobs with the given hashes that nothing refers to anymore, in a
+// transaction of its own so deletions don't hold the write lock while blobs are checked, and then
+// deletes their contents from the ContentStore. Blobs left behind by a crash in between are
+// collected by Compact.
+func (database *TimeturnerDatabase) collectGarbage(hashes []string) {
+	if len(hashes) == 0 {
+		return
+	}
+	var storageKeys []string
+	err := database.inTransaction(func(transaction *gorp.Transaction) (err error) {
+		storageKeys, err = deleteOrphanedBlobs(transaction, hashes)
+		return err
+	})
+	if err != nil {
+		panic(err)
+	}
+	database.deleteStoredContents(storageKeys)
+}
+
+// cleanOldSnapshots deletes snapshots past the retention policy's MaxAge, except pinned ones.
+func (database *TimeturnerDatabase) cleanOldSnapshots() {
+	if database.retention.MaxAge == 0 {
+		return
+	}
+	oldestAllowedTimestamp := database.nowFunc().Add(-database.retention.MaxAge)
+	database.metrics.RetentionDeleted(
+		database.compactWhere("UnixTimestamp < ? AND "+notPinned, oldestAllowedTimestamp.Unix()),
+	)
+}
+
+func latestRevision(executor gorp.SqlExecutor, snapshotId int64) int64 {
+	query := "SELECT COALESCE(MAX(VersionNumber), 0) FROM SnapshotRevision WHERE SnapshotId = ?"
+	version, err := executor.SelectInt(query, snapshotId)
+	if err != nil {
+		panic(err)
+	}
+	return version
+}
+
+// inTransaction runs body in a transaction, which is committed if body returns nil and rolled
+// back if it returns an error or panics.
+func (database *TimeturnerDatabase) inTransaction(
+	body func(transaction *gorp.Transaction) error) error {
+	transaction, err := database.mapper.Begin()
+	if err != nil {
+		panic(err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			transaction.Rollback()
+		}
+	}()
+	if err = body(transaction); err != nil {
+		return err
+	}
+	if err = transaction.Commit(); err != nil {
+		panic(err)
+	}
+	committed = true
+	return nil
+}
+
+// AddSnapshot stores new contents and returns their version. If the snapshot already exists, its
+// current contents are kept as a revision and onConflict decides what happens: the new contents
+// replace the old, their data rows are appended to the old, or ErrSnapshotExists is returned.
+// Concurrent calls for the same snapshot are serialized, so they can't create duplicates.
+func (database *TimeturnerDatabase) AddSnapshot(timestamp time.Time, hostname string, title string,
+	contents [][]string, onConflict ConflictMode, actor Actor) (version int64, err error) {
+	created := false
+	err = database.inTransaction(func(transaction *gorp.Transaction) error {
+		snapshot, inserted := insertSnapshot(transaction, timestamp, hostname, title)
+		if !inserted {
+			version, err = database.replaceContents(
+				transaction, timestamp, hostname, title, contents, onConflict, actor,
+			)
+			return err
 		}
+		database.createContents(transaction, &snapshot, contents, actor)
+		created = true
+		version = 1
+		return nil
+	})
+	if err == nil {
+		database.uploadSnapshotBlobs(timestamp, hostname, title)
+	}
+	if created && !actor.Importing {
 		database.cleanOldSnapshots()
 	}
+	return version, err
 }
 
-func (database *TimeturnerDatabase) querySnapshots(query string, args ...interface{}) []Snapshot {
+// insertSnapshot adds an empty snapshot unless it already exists. The snapshot returned only has
+// its Id if it was inserted. Inserting first takes the database's write lock for the rest of the
+// transaction, so concurrent writers of the same snapshot wait for each other instead of both
+// creating it.
+func insertSnapshot(executor gorp.SqlExecutor, timestamp time.Time, hostname string,
+	title string) (snapshot Snapshot, inserted bool) {
+	snapshot = Snapshot{UnixTimestamp: timestamp.Unix(), Hostname: hostname, Title: title}
+	result, err := executor.Exec(
+		"INSERT OR IGNORE INTO Snapshot (UnixTimestamp, Hostname, Title, CsvContents) "+
+			"VALUES (?, ?, ?, '')",
+		timestamp.Unix(), hostname, title,
+	)
+	if err != nil {
+		panic(err)
+	}
+	numInserted, err := result.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	if numInserted == 0 {
+		return snapshot, false
+	}
+	if snapshot.Id, err = result.LastInsertId(); err != nil {
+		panic(err)
+	}
+	return snapshot, true
+}
+
+// createContents stores the contents of a snapshot insertSnapshot just added and audits it.
+func (database *TimeturnerDatabase) createContents(executor gorp.SqlExecutor, snapshot *Snapshot,
+	contents [][]string, actor Actor) {
+	csvContents := dumpCsv(contents)
+	database.storeContents(executor, snapshot, csvContents)
+	entry := actor.Audit(CreateAction, *snapshot)
+	entry.ContentHash = hashContents(csvContents)
+	database.insertAuditEntry(executor, entry)
+}
+
+// replaceContents updates an existing snapshot for AddSnapshot, keeping its current contents as a
+// revision.
+func (database *TimeturnerDatabase) replaceContents(executor gorp.SqlExecutor,
+	timestamp time.Time, hostname string, title string, contents [][]string,
+	onConflict ConflictMode, actor Actor) (version int64, err error) {
+	snapshot, _ := database.getSnapshotWithContents(executor, timestamp, hostname, title)
+	entry := actor.Audit(OverwriteAction, snapshot)
+	csvContents := dumpCsv(contents)
+	switch onConflict {
+	case RejectOnConflict:
+		return 0, ErrSnapshotExists
+	case AppendOnConflict:
+		entry.Action = AppendAction
+		// An empty snapshot has no header yet, so it takes whichever one is appended.
+		if header := csvHeader(snapshot.CsvContents); len(header) > 0 && len(contents) > 0 {
+			if !isSameHeader(header, contents[0]) {
+				return 0, ErrHeaderMismatch
+			}
+			contents = contents[1:]
+		}
+		csvContents = appendRows(snapshot.CsvContents, contents)
+	}
+
+	version = latestRevision(executor, snapshot.Id) + 1
+	previousHash := snapshot.ContentHash
+	if previousHash == "" {
+		previousHash, _ = database.putBlob(executor, snapshot, snapshot.CsvContents)
+	}
+	revision := &SnapshotRevision{-1, snapshot.Id, version, "", previousHash}
+	if err := executor.Insert(revision); err != nil {
+		panic(err)
+	}
+	database.storeContents(executor, &snapshot, csvContents)
+	entry.PreviousContentHash = previousHash
+	entry.ContentHash = hashContents(csvContents)
+	database.insertAuditEntry(executor, entry)
+	return version + 1, nil
+}
+
+// storeContents replaces the contents of an existing snapshot, storing them as rows if its title
+// uses row storage and in a blob otherwise.
+func (database *TimeturnerDatabase) storeContents(executor gorp.SqlExecutor, snapshot *Snapshot,
+	csvContents string) {
+	_, err := executor.Exec("DELETE FROM SnapshotRow WHERE SnapshotId = ?", snapshot.Id)
+	if err != nil {
+		panic(err)
+	}
+	snapshot.ContentLength = int64(len(csvContents))
+	if contents := parseCsv(csvContents); usesRowStorage(executor, snapshot.Title) &&
+		canStoreRows(contents) {
+		snapshot.CsvContents = dumpCsv(contents[:1])
+		snapshot.Codec = ROWS_CODEC
+		snapshot.ContentHash = ""
+		insertRows(executor, snapshot.Id, contents[0], contents[1:], 1)
+	} else {
+		snapshot.CsvContents = ""
+		snapshot.ContentHash, snapshot.Codec = database.putBlob(executor, *snapshot, csvContents)
+	}
+
+	numUpdated, err := executor.Update(snapshot)
+	if err != nil {
+		panic(err)
+	}
+	if numUpdated != 1 {
+		panic(
+			fmt.Sprintf(
+				"Updated %d rows storing snapshot: timestamp=%v, hostname=%v, title=%v",
+				numUpdated, snapshot.Timestamp(), snapshot.Hostname, snapshot.Title,
+			),
+		)
+	}
+}
+
+func (database *TimeturnerDatabase) selectSnapshots(executor gorp.SqlExecutor, query string,
+	args ...interface{}) []Snapshot {
 	var rows []Snapshot
-	_, err := database.mapper.Select(&rows, query, args...)
+	_, err := executor.Select(&rows, query, args...)
 	if err != nil {
 		panic(err)
 	}
+	for index := range rows {
+		if rows[index].inContentStore() {
+			rows[index].CsvContents = database.getBlob(executor, rows[index].ContentHash)
+		} else {
+			rows[index].decodeContents()
+		}
+		if rows[index].Codec == ROWS_CODEC {
+			header := csvHeader(rows[index].CsvContents)
+			rows[index].CsvContents += dumpCsv(loadRows(executor, rows[index].Id, header))
+		}
+	}
 	return rows
 }
 
+func (database *TimeturnerDatabase) querySnapshots(query string, args ...interface{}) []Snapshot {
+	return database.selectSnapshots(&database.mapper, query, args...)
+}
+
 func uniqueTimestamps(snapshots []Snapshot, mapTimestamp func(time.Time) time.Time) []time.Time {
 	timestamps := make([]time.Time, 0)
 	seenMap := make(map[time.Time]bool)
@@ -147,9 +690,15 @@ func (database *TimeturnerDatabase) GetAllDays() []time.Time {
 }
 
 func (database *TimeturnerDatabase) GetTimestamps(day time.Time) []time.Time {
+	return database.GetTimestampsBetween(day, day.AddDate(0, 0, 1))
+}
+
+// GetTimestampsBetween returns the times of the snapshots from start up to end, in order.
+func (database *TimeturnerDatabase) GetTimestampsBetween(start time.Time,
+	end time.Time) []time.Time {
 	query := "SELECT DISTINCT UnixTimestamp FROM Snapshot " +
 		"WHERE UnixTimestamp >= ? AND UnixTimestamp < ? ORDER BY UnixTimestamp"
-	rows := database.querySnapshots(query, day.Unix(), day.AddDate(0, 0, 1).Unix())
+	rows := database.querySnapshots(query, start.Unix(), end.Unix())
 	return uniqueTimestamps(rows, func(timestamp time.Time) time.Time { return timestamp })
 }
 
@@ -163,8 +712,13 @@ func (database *TimeturnerDatabase) GetSnapshots(timestamp time.Time) []Snapshot
 
 func (database *TimeturnerDatabase) GetSnapshotWithContents(timestamp time.Time, hostname string,
 	title string) (snapshot Snapshot, ok bool) {
-	query := "SELECT * FROM Snapshot WHERE UnixTimestamp = ? AND Hostname = ? AND Title = ?"
-	rows := database.querySnapshots(query, timestamp.Unix(), hostname, title)
+	return database.getSnapshotWithContents(&database.mapper, timestamp, hostname, title)
+}
+
+func (database *TimeturnerDatabase) getSnapshotWithContents(executor gorp.SqlExecutor,
+	timestamp time.Time, hostname string, title string) (snapshot Snapshot, ok bool) {
+	query := snapshotQuery + " WHERE UnixTimestamp = ? AND Hostname = ? AND Title = ?"
+	rows := database.selectSnapshots(executor, query, timestamp.Unix(), hostname, title)
 	if len(rows) == 0 {
 		return Snapshot{}, false
 	} else if len(rows) == 1 {
@@ -177,3 +731,318 @@ func (database *TimeturnerDatabase) GetSnapshotWithContents(timestamp time.Time,
 		)
 	}
 }
+
+// GetTitleSnapshots returns every host's snapshot with the title at the timestamp, contents
+// included, ordered by hostname.
+func (database *TimeturnerDatabase) GetTitleSnapshots(timestamp time.Time,
+	title string) []Snapshot {
+	query := snapshotQuery + " WHERE UnixTimestamp = ? AND Title = ? ORDER BY Hostname"
+	return database.querySnapshots(query, timestamp.Unix(), title)
+}
+
+// deletedSnapshotQuery selects what deleteSnapshots returns about each snapshot, leaving out its
+// contents.
+const deletedSnapshotQuery = "SELECT Id, UnixTimestamp, Hostname, Title, Codec, ContentLength, " +
+	"ContentHash FROM Snapshot"
+
+// inlineContentHash hashes the contents of a snapshot stored without a blob, which are in its own
+// row or in SnapshotRow, so they never come from the ContentStore.
+func (database *TimeturnerDatabase) inlineContentHash(executor gorp.SqlExecutor,
+	snapshotId int64) string {
+	rows := database.selectSnapshots(executor, snapshotQuery+" WHERE Snapshot.Id = ?", snapshotId)
+	if len(rows) == 0 {
+		return ""
+	}
+	return hashContents(rows[0].CsvContents)
+}
+
+// deleteSnapshots deletes every snapshot matching the WHERE clause, auditing each deletion, and
+// returns them without their contents.
+func (database *TimeturnerDatabase) deleteSnapshots(actor Actor, where string,
+	args ...interface{}) []Snapshot {
+	var rows []Snapshot
+	var hashes []string
+	err := database.inTransaction(func(transaction *gorp.Transaction) (err error) {
+		query := deletedSnapshotQuery + " WHERE " + where + " ORDER BY UnixTimestamp, Hostname, Title"
+		if _, err = transaction.Select(&rows, query, args...); err != nil {
+			return err
+		}
+		for _, snapshot := range rows {
+			entry := actor.Audit(DeleteAction, snapshot)
+			entry.PreviousContentHash = snapshot.ContentHash
+			if entry.PreviousContentHash == "" {
+				entry.PreviousContentHash = database.inlineContentHash(transaction, snapshot.Id)
+			}
+			database.insertAuditEntry(transaction, entry)
+		}
+		hashes, err = deleteWhere(transaction, where, args...)
+		return err
+	})
+	if err != nil {
+		panic(err)
+	}
+	database.collectGarbage(hashes)
+	return rows
+}
+
+func (database *TimeturnerDatabase) DeleteSnapshot(timestamp time.Time, hostname string,
+	title string, actor Actor) (snapshot Snapshot, ok bool) {
+	rows := database.deleteSnapshots(
+		actor, "UnixTimestamp = ? AND Hostname = ? AND Title = ?", timestamp.Unix(), hostname, title,
+	)
+	if len(rows) == 0 {
+		return Snapshot{}, false
+	}
+	return rows[0], true
+}
+
+func (database *TimeturnerDatabase) DeleteHost(hostname string, actor Actor) []Snapshot {
+	return database.deleteSnapshots(actor, "Hostname = ?", hostname)
+}
+
+func (database *TimeturnerDatabase) DeleteTitle(title string, actor Actor) []Snapshot {
+	return database.deleteSnapshots(actor, "Title = ?", title)
+}
+
+func (database *TimeturnerDatabase) DeleteTimeRange(start time.Time, end time.Time,
+	actor Actor) []Snapshot {
+	return database.deleteSnapshots(
+		actor, "UnixTimestamp >= ? AND UnixTimestamp < ?", start.Unix(), end.Unix(),
+	)
+}
+
+// headerPrefixLength is how much of a snapshot AppendRows reads to find its header row.
+const headerPrefixLength = 64 * 1024
+
+// AppendRows adds data rows to a snapshot in place, creating it if it doesn't exist yet. The first
+// row of contents must match the stored header. Unlike AddSnapshot with AppendOnConflict, the
+// stored contents are extended in SQL instead of being read and rewritten, and no revision is
+// kept, so collectors can cheaply stream rows into a snapshot. Appending to a snapshot whose
+// contents are in a shared blob first copies them into the snapshot row. It all happens in one
+// transaction, so concurrent appends to the same snapshot each keep their rows.
+func (database *TimeturnerDatabase) AppendRows(timestamp time.Time, hostname string, title string,
+	contents [][]string, actor Actor) (created bool, err error) {
+	if len(contents) == 0 {
+		return false, ErrHeaderMismatch
+	}
+	var storageKeys []string
+	err = database.inTransaction(func(transaction *gorp.Transaction) error {
+		snapshot, inserted := insertSnapshot(transaction, timestamp, hostname, title)
+		if inserted {
+			database.createContents(transaction, &snapshot, contents, actor)
+			created = true
+			return nil
+		}
+		var err error
+		storageKeys, err = database.appendRows(transaction, timestamp, hostname, title, contents)
+		if err == nil {
+			entry := actor.Audit(AppendAction, snapshot)
+			entry.ContentHash = hashContents(dumpCsv(contents[1:]))
+			database.insertAuditEntry(transaction, entry)
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	database.deleteStoredContents(storageKeys)
+	if created {
+		database.uploadSnapshotBlobs(timestamp, hostname, title)
+		database.cleanOldSnapshots()
+	}
+	return created, nil
+}
+
+// appendRows appends to an existing snapshot for AppendRows, returning the keys of any blobs
+// detaching it orphaned in the ContentStore.
+func (database *TimeturnerDatabase) appendRows(executor gorp.SqlExecutor, timestamp time.Time,
+	hostname string, title string, contents [][]string) (storageKeys []string, err error) {
+	where := "UnixTimestamp = ? AND Hostname = ? AND Title = ?"
+	var prefixes []Snapshot
+	_, err = executor.Select(
+		&prefixes,
+		"SELECT Id, ContentHash, Snapshot.ContentLength, "+
+			"COALESCE(ContentBlob.Codec, Snapshot.Codec) AS Codec, "+
+			"CASE WHEN "+inContentStoreSql+" THEN '' ELSE COALESCE(substr(CAST("+
+			"COALESCE(ContentBlob.Contents, CsvContents) AS BLOB), 1, ?), '') END AS CsvContents "+
+			"FROM Snapshot LEFT JOIN ContentBlob ON ContentBlob.Hash = ContentHash WHERE "+where,
+		headerPrefixLength, timestamp.Unix(), hostname, title,
+	)
+	if err != nil {
+		panic(err)
+	}
+	prefix := prefixes[0]
+	codec := prefix.Codec
+	var header []string
+	if prefix.inContentStore() {
+		snapshot, _ := database.getSnapshotWithContents(executor, timestamp, hostname, title)
+		header = csvHeader(snapshot.CsvContents)
+	} else {
+		header = csvHeader(decodeContentsPrefix(codec, prefix.CsvContents))
+	}
+	rows := contents[1:]
+	if len(header) == 0 {
+		// An empty snapshot has no header yet, so it takes the appended one.
+		rows = contents
+	} else if !isSameHeader(header, contents[0]) {
+		return nil, ErrHeaderMismatch
+	}
+
+	if codec == ROWS_CODEC {
+		appendStoredRows(executor, prefix.Id, header, contents[1:])
+		return nil, nil
+	}
+	if prefix.ContentHash != "" {
+		codec, storageKeys = database.detachContents(executor, timestamp, hostname, title)
+	}
+
+	// Gzip streams can be concatenated, so even compressed contents can be appended to in place.
+	appendedContents := dumpCsv(rows)
+	_, err = executor.Exec(
+		"UPDATE Snapshot SET CsvContents = CsvContents || ?, ContentLength = ContentLength + ? "+
+			"WHERE "+where,
+		encodeAppendedContents(codec, appendedContents), len(appendedContents),
+		timestamp.Unix(), hostname, title,
+	)
+	if err != nil {
+		panic(err)
+	}
+	return storageKeys, nil
+}
+
+// appendStoredRows appends data rows to a snapshot using row storage.
+func appendStoredRows(executor gorp.SqlExecutor, snapshotId int64, header []string,
+	rows [][]string) {
+	insertRows(executor, snapshotId, header, rows, nextRowNumber(executor, snapshotId))
+	_, err := executor.Exec(
+		"UPDATE Snapshot SET ContentLength = ContentLength + ? WHERE Id = ?",
+		len(dumpCsv(rows)), snapshotId,
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// detachContents copies a snapshot's contents out of its blob and into its own row, so they can be
+// appended to without affecting other snapshots, and returns the codec they're stored with and the
+// keys of blobs left orphaned in the ContentStore. This holds even with a ContentStore, so appended
+// snapshots always live in the database.
+func (database *TimeturnerDatabase) detachContents(executor gorp.SqlExecutor, timestamp time.Time,
+	hostname string, title string) (codec string, storageKeys []string) {
+	snapshot, _ := database.getSnapshotWithContents(executor, timestamp, hostname, title)
+	previousHash := snapshot.ContentHash
+	snapshot.ContentHash = ""
+	snapshot.encodeContents()
+	if _, err := executor.Update(&snapshot); err != nil {
+		panic(err)
+	}
+	storageKeys, err := deleteOrphanedBlobs(executor, []string{previousHash})
+	if err != nil {
+		panic(err)
+	}
+	return snapshot.Codec, storageKeys
+}
+
+// GetSnapshotVersions lists the versions of a snapshot, oldest first, ending with the current one.
+func (database *TimeturnerDatabase) GetSnapshotVersions(timestamp time.Time, hostname string,
+	title string) []int64 {
+	snapshot, ok := database.GetSnapshotWithContents(timestamp, hostname, title)
+	if !ok {
+		return nil
+	}
+	versions := make([]int64, 0)
+	for version := int64(1); version <= latestRevision(&database.mapper, snapshot.Id)+1; version++ {
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+// GetSnapshotVersion is like GetSnapshotWithContents, but with contents as of the given version.
+func (database *TimeturnerDatabase) GetSnapshotVersion(timestamp time.Time, hostname string,
+	title string, version int64) (snapshot Snapshot, ok bool) {
+	snapshot, ok = database.GetSnapshotWithContents(timestamp, hostname, title)
+	if !ok || version == latestRevision(&database.mapper, snapshot.Id)+1 {
+		return
+	}
+	var revisions []SnapshotRevision
+	query := "SELECT * FROM SnapshotRevision WHERE SnapshotId = ? AND VersionNumber = ?"
+	_, err := database.mapper.Select(&revisions, query, snapshot.Id, version)
+	if err != nil {
+		panic(err)
+	}
+	if len(revisions) == 0 {
+		return Snapshot{}, false
+	}
+	if revisions[0].ContentHash != "" {
+		snapshot.CsvContents = database.getBlob(&database.mapper, revisions[0].ContentHash)
+	} else {
+		snapshot.CsvContents = revisions[0].CsvContents
+	}
+	return snapshot, true
+}
+
+// GetUnchangedSince finds the snapshots at the given time whose contents haven't changed since an
+// earlier snapshot of the same host and title. Each is returned with the timestamp of the
+// earliest snapshot in that unchanged run.
+func (database *TimeturnerDatabase) GetUnchangedSince(timestamp time.Time) []Snapshot {
+	query := "SELECT Hostname, Title, UnixTimestamp FROM (" +
+		"SELECT Current.Hostname, Current.Title, (" +
+		"SELECT MIN(Earlier.UnixTimestamp) FROM Snapshot Earlier " +
+		"WHERE Earlier.Hostname = Current.Hostname AND Earlier.Title = Current.Title " +
+		"AND Earlier.UnixTimestamp > COALESCE((" +
+		"SELECT MAX(Changed.UnixTimestamp) FROM Snapshot Changed " +
+		"WHERE Changed.Hostname = Current.Hostname AND Changed.Title = Current.Title " +
+		"AND Changed.UnixTimestamp < Current.UnixTimestamp " +
+		"AND Changed.ContentHash != Current.ContentHash), -1)" +
+		") AS UnixTimestamp FROM Snapshot Current " +
+		"WHERE Current.UnixTimestamp = ? AND Current.ContentHash != ''" +
+		") WHERE UnixTimestamp < ? ORDER BY Hostname, Title"
+	return database.querySnapshots(query, timestamp.Unix(), timestamp.Unix())
+}
+
+// GetStorageStats summarizes how much space snapshot contents take up, by codec. Contents shared
+// by several snapshots through a blob are counted once in StoredBytes but once per snapshot in
+// ContentBytes, so deduplication shows up as bytes saved too.
+func (database *TimeturnerDatabase) GetStorageStats() []StorageStats {
+	var stats []StorageStats
+	query := "SELECT Codec, SUM(SnapshotCount) AS SnapshotCount, " +
+		"SUM(ContentBytes) AS ContentBytes, SUM(StoredBytes) AS StoredBytes FROM (" +
+		"SELECT CASE WHEN " + inContentStoreSql + " THEN '" + EXTERNAL_STORAGE + "' " +
+		"ELSE COALESCE(ContentBlob.Codec, Snapshot.Codec) END AS Codec, 1 AS SnapshotCount, " +
+		"Snapshot.ContentLength AS ContentBytes, " +
+		"length(CAST(Snapshot.CsvContents AS BLOB)) AS StoredBytes " +
+		"FROM Snapshot LEFT JOIN ContentBlob ON ContentBlob.Hash = Snapshot.ContentHash " +
+		"UNION ALL SELECT CASE WHEN " + inContentStoreSql + " THEN '" + EXTERNAL_STORAGE + "' " +
+		"ELSE Codec END, 0, 0, length(Contents) FROM ContentBlob " +
+		"UNION ALL SELECT '" + ROWS_CODEC + "', 0, 0, length(CAST(Cells AS BLOB)) FROM SnapshotRow" +
+		") GROUP BY Codec ORDER BY Codec"
+	_, err := database.mapper.Select(&stats, query)
+	if err != nil {
+		panic(err)
+	}
+	return stats
+}
+
+// AddAuditEntry stores the entry, stamped with the current time.
+func (database *TimeturnerDatabase) AddAuditEntry(entry AuditEntry) {
+	database.insertAuditEntry(&database.mapper, entry)
+}
+
+func (database *TimeturnerDatabase) insertAuditEntry(executor gorp.SqlExecutor, entry AuditEntry) {
+	entry.Id = -1
+	entry.UnixTimestamp = database.nowFunc().Unix()
+	if err := executor.Insert(&entry); err != nil {
+		panic(err)
+	}
+}
+
+// GetAuditEntries returns up to limit entries, newest first.
+func (database *TimeturnerDatabase) GetAuditEntries(limit int) []AuditEntry {
+	var rows []AuditEntry
+	query := "SELECT * FROM AuditEntry ORDER BY UnixTimestamp DESC, Id DESC LIMIT ?"
+	_, err := database.mapper.Select(&rows, query, limit)
+	if err != nil {
+		panic(err)
+	}
+	return rows
+}
@@ -2,19 +2,41 @@ package timeturner
 
 import (
 	"database/sql"
+	"errors"
 	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
 
 var now time.Time = time.Date(2013, 10, 6, 0, 0, 0, 0, time.Local)
 
-func setUp() Database {
+func setUpConnection() *sql.DB {
 	connection, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
 		panic(err)
 	}
-	return InitializeDatabase(connection, func() time.Time { return now }, false)
+	connection.SetMaxOpenConns(1)
+	return connection
+}
+
+// setUpFileConnection opens a database file that, unlike :memory:, can be shared by several
+// connections, so concurrent writers really do run concurrently.
+func setUpFileConnection(t *testing.T) *sql.DB {
+	connection, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "timeturner.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connection.Close() })
+	return connection
+}
+
+func setUp() Database {
+	return InitializeDatabase(setUpConnection(), func() time.Time { return now }, false)
 }
 
 func wrapSimpleContents(contents string) [][]string {
@@ -28,7 +50,7 @@ func addTimestampTestData(database Database) {
 	secondTime := now.Add(1 * time.Hour)
 	thirdTime := now.Add(24 * time.Hour)
 	for _, timestamp := range []time.Time{now, secondTime, thirdTime} {
-		database.AddSnapshot(timestamp, "host1", "processes", [][]string{})
+		database.AddSnapshot(timestamp, "host1", "processes", [][]string{}, OverwriteOnConflict, Actor{})
 	}
 }
 
@@ -62,23 +84,36 @@ func TestGetTimestamps(t *testing.T) {
 			t.Fatalf("Unexpected timestamp at %d: %v", index, timestamps)
 		}
 		if timestamp.Location() != time.Local {
-			t.Fatalf("Expected local timezone, got %b", timestamp.Location())
+			t.Fatalf("Expected local timezone, got %v", timestamp.Location())
 		}
 	}
 }
 
+func TestGetTimestampsBetween(t *testing.T) {
+	database := setUp()
+	addTimestampTestData(database)
+	timestamps := database.GetTimestampsBetween(now.Add(time.Hour), now.Add(25*time.Hour))
+	if len(timestamps) != 2 || !timestamps[0].Equal(now.Add(time.Hour)) ||
+		!timestamps[1].Equal(now.Add(24*time.Hour)) {
+		t.Fatalf("Unexpected timestamps: %v", timestamps)
+	}
+}
+
 func TestGetSnapshots(t *testing.T) {
 	database := setUp()
 
 	data := []Snapshot{
-		{-1, now.Unix(), "host1", "processes", ""},
-		{-1, now.Unix(), "host1", "queries", ""},
-		{-1, now.Unix(), "host2", "processes", ""},
-		{-1, now.Add(time.Hour).Unix(), "host2", "queries", ""},
+		{UnixTimestamp: now.Unix(), Hostname: "host1", Title: "processes"},
+		{UnixTimestamp: now.Unix(), Hostname: "host1", Title: "queries"},
+		{UnixTimestamp: now.Unix(), Hostname: "host2", Title: "processes"},
+		{UnixTimestamp: now.Add(time.Hour).Unix(), Hostname: "host2", Title: "queries"},
 	}
 
 	for _, snapshot := range data {
-		database.AddSnapshot(snapshot.Timestamp(), snapshot.Hostname, snapshot.Title, [][]string{})
+		database.AddSnapshot(
+			snapshot.Timestamp(), snapshot.Hostname, snapshot.Title, [][]string{}, OverwriteOnConflict,
+			Actor{},
+		)
 	}
 
 	snapshots := database.GetSnapshots(now)
@@ -95,8 +130,10 @@ func TestGetSnapshots(t *testing.T) {
 func TestGetSnapshotWithContents(t *testing.T) {
 	database := setUp()
 
-	database.AddSnapshot(now, "host1", "processes", wrapSimpleContents("other data"))
-	database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("Hello world!"))
+	database.AddSnapshot(now, "host1", "processes", wrapSimpleContents("other data"),
+		OverwriteOnConflict, Actor{})
+	database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("Hello world!"),
+		OverwriteOnConflict, Actor{})
 
 	snapshot, ok := database.GetSnapshotWithContents(now, "host1", "queries")
 	if !ok {
@@ -104,7 +141,7 @@ func TestGetSnapshotWithContents(t *testing.T) {
 	}
 	expectedContents := "column\nHello world!\n"
 	if snapshot.CsvContents != expectedContents {
-		t.Fatalf("Unexpected contents: %v", snapshot.Contents)
+		t.Fatalf("Unexpected contents: %v", snapshot.Contents())
 	}
 
 	_, ok = database.GetSnapshotWithContents(now, "host2", "foobar")
@@ -113,12 +150,32 @@ func TestGetSnapshotWithContents(t *testing.T) {
 	}
 }
 
+func TestGetTitleSnapshots(t *testing.T) {
+	database := setUp()
+	database.AddSnapshot(now, "host2", "queries", wrapSimpleContents("two"), OverwriteOnConflict,
+		Actor{})
+	database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("one"), OverwriteOnConflict,
+		Actor{})
+	database.AddSnapshot(now, "host1", "processes", wrapSimpleContents("x"), OverwriteOnConflict,
+		Actor{})
+	database.AddSnapshot(now.Add(time.Hour), "host3", "queries", wrapSimpleContents("y"),
+		OverwriteOnConflict, Actor{})
+
+	snapshots := database.GetTitleSnapshots(now, "queries")
+	if len(snapshots) != 2 || snapshots[0].Hostname != "host1" || snapshots[1].Hostname != "host2" {
+		t.Fatalf("Unexpected snapshots %v", snapshots)
+	}
+	if snapshots[0].CsvContents != "column\none\n" {
+		t.Fatalf("Unexpected contents %v", snapshots[0].Contents())
+	}
+}
+
 func TestCleanOldSnapshots(t *testing.T) {
 	database := setUp()
 
-	database.AddSnapshot(now, "host1", "processes", [][]string{})
+	database.AddSnapshot(now, "host1", "processes", [][]string{}, OverwriteOnConflict, Actor{})
 	now = now.AddDate(0, 0, 100)
-	database.AddSnapshot(now, "host2", "queries", [][]string{})
+	database.AddSnapshot(now, "host2", "queries", [][]string{}, OverwriteOnConflict, Actor{})
 
 	days := database.GetAllDays()
 	if len(days) != 1 {
@@ -129,8 +186,10 @@ func TestCleanOldSnapshots(t *testing.T) {
 func TestOverwriteExistingSnapshot(t *testing.T) {
 	database := setUp()
 
-	database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("hello world"))
-	database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("goodbye cruel world"))
+	database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("hello world"),
+		OverwriteOnConflict, Actor{})
+	database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("goodbye cruel world"),
+		OverwriteOnConflict, Actor{})
 
 	snapshots := database.GetSnapshots(now)
 	if len(snapshots) != 1 {
@@ -139,6 +198,553 @@ func TestOverwriteExistingSnapshot(t *testing.T) {
 
 	snapshot, _ := database.GetSnapshotWithContents(now, "host1", "queries")
 	if snapshot.Contents()[1][0] != "goodbye cruel world" {
-		t.Fatalf("Unexpected contents: %v", snapshot.Contents)
+		t.Fatalf("Unexpected contents: %v", snapshot.Contents())
+	}
+}
+
+func addDeleteTestData(database Database) {
+	database.AddSnapshot(now, "host1", "processes", wrapSimpleContents("1"), OverwriteOnConflict,
+		Actor{})
+	database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("2"), OverwriteOnConflict,
+		Actor{})
+	database.AddSnapshot(now, "host2", "processes", wrapSimpleContents("3"), OverwriteOnConflict,
+		Actor{})
+	database.AddSnapshot(now.Add(time.Hour), "host2", "queries", wrapSimpleContents("4"),
+		OverwriteOnConflict, Actor{})
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	database := setUp()
+	addDeleteTestData(database)
+
+	snapshot, ok := database.DeleteSnapshot(now, "host1", "queries", Actor{})
+	if !ok || snapshot.Hostname != "host1" || snapshot.Title != "queries" ||
+		snapshot.ContentHash != hashContents(dumpCsv(wrapSimpleContents("2"))) {
+		t.Fatalf("Unexpected deleted snapshot %v", snapshot)
+	}
+	if _, ok = database.GetSnapshotWithContents(now, "host1", "queries"); ok {
+		t.Fatalf("Snapshot still exists after deleting it")
+	}
+	if _, ok = database.DeleteSnapshot(now, "host1", "queries", Actor{}); ok {
+		t.Fatalf("Deleted nonexistent snapshot")
+	}
+	if snapshots := database.GetSnapshots(now); len(snapshots) != 2 {
+		t.Fatalf("Unexpected remaining snapshots: %v", snapshots)
+	}
+}
+
+func TestBulkDeletes(t *testing.T) {
+	database := setUp()
+	addDeleteTestData(database)
+	if deleted := database.DeleteHost("host2", Actor{}); len(deleted) != 2 {
+		t.Fatalf("Unexpected snapshots deleted for host: %v", deleted)
+	}
+	if snapshots := database.GetSnapshots(now); len(snapshots) != 2 {
+		t.Fatalf("Unexpected remaining snapshots: %v", snapshots)
+	}
+
+	database = setUp()
+	addDeleteTestData(database)
+	if deleted := database.DeleteTitle("processes", Actor{}); len(deleted) != 2 {
+		t.Fatalf("Unexpected snapshots deleted for title: %v", deleted)
+	}
+
+	database = setUp()
+	addDeleteTestData(database)
+	deleted := database.DeleteTimeRange(now.Add(time.Minute), now.Add(2*time.Hour), Actor{})
+	if len(deleted) != 1 || deleted[0].Title != "queries" {
+		t.Fatalf("Unexpected snapshots deleted for time range: %v", deleted)
+	}
+	if timestamps := database.GetTimestamps(now); len(timestamps) != 1 {
+		t.Fatalf("Unexpected remaining timestamps: %v", timestamps)
+	}
+}
+
+func TestAuditEntries(t *testing.T) {
+	database := setUp()
+	for _, action := range []string{CreateAction, OverwriteAction, DeleteAction} {
+		database.AddAuditEntry(AuditEntry{Action: action, Hostname: "host1", Title: "queries"})
+	}
+
+	entries := database.GetAuditEntries(2)
+	if len(entries) != 2 || entries[0].Action != DeleteAction || entries[1].Action != OverwriteAction {
+		t.Fatalf("Unexpected audit entries %v", entries)
+	}
+	if !entries[0].Timestamp().Equal(now) {
+		t.Fatalf("Expected audit entry at %v, got %v", now, entries[0].Timestamp())
+	}
+}
+
+func TestSnapshotVersions(t *testing.T) {
+	database := setUp()
+
+	version, _ := database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("first"),
+		OverwriteOnConflict, Actor{})
+	if version != 1 {
+		t.Fatalf("Expected version 1, got %d", version)
+	}
+	database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("second"), OverwriteOnConflict,
+		Actor{})
+	version, _ = database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("third"),
+		OverwriteOnConflict, Actor{})
+	if version != 3 {
+		t.Fatalf("Expected version 3, got %d", version)
+	}
+
+	versions := database.GetSnapshotVersions(now, "host1", "queries")
+	if len(versions) != 3 || versions[0] != 1 || versions[2] != 3 {
+		t.Fatalf("Unexpected versions %v", versions)
+	}
+	for version, expected := range map[int64]string{1: "first", 2: "second", 3: "third"} {
+		snapshot, ok := database.GetSnapshotVersion(now, "host1", "queries", version)
+		if !ok || snapshot.Contents()[1][0] != expected {
+			t.Fatalf("Unexpected contents for version %d: %v", version, snapshot.Contents())
+		}
+	}
+	if _, ok := database.GetSnapshotVersion(now, "host1", "queries", 4); ok {
+		t.Fatalf("Found nonexistent version")
+	}
+}
+
+func TestAddSnapshotConflictModes(t *testing.T) {
+	database := setUp()
+	database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("first"), OverwriteOnConflict,
+		Actor{})
+
+	_, err := database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("second"),
+		RejectOnConflict, Actor{})
+	if err != ErrSnapshotExists {
+		t.Fatalf("Expected ErrSnapshotExists, got %v", err)
+	}
+
+	version, err := database.AddSnapshot(now, "host1", "queries", wrapSimpleContents("second"),
+		AppendOnConflict, Actor{})
+	if err != nil || version != 2 {
+		t.Fatalf("Failed to append rows: version %d, %v", version, err)
+	}
+	snapshot, _ := database.GetSnapshotWithContents(now, "host1", "queries")
+	if snapshot.CsvContents != "column\nfirst\nsecond\n" {
+		t.Fatalf("Unexpected contents after append: %q", snapshot.CsvContents)
+	}
+
+	_, err = database.AddSnapshot(now, "host1", "queries", [][]string{{"other"}, {"third"}},
+		AppendOnConflict, Actor{})
+	if err != ErrHeaderMismatch {
+		t.Fatalf("Expected ErrHeaderMismatch, got %v", err)
+	}
+}
+
+func TestAppendRows(t *testing.T) {
+	database := setUp()
+
+	created, err := database.AppendRows(now, "host1", "slow queries", [][]string{{"query"}, {"a"}},
+		Actor{})
+	if !created || err != nil {
+		t.Fatalf("Failed to create snapshot by appending: %v, %v", created, err)
+	}
+	created, err = database.AppendRows(now, "host1", "slow queries", [][]string{{"query"}, {"b"}},
+		Actor{})
+	if created || err != nil {
+		t.Fatalf("Failed to append to snapshot: %v, %v", created, err)
+	}
+	snapshot, _ := database.GetSnapshotWithContents(now, "host1", "slow queries")
+	if snapshot.CsvContents != "query\na\nb\n" {
+		t.Fatalf("Unexpected contents after append: %q", snapshot.CsvContents)
+	}
+	if versions := database.GetSnapshotVersions(now, "host1", "slow queries"); len(versions) != 1 {
+		t.Fatalf("Appending rows created revisions: %v", versions)
+	}
+
+	_, err = database.AppendRows(now, "host1", "slow queries", [][]string{{"other"}, {"c"}}, Actor{})
+	if err != ErrHeaderMismatch {
+		t.Fatalf("Expected ErrHeaderMismatch, got %v", err)
+	}
+}
+
+func TestConcurrentAppendRows(t *testing.T) {
+	database := InitializeDatabase(setUpFileConnection(t), func() time.Time { return now }, false)
+	var group sync.WaitGroup
+	for index := 0; index < 10; index++ {
+		group.Add(1)
+		go func(index int) {
+			defer group.Done()
+			_, err := database.AppendRows(
+				now, "host1", "slow queries", [][]string{{"query"}, {strconv.Itoa(index)}}, Actor{},
+			)
+			if err != nil {
+				t.Errorf("Failed to append rows: %v", err)
+			}
+		}(index)
+	}
+	group.Wait()
+
+	snapshot, _ := database.GetSnapshotWithContents(now, "host1", "slow queries")
+	if contents := snapshot.Contents(); len(contents) != 11 {
+		t.Fatalf("Expected a header and 10 rows, got %v", contents)
+	}
+}
+
+func repetitiveContents(rowCount int) [][]string {
+	contents := [][]string{{"pid", "command"}}
+	for pid := 0; pid < rowCount; pid++ {
+		contents = append(contents, []string{strconv.Itoa(pid), "/usr/sbin/apache2 -k start"})
+	}
+	return contents
+}
+
+func TestCompressedStorage(t *testing.T) {
+	database := setUp()
+	database.AddSnapshot(now, "host1", "processes", repetitiveContents(100), OverwriteOnConflict,
+		Actor{})
+	database.AddSnapshot(now, "host1", "tiny", wrapSimpleContents("x"), OverwriteOnConflict, Actor{})
+	database.AppendRows(now, "host1", "processes", [][]string{{"pid", "command"}, {"100", "sshd"}},
+		Actor{})
+
+	snapshot, _ := database.GetSnapshotWithContents(now, "host1", "processes")
+	contents := snapshot.Contents()
+	if snapshot.Codec != GZIP_CODEC || len(contents) != 102 || contents[101][1] != "sshd" {
+		t.Fatalf("Unexpected snapshot %v with contents %v", snapshot.Codec, contents)
+	}
+
+	stats := database.GetStorageStats()
+	if len(stats) != 2 || stats[0].Codec != GZIP_CODEC || stats[1].Codec != NO_CODEC {
+		t.Fatalf("Unexpected storage stats %v", stats)
+	}
+	if stats[0].ContentBytes != int64(len(snapshot.CsvContents)) || stats[0].PercentSaved() < 50 {
+		t.Fatalf("Unexpected gzip storage stats %v", stats[0])
+	}
+	if stats[1].BytesSaved() != 0 {
+		t.Fatalf("Unexpected uncompressed storage stats %v", stats[1])
+	}
+}
+
+func TestCompressionMigration(t *testing.T) {
+	connection := setUpConnection()
+	oldSchema := "CREATE TABLE Snapshot (Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, " +
+		"UnixTimestamp INTEGER NOT NULL, Hostname VARCHAR(255) NOT NULL, " +
+		"Title VARCHAR(255) NOT NULL, CsvContents TEXT NOT NULL)"
+	if _, err := connection.Exec(oldSchema); err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+	csvContents := dumpCsv(repetitiveContents(100))
+	_, err := connection.Exec(
+		"INSERT INTO Snapshot (UnixTimestamp, Hostname, Title, CsvContents) VALUES (?, ?, ?, ?)",
+		now.Unix(), "host1", "processes", csvContents,
+	)
+	if err != nil {
+		t.Fatalf("Failed to insert old snapshot: %v", err)
+	}
+
+	database := InitializeDatabase(connection, func() time.Time { return now }, false)
+	snapshot, _ := database.GetSnapshotWithContents(now, "host1", "processes")
+	if snapshot.Codec != GZIP_CODEC || snapshot.CsvContents != csvContents {
+		t.Fatalf("Snapshot wasn't migrated: %v", snapshot.Codec)
+	}
+	if stats := database.GetStorageStats(); stats[0].ContentBytes != int64(len(csvContents)) {
+		t.Fatalf("Unexpected storage stats %v", stats)
+	}
+}
+
+func TestIdenticalSnapshotsShareContents(t *testing.T) {
+	database := setUp()
+	mapper := &database.(*TimeturnerDatabase).mapper
+	contents := repetitiveContents(10)
+	for minute := 0; minute < 3; minute++ {
+		timestamp := now.Add(time.Duration(minute) * time.Minute)
+		database.AddSnapshot(timestamp, "host1", "mounts", contents, OverwriteOnConflict, Actor{})
+	}
+	database.AddSnapshot(now, "host1", "processes", wrapSimpleContents("x"), OverwriteOnConflict,
+		Actor{})
+
+	blobCount, err := mapper.SelectInt("SELECT COUNT(*) FROM ContentBlob")
+	if err != nil || blobCount != 2 {
+		t.Fatalf("Expected 2 content blobs, got %v (%v)", blobCount, err)
+	}
+	later := now.Add(2 * time.Minute)
+	snapshot, _ := database.GetSnapshotWithContents(later, "host1", "mounts")
+	if snapshot.CsvContents != dumpCsv(contents) {
+		t.Fatalf("Unexpected shared contents %q", snapshot.CsvContents)
+	}
+
+	database.DeleteSnapshot(now, "host1", "mounts", Actor{})
+	database.DeleteSnapshot(now, "host1", "processes", Actor{})
+	blobCount, _ = mapper.SelectInt("SELECT COUNT(*) FROM ContentBlob")
+	if blobCount != 1 {
+		t.Fatalf("Expected unreferenced blob to be deleted, %v left", blobCount)
+	}
+
+	database.AppendRows(later, "host1", "mounts", [][]string{{"pid", "command"}, {"10", "sshd"}},
+		Actor{})
+	snapshot, _ = database.GetSnapshotWithContents(later, "host1", "mounts")
+	if len(snapshot.Contents()) != 12 || snapshot.ContentHash != "" {
+		t.Fatalf("Appending didn't detach contents: %v", snapshot.Contents())
+	}
+	snapshot, _ = database.GetSnapshotWithContents(now.Add(time.Minute), "host1", "mounts")
+	if len(snapshot.Contents()) != 11 {
+		t.Fatalf("Appending changed another snapshot's contents: %v", snapshot.Contents())
+	}
+}
+
+func TestDeleteSnapshotDeletesRevisionBlobs(t *testing.T) {
+	database := setUp()
+	mapper := &database.(*TimeturnerDatabase).mapper
+	for _, value := range []string{"a", "b", "c"} {
+		database.AddSnapshot(now, "host1", "processes", wrapSimpleContents(value),
+			OverwriteOnConflict, Actor{})
+	}
+	database.AddSnapshot(now, "host2", "processes", wrapSimpleContents("a"), OverwriteOnConflict,
+		Actor{})
+
+	database.DeleteSnapshot(now, "host1", "processes", Actor{})
+	var hashes []string
+	if _, err := mapper.Select(&hashes, "SELECT Hash FROM ContentBlob"); err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 || hashes[0] != hashContents(dumpCsv(wrapSimpleContents("a"))) {
+		t.Fatalf("Expected only the blob host2 shares to be left, got %v", hashes)
+	}
+}
+
+func TestGetUnchangedSince(t *testing.T) {
+	database := setUp()
+	contents := [][][]string{
+		wrapSimpleContents("a"), wrapSimpleContents("a"), wrapSimpleContents("b"),
+		wrapSimpleContents("b"), wrapSimpleContents("b"),
+	}
+	for minute, minuteContents := range contents {
+		timestamp := now.Add(time.Duration(minute) * time.Minute)
+		database.AddSnapshot(timestamp, "host1", "mounts", minuteContents, OverwriteOnConflict, Actor{})
+		database.AddSnapshot(
+			timestamp, "host1", "clock", wrapSimpleContents(strconv.Itoa(minute)),
+			OverwriteOnConflict, Actor{},
+		)
+	}
+
+	unchanged := database.GetUnchangedSince(now.Add(4 * time.Minute))
+	if len(unchanged) != 1 || unchanged[0].Title != "mounts" ||
+		unchanged[0].UnixTimestamp != now.Add(2*time.Minute).Unix() {
+		t.Fatalf("Unexpected unchanged snapshots %v", unchanged)
+	}
+	if unchanged = database.GetUnchangedSince(now.Add(2 * time.Minute)); len(unchanged) != 0 {
+		t.Fatalf("Changed snapshot reported unchanged: %v", unchanged)
+	}
+}
+
+func TestConcurrentAddSnapshot(t *testing.T) {
+	database := InitializeDatabase(setUpFileConnection(t), func() time.Time { return now }, false)
+	var group sync.WaitGroup
+	for index := 0; index < 10; index++ {
+		group.Add(1)
+		go func(index int) {
+			defer group.Done()
+			database.AddSnapshot(
+				now, "host1", "processes", wrapSimpleContents(strconv.Itoa(index)),
+				OverwriteOnConflict, Actor{},
+			)
+		}(index)
+	}
+	group.Wait()
+
+	if snapshots := database.GetSnapshots(now); len(snapshots) != 1 {
+		t.Fatalf("Expected one snapshot, got %v", snapshots)
+	}
+	if versions := database.GetSnapshotVersions(now, "host1", "processes"); len(versions) != 10 {
+		t.Fatalf("Expected 10 versions, got %v", versions)
+	}
+}
+
+func TestRowStorage(t *testing.T) {
+	database := setUp().(*TimeturnerDatabase)
+	database.UseRowStorage([]string{"processes"})
+	contents := [][]string{{"pid", "command"}, {"1", "init"}, {"2", "sshd"}}
+	database.AddSnapshot(now, "host1", "processes", contents, OverwriteOnConflict, Actor{})
+	database.AppendRows(now, "host1", "processes", [][]string{{"pid", "command"}, {"3", "cron"}},
+		Actor{})
+
+	snapshot, _ := database.GetSnapshotWithContents(now, "host1", "processes")
+	expectedContents := "pid,command\n1,init\n2,sshd\n3,cron\n"
+	if snapshot.Codec != ROWS_CODEC || snapshot.CsvContents != expectedContents {
+		t.Fatalf("Unexpected row-stored snapshot %v: %q", snapshot.Codec, snapshot.CsvContents)
+	}
+	command, err := database.mapper.SelectStr(
+		"SELECT json_extract(Cells, '$.command') FROM SnapshotRow WHERE SnapshotId = ? AND "+
+			"CAST(json_extract(Cells, '$.pid') AS INTEGER) > 2",
+		snapshot.Id,
+	)
+	if err != nil || command != "cron" {
+		t.Fatalf("Failed to query rows with SQL: %q, %v", command, err)
+	}
+
+	database.AddSnapshot(now, "host1", "processes", wrapSimpleContents("x"), OverwriteOnConflict,
+		Actor{})
+	snapshot, _ = database.GetSnapshotVersion(now, "host1", "processes", 1)
+	if len(snapshot.Contents()) != 4 {
+		t.Fatalf("Unexpected first version %v", snapshot.Contents())
+	}
+	database.DeleteSnapshot(now, "host1", "processes", Actor{})
+	rowCount, _ := database.mapper.SelectInt("SELECT COUNT(*) FROM SnapshotRow")
+	if rowCount != 0 {
+		t.Fatalf("Deleting a snapshot left %d rows behind", rowCount)
+	}
+}
+
+func TestRowStorageTitlesPersist(t *testing.T) {
+	connection := setUpFileConnection(t)
+	database := InitializeDatabase(connection, func() time.Time { return now }, false)
+	database.UseRowStorage([]string{"processes"})
+
+	reopened := InitializeDatabase(connection, func() time.Time { return now }, false)
+	contents := [][]string{{"pid", "command"}, {"1", "init"}}
+	reopened.AddSnapshot(now, "host1", "processes", contents, OverwriteOnConflict, Actor{})
+	reopened.AddSnapshot(now, "host1", "mounts", contents, OverwriteOnConflict, Actor{})
+	snapshot, _ := reopened.GetSnapshotWithContents(now, "host1", "processes")
+	if snapshot.Codec != ROWS_CODEC {
+		t.Fatalf("Row storage setting wasn't kept: %v", snapshot.Codec)
+	}
+	snapshot, _ = reopened.GetSnapshotWithContents(now, "host1", "mounts")
+	if snapshot.Codec == ROWS_CODEC {
+		t.Fatal("Stored a title without row storage as rows")
+	}
+}
+
+func TestRowStorageNeedsDistinctColumnNames(t *testing.T) {
+	database := setUp().(*TimeturnerDatabase)
+	database.UseRowStorage([]string{"processes"})
+	contents := [][]string{{"name", "name"}, {"a", "b"}}
+	database.AddSnapshot(now, "host1", "processes", contents, OverwriteOnConflict, Actor{})
+	snapshot, _ := database.GetSnapshotWithContents(now, "host1", "processes")
+	if snapshot.Codec == ROWS_CODEC || snapshot.CsvContents != "name,name\na,b\n" {
+		t.Fatalf("Unexpected snapshot %v: %q", snapshot.Codec, snapshot.CsvContents)
+	}
+}
+
+func TestContentStoreBackedDatabase(t *testing.T) {
+	root, err := ioutil.TempDir("", "timeturner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	database := setUp().(*TimeturnerDatabase)
+	database.UseContentStore(FileContentStore{root})
+
+	contents := repetitiveContents(100)
+	database.AddSnapshot(now, "host1", "processes", contents, OverwriteOnConflict, Actor{})
+	database.AddSnapshot(now, "host1", "processes", wrapSimpleContents("x"), OverwriteOnConflict,
+		Actor{})
+	directory := filepath.Join(root, now.Format(DATE_FORMAT), "host1", "processes")
+	paths, _ := filepath.Glob(filepath.Join(directory, "*"))
+	if len(paths) != 2 {
+		t.Fatalf("Expected files for both versions, got %v", paths)
+	}
+	snapshot, _ := database.GetSnapshotVersion(now, "host1", "processes", 1)
+	if snapshot.CsvContents != dumpCsv(contents) {
+		t.Fatalf("Unexpected first version %q", snapshot.CsvContents)
+	}
+	if stats := database.GetStorageStats(); stats[0].Codec != EXTERNAL_STORAGE {
+		t.Fatalf("Unexpected storage stats %v", stats)
+	}
+
+	database.AppendRows(now, "host1", "processes", [][]string{{"column"}, {"y"}}, Actor{})
+	snapshot, _ = database.GetSnapshotWithContents(now, "host1", "processes")
+	if snapshot.CsvContents != "column\nx\ny\n" {
+		t.Fatalf("Unexpected contents after append %q", snapshot.CsvContents)
+	}
+
+	database.DeleteSnapshot(now, "host1", "processes", Actor{})
+	paths, _ = filepath.Glob(filepath.Join(directory, "*"))
+	if len(paths) != 0 {
+		t.Fatalf("Deleting the snapshot left files %v", paths)
+	}
+}
+
+// unreliableContentStore fails to put contents while failing is set.
+type unreliableContentStore struct {
+	FileContentStore
+	failing bool
+}
+
+func (store *unreliableContentStore) Put(key string, contents []byte) error {
+	if store.failing {
+		return errors.New("content store is down")
+	}
+	return store.FileContentStore.Put(key, contents)
+}
+
+func TestContentStoreUploadsAreRetried(t *testing.T) {
+	store := &unreliableContentStore{FileContentStore{t.TempDir()}, true}
+	database := setUp().(*TimeturnerDatabase)
+	database.UseContentStore(store)
+	contents := repetitiveContents(100)
+	if _, err := database.AddSnapshot(now, "host1", "processes", contents, OverwriteOnConflict,
+		Actor{}); err != nil {
+		t.Fatalf("Failed to add snapshot while the content store was down: %v", err)
+	}
+	snapshot, _ := database.GetSnapshotWithContents(now, "host1", "processes")
+	if snapshot.CsvContents != dumpCsv(contents) {
+		t.Fatalf("Unexpected contents before upload %q", snapshot.CsvContents)
+	}
+	if stats := database.GetStorageStats(); stats[0].Codec == EXTERNAL_STORAGE {
+		t.Fatalf("Contents counted as external before upload: %v", stats)
+	}
+
+	store.failing = false
+	database.Compact()
+	storedBytes, err := database.mapper.SelectInt("SELECT SUM(length(Contents)) FROM ContentBlob")
+	if err != nil || storedBytes != 0 {
+		t.Fatalf("Contents still in the database after upload: %d bytes (%v)", storedBytes, err)
+	}
+	snapshot, _ = database.GetSnapshotWithContents(now, "host1", "processes")
+	if snapshot.CsvContents != dumpCsv(contents) {
+		t.Fatalf("Unexpected contents after upload %q", snapshot.CsvContents)
+	}
+}
+
+// countingContentStore counts the contents read from it.
+type countingContentStore struct {
+	FileContentStore
+	gets int
+}
+
+func (store *countingContentStore) Get(key string) ([]byte, error) {
+	store.gets++
+	return store.FileContentStore.Get(key)
+}
+
+func TestDeletesDontReadContents(t *testing.T) {
+	store := &countingContentStore{FileContentStore: FileContentStore{t.TempDir()}}
+	database := setUp().(*TimeturnerDatabase)
+	database.UseContentStore(store)
+	contents := repetitiveContents(100)
+	database.AddSnapshot(now, "host1", "processes", contents, OverwriteOnConflict, Actor{})
+	database.AppendRows(now, "host1", "queries", wrapSimpleContents("a"), Actor{})
+
+	deleted := database.DeleteHost("host1", Actor{})
+	if len(deleted) != 2 || deleted[0].CsvContents != "" || store.gets != 0 {
+		t.Fatalf("Deleting read %d blobs: %v", store.gets, deleted)
+	}
+	entries := database.GetAuditEntries(2)
+	if entries[0].PreviousContentHash != hashContents(dumpCsv(wrapSimpleContents("a"))) ||
+		entries[1].PreviousContentHash != hashContents(dumpCsv(contents)) {
+		t.Fatalf("Unexpected audit entries %v", entries)
+	}
+	paths, _ := filepath.Glob(filepath.Join(store.Root, "*", "*", "*", "*"))
+	if len(paths) != 0 {
+		t.Fatalf("Deleting the host left files %v", paths)
+	}
+}
+
+func TestCompactDeletesOrphanedBlobs(t *testing.T) {
+	database := setUp().(*TimeturnerDatabase)
+	database.AddSnapshot(now, "host1", "processes", wrapSimpleContents("a"), OverwriteOnConflict,
+		Actor{})
+	orphan := &ContentBlob{"orphan", "", 1, []byte("x"), ""}
+	if err := database.mapper.Insert(orphan); err != nil {
+		t.Fatal(err)
+	}
+	database.Compact()
+	var hashes []string
+	database.mapper.Select(&hashes, "SELECT Hash FROM ContentBlob")
+	if len(hashes) != 1 || hashes[0] != hashContents(dumpCsv(wrapSimpleContents("a"))) {
+		t.Fatalf("Unexpected blobs after compacting %v", hashes)
 	}
 }
@@ -0,0 +1,86 @@
+package timeturner
+
+import (
+	"time"
+)
+
+// Pin exempts snapshots from retention: those from StartUnixTimestamp (inclusive) to
+// EndUnixTimestamp (exclusive) on Hostname with Title, where an empty Hostname or Title matches
+// any. Pinning a single timestamp or snapshot covers just that second. UnixTimestamp is when the
+// pin was made and Identity who made it.
+type Pin struct {
+	Id                 int64
+	UnixTimestamp      int64
+	StartUnixTimestamp int64
+	EndUnixTimestamp   int64
+	Hostname           string
+	Title              string
+	Note               string
+	Identity           string
+}
+
+func (pin Pin) Timestamp() time.Time {
+	return time.Unix(pin.UnixTimestamp, 0)
+}
+
+func (pin Pin) Start() time.Time {
+	return time.Unix(pin.StartUnixTimestamp, 0)
+}
+
+func (pin Pin) End() time.Time {
+	return time.Unix(pin.EndUnixTimestamp, 0)
+}
+
+// IsSingleTimestamp reports whether the pin covers just one snapshot time.
+func (pin Pin) IsSingleTimestamp() bool {
+	return pin.EndUnixTimestamp == pin.StartUnixTimestamp+1
+}
+
+func (pin Pin) Covers(snapshot Snapshot) bool {
+	return pin.StartUnixTimestamp <= snapshot.UnixTimestamp &&
+		snapshot.UnixTimestamp < pin.EndUnixTimestamp &&
+		(pin.Hostname == "" || pin.Hostname == snapshot.Hostname) &&
+		(pin.Title == "" || pin.Title == snapshot.Title)
+}
+
+// notPinned is a WHERE clause matching the snapshots no pin covers.
+const notPinned = "NOT EXISTS (SELECT 1 FROM Pin WHERE " +
+	"Pin.StartUnixTimestamp <= Snapshot.UnixTimestamp AND " +
+	"Snapshot.UnixTimestamp < Pin.EndUnixTimestamp AND " +
+	"Pin.Hostname IN ('', Snapshot.Hostname) AND Pin.Title IN ('', Snapshot.Title))"
+
+// AddPin stores the pin, stamped with the current time, and returns it with its Id.
+func (database *TimeturnerDatabase) AddPin(pin Pin) Pin {
+	pin.Id = -1
+	pin.UnixTimestamp = database.nowFunc().Unix()
+	if err := database.mapper.Insert(&pin); err != nil {
+		panic(err)
+	}
+	return pin
+}
+
+// GetPins returns every pin, most recently pinned times first.
+func (database *TimeturnerDatabase) GetPins() []Pin {
+	var pins []Pin
+	query := "SELECT * FROM Pin ORDER BY StartUnixTimestamp DESC, Id DESC"
+	if _, err := database.mapper.Select(&pins, query); err != nil {
+		panic(err)
+	}
+	return pins
+}
+
+// DeletePin removes a pin, leaving the snapshots it covered to expire as usual.
+func (database *TimeturnerDatabase) DeletePin(id int64) (pin Pin, ok bool) {
+	result, err := database.mapper.Get(Pin{}, id)
+	if err != nil {
+		panic(err)
+	}
+	if result == nil {
+		return Pin{}, false
+	}
+	pin = *result.(*Pin)
+	if _, err = database.mapper.Delete(&pin); err != nil {
+		panic(err)
+	}
+	return pin, true
+}
@@ -0,0 +1,68 @@
+package timeturner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPinnedSnapshotsSurviveRetention(t *testing.T) {
+	current := now
+	database := InitializeDatabase(setUpConnection(), func() time.Time { return current }, false)
+	for _, hostname := range []string{"host1", "host2", "host3"} {
+		for _, title := range []string{"processes", "queries"} {
+			database.AddSnapshot(current, hostname, title, wrapSimpleContents(hostname),
+				OverwriteOnConflict, Actor{})
+		}
+	}
+	database.AddPin(Pin{
+		StartUnixTimestamp: current.Unix(), EndUnixTimestamp: current.Unix() + 1,
+		Hostname: "host1", Title: "processes", Note: "outage", Identity: "steve",
+	})
+	database.AddPin(Pin{
+		StartUnixTimestamp: current.Add(-time.Hour).Unix(),
+		EndUnixTimestamp:   current.Add(time.Hour).Unix(),
+		Hostname:           "host2",
+	})
+	unpinned := database.AddPin(Pin{
+		StartUnixTimestamp: current.Unix(), EndUnixTimestamp: current.Unix() + 1,
+	})
+	if _, ok := database.DeletePin(unpinned.Id); !ok {
+		t.Fatalf("Failed to delete pin")
+	}
+	if _, ok := database.DeletePin(unpinned.Id); ok {
+		t.Fatalf("Deleted a pin twice")
+	}
+
+	pinnedTime := current
+	current = current.AddDate(0, 0, 100)
+	database.AddSnapshot(current, "host1", "processes", wrapSimpleContents("new"),
+		OverwriteOnConflict, Actor{})
+
+	kept := database.GetSnapshots(pinnedTime)
+	if len(kept) != 3 || kept[0].Hostname != "host1" || kept[0].Title != "processes" ||
+		kept[1].Hostname != "host2" || kept[2].Hostname != "host2" {
+		t.Fatalf("Unexpected snapshots kept: %v", kept)
+	}
+	pins := database.GetPins()
+	if len(pins) != 2 || pins[0].Note != "outage" || !pins[0].Timestamp().Equal(pinnedTime) {
+		t.Fatalf("Unexpected pins: %v", pins)
+	}
+}
+
+func TestPinCovers(t *testing.T) {
+	pin := Pin{StartUnixTimestamp: 100, EndUnixTimestamp: 200, Title: "queries"}
+	tests := []struct {
+		snapshot Snapshot
+		covered  bool
+	}{
+		{Snapshot{UnixTimestamp: 100, Hostname: "host1", Title: "queries"}, true},
+		{Snapshot{UnixTimestamp: 199, Hostname: "host2", Title: "queries"}, true},
+		{Snapshot{UnixTimestamp: 200, Hostname: "host1", Title: "queries"}, false},
+		{Snapshot{UnixTimestamp: 150, Hostname: "host1", Title: "processes"}, false},
+	}
+	for _, test := range tests {
+		if pin.Covers(test.snapshot) != test.covered {
+			t.Fatalf("Expected Covers(%v) to be %v", test.snapshot, test.covered)
+		}
+	}
+}
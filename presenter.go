@@ -1,24 +1,60 @@
 package timeturner
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
 	"sort"
+	"strconv"
 	"time"
 )
 
 type RequestInfo struct {
-	Vars      map[string]string
-	Timestamp time.Time
-	Form      map[string]string
-	Body      string
+	Vars          map[string]string
+	Timestamp     time.Time
+	Form          map[string]string
+	Body          string
+	Identity      string
+	SourceAddress string
+	Header        http.Header
+	RequestId     string
 }
 
 type Database interface {
-	AddSnapshot(timestamp time.Time, hostname string, title string, contents [][]string)
+	AddSnapshot(timestamp time.Time, hostname string, title string, contents [][]string,
+		onConflict ConflictMode, actor Actor) (version int64, err error)
 	GetAllDays() []time.Time
 	GetTimestamps(day time.Time) []time.Time
+	GetTimestampsBetween(start time.Time, end time.Time) []time.Time
 	GetSnapshots(timestamp time.Time) []Snapshot
 	GetSnapshotWithContents(timestamp time.Time, hostname string, title string) (
 		snapshot Snapshot, ok bool)
+	GetTitleSnapshots(timestamp time.Time, title string) []Snapshot
+	GetSnapshotVersions(timestamp time.Time, hostname string, title string) []int64
+	GetSnapshotVersion(timestamp time.Time, hostname string, title string, version int64) (
+		snapshot Snapshot, ok bool)
+	AppendRows(timestamp time.Time, hostname string, title string, contents [][]string,
+		actor Actor) (created bool, err error)
+	DeleteSnapshot(timestamp time.Time, hostname string, title string, actor Actor) (
+		snapshot Snapshot, ok bool)
+	DeleteHost(hostname string, actor Actor) []Snapshot
+	DeleteTitle(title string, actor Actor) []Snapshot
+	DeleteTimeRange(start time.Time, end time.Time, actor Actor) []Snapshot
+	AddAuditEntry(entry AuditEntry)
+	GetAuditEntries(limit int) []AuditEntry
+	GetStorageStats() []StorageStats
+	GetUnchangedSince(timestamp time.Time) []Snapshot
+	AddPin(pin Pin) Pin
+	GetPins() []Pin
+	DeletePin(id int64) (pin Pin, ok bool)
+	AddAnnotation(annotation Annotation) Annotation
+	UpdateAnnotation(annotation Annotation) bool
+	GetAnnotation(id int64) (annotation Annotation, ok bool)
+	DeleteAnnotation(id int64) (annotation Annotation, ok bool)
+	GetAnnotations(start time.Time, end time.Time) []Annotation
+	SearchAnnotations(query string) []Annotation
+	Ping() error
+	PendingMigrations() []Migration
 }
 
 type Presenter struct {
@@ -50,15 +86,288 @@ func (presenter Presenter) ListHostsAndTitles() (timestamp time.Time, hostMap ma
 	return presenter.RequestInfo.Timestamp, hostMap
 }
 
-func (presenter Presenter) AddSnapshot() {
-	presenter.Database.AddSnapshot(
+// UnchangedSince maps hostname and title to the time since which the snapshot at the requested
+// time has had the same contents, for snapshots that haven't changed.
+func (presenter Presenter) UnchangedSince() map[string]map[string]time.Time {
+	unchangedSince := make(map[string]map[string]time.Time)
+	for _, snapshot := range presenter.Database.GetUnchangedSince(presenter.RequestInfo.Timestamp) {
+		if _, ok := unchangedSince[snapshot.Hostname]; !ok {
+			unchangedSince[snapshot.Hostname] = make(map[string]time.Time)
+		}
+		unchangedSince[snapshot.Hostname][snapshot.Title] = snapshot.Timestamp()
+	}
+	return unchangedSince
+}
+
+func uniqueTitles(hostMap map[string][]string) []string {
+	titles := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, hostTitles := range hostMap {
+		for _, title := range hostTitles {
+			if !seen[title] {
+				titles = append(titles, title)
+				seen[title] = true
+			}
+		}
+	}
+	sort.Strings(titles)
+	return titles
+}
+
+// actor identifies the caller to the database, which audits their changes.
+func (presenter Presenter) actor() Actor {
+	return Actor{
+		Identity:      presenter.RequestInfo.Identity,
+		SourceAddress: presenter.RequestInfo.SourceAddress,
+	}
+}
+
+const CONFLICT_HEADER = "X-Timeturner-On-Conflict"
+
+// AddSnapshot stores the request body and returns its version. The conflict header picks what
+// happens when the snapshot already exists; the default is to overwrite it.
+func (presenter Presenter) AddSnapshot() (version int64, err error) {
+	timestamp := presenter.RequestInfo.Timestamp
+	hostname := presenter.RequestInfo.Vars["hostname"]
+	title := presenter.RequestInfo.Vars["title"]
+	contents, err := readCsv(presenter.RequestInfo.Body)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid CSV: %v", err)
+	}
+
+	onConflict := ConflictMode(presenter.RequestInfo.Header.Get(CONFLICT_HEADER))
+	switch onConflict {
+	case "":
+		onConflict = OverwriteOnConflict
+	case OverwriteOnConflict, AppendOnConflict, RejectOnConflict:
+	default:
+		return 0, fmt.Errorf("Unknown %v %q", CONFLICT_HEADER, onConflict)
+	}
+
+	return presenter.Database.AddSnapshot(
+		timestamp, hostname, title, contents, onConflict, presenter.actor(),
+	)
+}
+
+// AppendRows streams the data rows of the request body into the snapshot and returns how many
+// rows were appended.
+func (presenter Presenter) AppendRows() (rowCount int, err error) {
+	timestamp := presenter.RequestInfo.Timestamp
+	hostname := presenter.RequestInfo.Vars["hostname"]
+	title := presenter.RequestInfo.Vars["title"]
+	contents, err := readCsv(presenter.RequestInfo.Body)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid CSV: %v", err)
+	}
+	if len(contents) == 0 {
+		return 0, errors.New("Appending needs a header row")
+	}
+
+	_, err = presenter.Database.AppendRows(timestamp, hostname, title, contents, presenter.actor())
+	if err != nil {
+		return 0, err
+	}
+	return len(contents) - 1, nil
+}
+
+const defaultAuditLimit = 500
+
+func (presenter Presenter) ListAuditEntries() []AuditEntry {
+	limit, err := strconv.Atoi(presenter.RequestInfo.Form["limit"])
+	if err != nil || limit <= 0 {
+		limit = defaultAuditLimit
+	}
+	return presenter.Database.GetAuditEntries(limit)
+}
+
+func (presenter Presenter) DeleteSnapshot() (snapshot Snapshot, ok bool) {
+	return presenter.Database.DeleteSnapshot(
 		presenter.RequestInfo.Timestamp,
 		presenter.RequestInfo.Vars["hostname"],
 		presenter.RequestInfo.Vars["title"],
-		parseCsv(presenter.RequestInfo.Body),
+		presenter.actor(),
 	)
 }
 
+func (presenter Presenter) DeleteHost() []Snapshot {
+	return presenter.Database.DeleteHost(presenter.RequestInfo.Vars["hostname"], presenter.actor())
+}
+
+func (presenter Presenter) DeleteTitle() []Snapshot {
+	return presenter.Database.DeleteTitle(presenter.RequestInfo.Vars["title"], presenter.actor())
+}
+
+func (presenter Presenter) DeleteTimeRange() ([]Snapshot, error) {
+	start, end, err := parseTimeRange(presenter.RequestInfo.Form)
+	if err != nil {
+		return nil, err
+	}
+	return presenter.Database.DeleteTimeRange(start, end, presenter.actor()), nil
+}
+
+// AddPin pins the snapshots described by the form: "at" pins a single timestamp and "start" and
+// "end" a range, either optionally narrowed to a "hostname" and "title", with a "note" saying why.
+func (presenter Presenter) AddPin() (Pin, error) {
+	form := presenter.RequestInfo.Form
+	pin := Pin{
+		Hostname: form["hostname"],
+		Title:    form["title"],
+		Note:     form["note"],
+		Identity: presenter.RequestInfo.Identity,
+	}
+	if form["at"] != "" {
+		at, err := parseRangeBoundary(form["at"])
+		if err != nil {
+			return Pin{}, err
+		}
+		pin.StartUnixTimestamp, pin.EndUnixTimestamp = at.Unix(), at.Unix()+1
+	} else {
+		start, end, err := parseTimeRange(form)
+		if err != nil {
+			return Pin{}, err
+		}
+		pin.StartUnixTimestamp, pin.EndUnixTimestamp = start.Unix(), end.Unix()
+	}
+	return presenter.Database.AddPin(pin), nil
+}
+
+func (presenter Presenter) ListPins() []Pin {
+	return presenter.Database.GetPins()
+}
+
+func (presenter Presenter) requestedId() (id int64, ok bool) {
+	id, err := strconv.ParseInt(presenter.RequestInfo.Vars["id"], 10, 64)
+	return id, err == nil
+}
+
+func (presenter Presenter) DeletePin() (pin Pin, ok bool) {
+	id, ok := presenter.requestedId()
+	if !ok {
+		return Pin{}, false
+	}
+	return presenter.Database.DeletePin(id)
+}
+
+// PinsCovering returns the pins that keep a snapshot from expiring.
+func (presenter Presenter) PinsCovering(snapshot Snapshot) []Pin {
+	pins := make([]Pin, 0)
+	for _, pin := range presenter.Database.GetPins() {
+		if pin.Covers(snapshot) {
+			pins = append(pins, pin)
+		}
+	}
+	return pins
+}
+
+// DayAnnotations returns the annotations overlapping the requested day.
+func (presenter Presenter) DayAnnotations() []Annotation {
+	day := presenter.RequestInfo.Timestamp
+	return presenter.Database.GetAnnotations(day, day.AddDate(0, 0, 1))
+}
+
+// TimestampAnnotations returns the annotations covering the requested timestamp.
+func (presenter Presenter) TimestampAnnotations() []Annotation {
+	timestamp := presenter.RequestInfo.Timestamp
+	return presenter.Database.GetAnnotations(timestamp, timestamp.Add(time.Second))
+}
+
+// readFormTimestamp sets unixTimestamp from a date or date and time form value, if there is one.
+func readFormTimestamp(form map[string]string, name string, unixTimestamp *int64) error {
+	if form[name] == "" {
+		return nil
+	}
+	timestamp, err := parseRangeBoundary(form[name])
+	if err == nil {
+		*unixTimestamp = timestamp.Unix()
+	}
+	return err
+}
+
+// readAnnotationForm applies the "start", "end" and "text" form values to an annotation, leaving
+// fields whose values are missing unchanged.
+func (presenter Presenter) readAnnotationForm(annotation *Annotation) error {
+	form := presenter.RequestInfo.Form
+	if err := readFormTimestamp(form, "start", &annotation.StartUnixTimestamp); err != nil {
+		return err
+	}
+	if err := readFormTimestamp(form, "end", &annotation.EndUnixTimestamp); err != nil {
+		return err
+	}
+	if text, ok := form["text"]; ok {
+		annotation.Text = text
+	}
+	if annotation.StartUnixTimestamp >= annotation.EndUnixTimestamp {
+		return errors.New("start must be before end")
+	}
+	if annotation.Text == "" {
+		return errors.New("text is required")
+	}
+	return nil
+}
+
+// AddAnnotation annotates the window from the "start" to the "end" form values with "text".
+func (presenter Presenter) AddAnnotation() (Annotation, error) {
+	if form := presenter.RequestInfo.Form; form["start"] == "" || form["end"] == "" {
+		return Annotation{}, errors.New("start and end are required")
+	}
+	annotation := Annotation{Identity: presenter.RequestInfo.Identity}
+	if err := presenter.readAnnotationForm(&annotation); err != nil {
+		return Annotation{}, err
+	}
+	return presenter.Database.AddAnnotation(annotation), nil
+}
+
+// UpdateAnnotation changes whichever of the window and text the form gives.
+func (presenter Presenter) UpdateAnnotation() (annotation Annotation, ok bool, err error) {
+	annotation, ok = presenter.getAnnotation()
+	if !ok {
+		return
+	}
+	if err = presenter.readAnnotationForm(&annotation); err != nil {
+		return
+	}
+	ok = presenter.Database.UpdateAnnotation(annotation)
+	return
+}
+
+func (presenter Presenter) getAnnotation() (annotation Annotation, ok bool) {
+	id, ok := presenter.requestedId()
+	if !ok {
+		return Annotation{}, false
+	}
+	return presenter.Database.GetAnnotation(id)
+}
+
+// GetAnnotation returns the requested annotation and the snapshot times in its window.
+func (presenter Presenter) GetAnnotation() (annotation Annotation, timestamps []time.Time,
+	ok bool) {
+	annotation, ok = presenter.getAnnotation()
+	if !ok {
+		return
+	}
+	timestamps = presenter.Database.GetTimestampsBetween(annotation.Start(), annotation.End())
+	return
+}
+
+func (presenter Presenter) DeleteAnnotation() (annotation Annotation, ok bool) {
+	id, ok := presenter.requestedId()
+	if !ok {
+		return Annotation{}, false
+	}
+	return presenter.Database.DeleteAnnotation(id)
+}
+
+// SearchAnnotations finds the annotations whose text contains the "q" form value.
+func (presenter Presenter) SearchAnnotations() (query string, annotations []Annotation) {
+	query = presenter.RequestInfo.Form["q"]
+	return query, presenter.Database.SearchAnnotations(query)
+}
+
+func (presenter Presenter) StorageStats() (stats []StorageStats, total StorageStats) {
+	stats = presenter.Database.GetStorageStats()
+	return stats, totalStorageStats(stats)
+}
+
 type Column struct {
 	Name         string
 	IsSortColumn bool
@@ -69,12 +378,20 @@ type SortableRows struct {
 	data            [][]string
 	sortColumnIndex int
 	isReversed      bool
+	isNumeric       bool
 }
 
 func (rows SortableRows) Len() int      { return len(rows.data) }
 func (rows SortableRows) Swap(i, j int) { rows.data[i], rows.data[j] = rows.data[j], rows.data[i] }
 func (rows SortableRows) Less(i, j int) bool {
-	isLess := rows.data[i][rows.sortColumnIndex] < rows.data[j][rows.sortColumnIndex]
+	left := cellAt(rows.data[i], rows.sortColumnIndex)
+	right := cellAt(rows.data[j], rows.sortColumnIndex)
+	if rows.isNumeric && rows.isReversed {
+		return compareCells(right, left)
+	} else if rows.isNumeric {
+		return compareCells(left, right)
+	}
+	isLess := left < right
 	if rows.isReversed {
 		return !isLess
 	} else {
@@ -82,6 +399,21 @@ func (rows SortableRows) Less(i, j int) bool {
 	}
 }
 
+// compareCells orders numbers numerically, so that e.g. a CPU column sorts 9 before 10, and before
+// everything else, which is ordered as strings. Keeping numbers and strings apart makes this a
+// consistent ordering for columns that mix the two, like "-" standing in for a missing value.
+func compareCells(left string, right string) bool {
+	leftNumber, leftOk := parseNumber(left)
+	rightNumber, rightOk := parseNumber(right)
+	if leftOk != rightOk {
+		return leftOk
+	}
+	if leftOk {
+		return leftNumber < rightNumber
+	}
+	return left < right
+}
+
 func findColumnIndex(columns []string, desiredColumn string) int {
 	for index, columnName := range columns {
 		if columnName == desiredColumn {
@@ -91,38 +423,210 @@ func findColumnIndex(columns []string, desiredColumn string) int {
 	return -1
 }
 
-func (presenter Presenter) ViewSnapshot() (
-	snapshot Snapshot, columns []Column, data [][]string, ok bool) {
-	snapshot, ok = presenter.Database.GetSnapshotWithContents(
+// sortTable sorts data by the form's "sort" column, reversed if it has "reverse". Snapshots are
+// sorted by their cells as strings, while the derived tables of aggregates and host comparisons
+// are isNumeric, sorting numbers numerically and keeping rows with equal cells in order.
+func sortTable(columnNames []string, data [][]string, form map[string]string, isNumeric bool) (
+	columns []Column) {
+	sortColumn := form["sort"]
+	_, isReversed := form["reverse"]
+	var sortColumnIndex int
+	for index, columnName := range columnNames {
+		column := Column{columnName, false, false}
+		if columnName == sortColumn {
+			column.IsSortColumn = true
+			column.ReverseLink = !isReversed
+			sortColumnIndex = index
+		}
+		columns = append(columns, column)
+	}
+
+	if sortColumn != "" && isNumeric {
+		sort.Stable(SortableRows{data, sortColumnIndex, isReversed, true})
+	} else if sortColumn != "" {
+		sort.Sort(SortableRows{data, sortColumnIndex, isReversed, false})
+	}
+	return
+}
+
+// findSnapshot looks up the requested snapshot, as of the version in the form if there is one.
+func (presenter Presenter) findSnapshot() (snapshot Snapshot, ok bool) {
+	timestamp := presenter.RequestInfo.Timestamp
+	hostname := presenter.RequestInfo.Vars["hostname"]
+	title := presenter.RequestInfo.Vars["title"]
+	versionString, hasVersion := presenter.RequestInfo.Form["version"]
+	if !hasVersion {
+		return presenter.Database.GetSnapshotWithContents(timestamp, hostname, title)
+	}
+	version, err := strconv.ParseInt(versionString, 10, 64)
+	if err != nil {
+		return Snapshot{}, false
+	}
+	return presenter.Database.GetSnapshotVersion(timestamp, hostname, title, version)
+}
+
+func (presenter Presenter) ListVersions() []int64 {
+	return presenter.Database.GetSnapshotVersions(
 		presenter.RequestInfo.Timestamp,
 		presenter.RequestInfo.Vars["hostname"],
 		presenter.RequestInfo.Vars["title"],
 	)
+}
+
+func (presenter Presenter) ViewSnapshot() (
+	snapshot Snapshot, columns []Column, data [][]string, ok bool) {
+	snapshot, ok = presenter.findSnapshot()
 	if !ok {
 		return
 	}
 
 	contents := snapshot.Contents()
-	columnNames := contents[0]
+	if len(contents) == 0 {
+		return snapshot, nil, nil, true
+	}
 	data = contents[1:]
+	columns = sortTable(contents[0], data, presenter.RequestInfo.Form, false)
 
-	sortColumn := presenter.RequestInfo.Form["sort"]
-	_, isReversed := presenter.RequestInfo.Form["reverse"]
-	var sortColumnIndex int
-	for index, columnName := range columnNames {
-		column := Column{columnName, false, false}
-		if columnName == sortColumn {
-			column.IsSortColumn = true
-			column.ReverseLink = !isReversed
-			sortColumnIndex = index
+	ok = true
+	return
+}
+
+func (presenter Presenter) AggregateSnapshot() (
+	snapshot Snapshot, columns []Column, data [][]string, ok bool, err error) {
+	snapshot, ok = presenter.findSnapshot()
+	if !ok {
+		return
+	}
+
+	aggregates, err := parseAggregates(presenter.RequestInfo.Form["agg"])
+	if err != nil {
+		return
+	}
+	contents := snapshot.Contents()
+	if len(contents) == 0 {
+		return
+	}
+	groupColumns := splitList(presenter.RequestInfo.Form["group"])
+	columnNames, data, err := aggregateRows(contents[0], contents[1:], groupColumns, aggregates)
+	if err != nil {
+		return
+	}
+	columns = sortTable(columnNames, data, presenter.RequestInfo.Form, true)
+	return
+}
+
+// selectColumns turns sorted rows back into a table with a header row, restricted to the columns
+// named in the "columns" form value if there is one.
+func selectColumns(columns []Column, data [][]string, form map[string]string) (
+	table [][]string, err error) {
+	columnNames := make([]string, 0, len(columns))
+	for _, column := range columns {
+		columnNames = append(columnNames, column.Name)
+	}
+	selectedNames := splitList(form["columns"])
+	if len(selectedNames) == 0 {
+		return append([][]string{columnNames}, data...), nil
+	}
+
+	indexes := make([]int, len(selectedNames))
+	for index, columnName := range selectedNames {
+		if indexes[index] = findColumnIndex(columnNames, columnName); indexes[index] < 0 {
+			return nil, fmt.Errorf("Unknown column %q", columnName)
 		}
-		columns = append(columns, column)
 	}
+	table = append(table, selectedNames)
+	for _, row := range data {
+		selectedRow := make([]string, len(indexes))
+		for index, columnIndex := range indexes {
+			selectedRow[index] = cellAt(row, columnIndex)
+		}
+		table = append(table, selectedRow)
+	}
+	return table, nil
+}
 
-	if sortColumn != "" {
-		sort.Sort(SortableRows{data, sortColumnIndex, isReversed})
+func (presenter Presenter) ExportSnapshot() (
+	snapshot Snapshot, table [][]string, ok bool, err error) {
+	snapshot, columns, data, ok := presenter.ViewSnapshot()
+	if !ok {
+		return
 	}
+	table, err = selectColumns(columns, data, presenter.RequestInfo.Form)
+	return
+}
 
-	ok = true
+func (presenter Presenter) ExportAggregate() (
+	snapshot Snapshot, table [][]string, ok bool, err error) {
+	snapshot, columns, data, ok, err := presenter.AggregateSnapshot()
+	if !ok || err != nil {
+		return
+	}
+	table, err = selectColumns(columns, data, presenter.RequestInfo.Form)
+	return
+}
+
+// HOSTNAME_COLUMN names the synthetic column CompareHosts prefixes its table with.
+const HOSTNAME_COLUMN = "hostname"
+
+// SNAPSHOT_HOSTNAME_COLUMN is what CompareHosts calls a snapshot's own hostname column, so it
+// doesn't overwrite HOSTNAME_COLUMN.
+const SNAPSHOT_HOSTNAME_COLUMN = "hostname (snapshot)"
+
+// CompareHosts concatenates the snapshots with one title from every host (or just the hosts listed
+// in the "hosts" form value) into a single table, prefixed with a synthetic hostname column.
+// Columns are matched up by name, so hosts reporting slightly different columns still line up.
+// A snapshot column of its own named hostname is renamed to SNAPSHOT_HOSTNAME_COLUMN.
+func (presenter Presenter) CompareHosts() (
+	timestamp time.Time, title string, hostnames []string, columns []Column, data [][]string) {
+	timestamp = presenter.RequestInfo.Timestamp
+	title = presenter.RequestInfo.Vars["title"]
+	selectedHosts := make(map[string]bool)
+	for _, hostname := range splitList(presenter.RequestInfo.Form["hosts"]) {
+		selectedHosts[hostname] = true
+	}
+
+	columnNames := []string{HOSTNAME_COLUMN}
+	data = make([][]string, 0)
+	for _, snapshot := range presenter.Database.GetTitleSnapshots(timestamp, title) {
+		hostname := snapshot.Hostname
+		if len(selectedHosts) > 0 && !selectedHosts[hostname] {
+			continue
+		}
+		hostnames = append(hostnames, hostname)
+		contents := snapshot.Contents()
+		if len(contents) == 0 {
+			continue
+		}
+
+		columnIndexes := make([]int, len(contents[0]))
+		for index, columnName := range contents[0] {
+			if columnName == HOSTNAME_COLUMN {
+				columnName = SNAPSHOT_HOSTNAME_COLUMN
+			}
+			columnIndexes[index] = findColumnIndex(columnNames, columnName)
+			if columnIndexes[index] < 0 {
+				columnIndexes[index] = len(columnNames)
+				columnNames = append(columnNames, columnName)
+			}
+		}
+		for _, row := range contents[1:] {
+			mergedRow := make([]string, len(columnNames))
+			mergedRow[0] = hostname
+			for index, cell := range row {
+				if index < len(columnIndexes) {
+					mergedRow[columnIndexes[index]] = cell
+				}
+			}
+			data = append(data, mergedRow)
+		}
+	}
+
+	for index, row := range data {
+		for len(row) < len(columnNames) {
+			row = append(row, "")
+		}
+		data[index] = row
+	}
+	columns = sortTable(columnNames, data, presenter.RequestInfo.Form, true)
 	return
 }
@@ -1,19 +1,33 @@
 package timeturner
 
 import (
+	"net/http"
 	"testing"
 	"time"
 )
 
 type FakeDatabase struct {
 	findSnapshotOk bool
+	csvContents    string
+	auditEntries   []AuditEntry
+	actors         []Actor
+	pins           []Pin
+	annotations    []Annotation
 }
 
-func (db FakeDatabase) AddSnapshot(timestamp time.Time, hostname string, title string,
-	contents [][]string) {
+func (db *FakeDatabase) AddSnapshot(timestamp time.Time, hostname string, title string,
+	contents [][]string, onConflict ConflictMode, actor Actor) (version int64, err error) {
+	if db.findSnapshotOk && onConflict == RejectOnConflict {
+		return 0, ErrSnapshotExists
+	}
+	db.actors = append(db.actors, actor)
+	return 1, nil
 }
 func (db FakeDatabase) GetAllDays() []time.Time                 { return nil }
 func (db FakeDatabase) GetTimestamps(day time.Time) []time.Time { return nil }
+func (db FakeDatabase) GetTimestampsBetween(start time.Time, end time.Time) []time.Time {
+	return nil
+}
 func (db FakeDatabase) GetSnapshots(timestamp time.Time) []Snapshot {
 	return []Snapshot{
 		{Hostname: "host1", Title: "processes"},
@@ -24,16 +38,116 @@ func (db FakeDatabase) GetSnapshots(timestamp time.Time) []Snapshot {
 func (db FakeDatabase) GetSnapshotWithContents(timestamp time.Time, hostname string, title string) (
 	snapshot Snapshot, ok bool) {
 	if db.findSnapshotOk {
+		csvContents := db.csvContents
+		if csvContents == "" {
+			csvContents = "name,value\nkey2,2\nkey1,1\n"
+		}
 		return Snapshot{
 			UnixTimestamp: 123,
-			Hostname:      "host1",
-			Title:         "processes",
-			CsvContents:   "name,value\nkey2,2\nkey1,1\n",
+			Hostname:      hostname,
+			Title:         title,
+			CsvContents:   csvContents,
 		}, true
 	} else {
 		return Snapshot{}, false
 	}
 }
+func (db FakeDatabase) GetTitleSnapshots(timestamp time.Time, title string) []Snapshot {
+	snapshots := make([]Snapshot, 0)
+	for _, snapshot := range db.GetSnapshots(timestamp) {
+		if snapshot.Title == title {
+			snapshot, _ = db.GetSnapshotWithContents(timestamp, snapshot.Hostname, title)
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots
+}
+
+func (db FakeDatabase) GetSnapshotVersions(timestamp time.Time, hostname string,
+	title string) []int64 {
+	return []int64{1, 2}
+}
+func (db FakeDatabase) GetSnapshotVersion(timestamp time.Time, hostname string, title string,
+	version int64) (snapshot Snapshot, ok bool) {
+	snapshot, ok = db.GetSnapshotWithContents(timestamp, hostname, title)
+	if version == 1 {
+		snapshot.CsvContents = "name,value\nold,0\n"
+	}
+	return snapshot, ok && version <= 2
+}
+func (db *FakeDatabase) AppendRows(timestamp time.Time, hostname string, title string,
+	contents [][]string, actor Actor) (created bool, err error) {
+	if len(contents) == 0 || contents[0][0] != "name" {
+		return false, ErrHeaderMismatch
+	}
+	db.actors = append(db.actors, actor)
+	return !db.findSnapshotOk, nil
+}
+func (db *FakeDatabase) DeleteSnapshot(timestamp time.Time, hostname string, title string,
+	actor Actor) (snapshot Snapshot, ok bool) {
+	db.actors = append(db.actors, actor)
+	return db.GetSnapshotWithContents(timestamp, hostname, title)
+}
+func (db FakeDatabase) DeleteHost(hostname string, actor Actor) []Snapshot { return nil }
+func (db FakeDatabase) DeleteTitle(title string, actor Actor) []Snapshot   { return nil }
+func (db FakeDatabase) DeleteTimeRange(start time.Time, end time.Time, actor Actor) []Snapshot {
+	return db.GetSnapshots(start)
+}
+
+func (db *FakeDatabase) AddAuditEntry(entry AuditEntry) {
+	db.auditEntries = append(db.auditEntries, entry)
+}
+func (db FakeDatabase) GetAuditEntries(limit int) []AuditEntry { return db.auditEntries }
+func (db FakeDatabase) GetStorageStats() []StorageStats {
+	return []StorageStats{
+		{Codec: GZIP_CODEC, SnapshotCount: 2, ContentBytes: 1000, StoredBytes: 200},
+		{Codec: NO_CODEC, SnapshotCount: 1, ContentBytes: 10, StoredBytes: 10},
+	}
+}
+func (db FakeDatabase) GetUnchangedSince(timestamp time.Time) []Snapshot {
+	return []Snapshot{{UnixTimestamp: 123, Hostname: "host1", Title: "queries"}}
+}
+
+func (db *FakeDatabase) AddPin(pin Pin) Pin {
+	pin.Id = int64(len(db.pins)) + 1
+	db.pins = append(db.pins, pin)
+	return pin
+}
+func (db FakeDatabase) GetPins() []Pin { return db.pins }
+func (db FakeDatabase) DeletePin(id int64) (pin Pin, ok bool) {
+	if id < 1 || id > int64(len(db.pins)) {
+		return Pin{}, false
+	}
+	return db.pins[id-1], true
+}
+
+func (db *FakeDatabase) AddAnnotation(annotation Annotation) Annotation {
+	annotation.Id = int64(len(db.annotations)) + 1
+	db.annotations = append(db.annotations, annotation)
+	return annotation
+}
+func (db *FakeDatabase) UpdateAnnotation(annotation Annotation) bool {
+	if annotation.Id < 1 || annotation.Id > int64(len(db.annotations)) {
+		return false
+	}
+	db.annotations[annotation.Id-1] = annotation
+	return true
+}
+func (db FakeDatabase) GetAnnotation(id int64) (annotation Annotation, ok bool) {
+	if id < 1 || id > int64(len(db.annotations)) {
+		return Annotation{}, false
+	}
+	return db.annotations[id-1], true
+}
+func (db FakeDatabase) DeleteAnnotation(id int64) (annotation Annotation, ok bool) {
+	return db.GetAnnotation(id)
+}
+func (db FakeDatabase) GetAnnotations(start time.Time, end time.Time) []Annotation {
+	return db.annotations
+}
+func (db FakeDatabase) SearchAnnotations(query string) []Annotation { return db.annotations }
+func (db FakeDatabase) Ping() error                                 { return nil }
+func (db FakeDatabase) PendingMigrations() []Migration              { return nil }
 
 func setUpPresenter() (*FakeDatabase, Presenter) {
 	requestInfo := RequestInfo{
@@ -111,3 +225,342 @@ func TestViewSnapshotNotFound(t *testing.T) {
 		t.Fatalf("Got ok for snapshot that doesn't exist")
 	}
 }
+
+func TestViewSnapshotSortsAsStrings(t *testing.T) {
+	fakeDb, presenter := setUpPresenter()
+	fakeDb.findSnapshotOk = true
+	fakeDb.csvContents = "name,value\nkey1,9\nkey2,10\n"
+	presenter.RequestInfo.Form["sort"] = "value"
+	_, _, data, _ := presenter.ViewSnapshot()
+	if data[0][0] != "key2" {
+		t.Fatalf("Unexpected data %v", data)
+	}
+}
+
+func TestSortTableSortsNumbersFirst(t *testing.T) {
+	// Imported snapshots can have rows shorter than the header.
+	data := [][]string{
+		{"key1", "10"}, {"key2", "-"}, {"key3", "9"}, {"key4", "NaN"}, {"key5", "abc"},
+		{"key6", "9"}, {"key7"},
+	}
+	form := map[string]string{"sort": "value"}
+	sortTable([]string{"name", "value"}, data, form, true)
+	names := make([]string, len(data))
+	for index, row := range data {
+		names[index] = row[0]
+	}
+	expected := []string{"key3", "key6", "key1", "key7", "key2", "key4", "key5"}
+	if !areStringsEqual(names, expected) {
+		t.Fatalf("Unexpected order %v", names)
+	}
+
+	form["reverse"] = ""
+	sortTable([]string{"name", "value"}, data, form, true)
+	for index, row := range data {
+		names[index] = row[0]
+	}
+	expected = []string{"key5", "key4", "key2", "key7", "key1", "key3", "key6"}
+	if !areStringsEqual(names, expected) {
+		t.Fatalf("Unexpected reversed order %v", names)
+	}
+}
+
+func TestAggregateEmptySnapshot(t *testing.T) {
+	fakeDb, presenter := setUpPresenter()
+	fakeDb.findSnapshotOk = true
+	fakeDb.csvContents = "\n"
+	presenter.RequestInfo.Form["agg"] = "count"
+	_, columns, data, ok, err := presenter.AggregateSnapshot()
+	if !ok || err != nil || len(columns) != 0 || len(data) != 0 {
+		t.Fatalf("Unexpected aggregate of an empty snapshot: %v %v %v %v", columns, data, ok, err)
+	}
+	if _, columns, data, ok := presenter.ViewSnapshot(); !ok || len(columns)+len(data) != 0 {
+		t.Fatalf("Unexpected view of an empty snapshot: %v %v %v", columns, data, ok)
+	}
+}
+
+func TestAggregateSnapshot(t *testing.T) {
+	fakeDb, presenter := setUpPresenter()
+	fakeDb.findSnapshotOk = true
+	fakeDb.csvContents = "user,rss\nroot,10\nsteve,200\nroot,30\n"
+	presenter.RequestInfo.Form["group"] = "user"
+	presenter.RequestInfo.Form["agg"] = "count,sum:rss"
+	presenter.RequestInfo.Form["sort"] = "sum(rss)"
+	presenter.RequestInfo.Form["reverse"] = ""
+	_, columns, data, ok, err := presenter.AggregateSnapshot()
+	if !ok || err != nil {
+		t.Fatalf("Failed to aggregate snapshot: %v", err)
+	}
+	if len(columns) != 3 || !columns[2].IsSortColumn {
+		t.Fatalf("Unexpected columns %v", columns)
+	}
+	isDataOk := areStringsEqual(data[0], []string{"steve", "1", "200"}) &&
+		areStringsEqual(data[1], []string{"root", "2", "40"})
+	if !isDataOk {
+		t.Fatalf("Unexpected data %v", data)
+	}
+
+	presenter.RequestInfo.Form["agg"] = "sum:nonexistent"
+	_, _, _, _, err = presenter.AggregateSnapshot()
+	if err == nil {
+		t.Fatalf("No error for unknown aggregate column")
+	}
+}
+
+func TestExportSnapshot(t *testing.T) {
+	fakeDb, presenter := setUpPresenter()
+	fakeDb.findSnapshotOk = true
+	presenter.RequestInfo.Form["sort"] = "name"
+	presenter.RequestInfo.Form["columns"] = "value"
+	_, table, ok, err := presenter.ExportSnapshot()
+	if !ok || err != nil {
+		t.Fatalf("Failed to export snapshot: %v", err)
+	}
+	isTableOk := len(table) == 3 &&
+		areStringsEqual(table[0], []string{"value"}) &&
+		areStringsEqual(table[1], []string{"1"}) &&
+		areStringsEqual(table[2], []string{"2"})
+	if !isTableOk {
+		t.Fatalf("Unexpected table %v", table)
+	}
+
+	presenter.RequestInfo.Form["columns"] = "nonexistent"
+	_, _, _, err = presenter.ExportSnapshot()
+	if err == nil {
+		t.Fatalf("No error for unknown export column")
+	}
+}
+
+func TestCompareHosts(t *testing.T) {
+	fakeDb, presenter := setUpPresenter()
+	fakeDb.findSnapshotOk = true
+	presenter.RequestInfo.Vars = map[string]string{"title": "processes"}
+	presenter.RequestInfo.Form["sort"] = "value"
+	_, _, hostnames, columns, data := presenter.CompareHosts()
+	if !areStringsEqual(hostnames, []string{"host1", "host2"}) {
+		t.Fatalf("Unexpected hostnames %v", hostnames)
+	}
+	if !(len(columns) == 3 && columns[0].Name == "hostname" && columns[2].IsSortColumn) {
+		t.Fatalf("Unexpected columns %v", columns)
+	}
+	isDataOk := len(data) == 4 &&
+		areStringsEqual(data[0], []string{"host1", "key1", "1"}) &&
+		areStringsEqual(data[1], []string{"host2", "key1", "1"}) &&
+		areStringsEqual(data[2], []string{"host1", "key2", "2"})
+	if !isDataOk {
+		t.Fatalf("Unexpected data %v", data)
+	}
+
+	presenter.RequestInfo.Form["hosts"] = "host2"
+	_, _, hostnames, _, data = presenter.CompareHosts()
+	if !areStringsEqual(hostnames, []string{"host2"}) || len(data) != 2 {
+		t.Fatalf("Unexpected hosts %v with data %v", hostnames, data)
+	}
+}
+
+func TestCompareHostsRenamesHostnameColumn(t *testing.T) {
+	fakeDb, presenter := setUpPresenter()
+	fakeDb.findSnapshotOk = true
+	fakeDb.csvContents = "hostname,value\nlocalhost,1\n"
+	presenter.RequestInfo.Vars = map[string]string{"title": "processes"}
+	_, _, _, columns, data := presenter.CompareHosts()
+	isColumnsOk := len(columns) == 3 && columns[0].Name == HOSTNAME_COLUMN &&
+		columns[1].Name == SNAPSHOT_HOSTNAME_COLUMN
+	if !isColumnsOk {
+		t.Fatalf("Unexpected columns %v", columns)
+	}
+	if len(data) != 2 || !areStringsEqual(data[0], []string{"host1", "localhost", "1"}) {
+		t.Fatalf("Unexpected data %v", data)
+	}
+}
+
+func TestDeleteTimeRange(t *testing.T) {
+	_, presenter := setUpPresenter()
+	presenter.RequestInfo.Form["start"] = "2013-10-06"
+	presenter.RequestInfo.Form["end"] = "2013-10-07"
+	snapshots, err := presenter.DeleteTimeRange()
+	if err != nil || len(snapshots) != 3 {
+		t.Fatalf("Unexpected result deleting time range: %v, %v", snapshots, err)
+	}
+
+	delete(presenter.RequestInfo.Form, "end")
+	if _, err = presenter.DeleteTimeRange(); err == nil {
+		t.Fatalf("No error deleting time range without an end")
+	}
+}
+
+func TestWritesIdentifyTheCaller(t *testing.T) {
+	fakeDb, presenter := setUpPresenter()
+	presenter.RequestInfo.Vars = map[string]string{"hostname": "host1", "title": "processes"}
+	presenter.RequestInfo.Body = "name,value\nkey1,1\n"
+	presenter.RequestInfo.Identity = "collector"
+	presenter.RequestInfo.SourceAddress = "10.0.0.1"
+	presenter.RequestInfo.Header = make(http.Header)
+	presenter.AddSnapshot()
+	presenter.AppendRows()
+	presenter.DeleteSnapshot()
+
+	expected := Actor{Identity: "collector", SourceAddress: "10.0.0.1"}
+	if len(fakeDb.actors) != 3 {
+		t.Fatalf("Unexpected actors %v", fakeDb.actors)
+	}
+	for _, actor := range fakeDb.actors {
+		if actor != expected {
+			t.Fatalf("Expected %v, got %v", expected, actor)
+		}
+	}
+}
+
+func TestAddSnapshotConflictHeader(t *testing.T) {
+	fakeDb, presenter := setUpPresenter()
+	fakeDb.findSnapshotOk = true
+	presenter.RequestInfo.Vars = map[string]string{"hostname": "host1", "title": "processes"}
+	presenter.RequestInfo.Body = "name,value\nkey3,3\n"
+	presenter.RequestInfo.Header = make(http.Header)
+
+	presenter.RequestInfo.Header.Set(CONFLICT_HEADER, "reject")
+	if _, err := presenter.AddSnapshot(); err != ErrSnapshotExists {
+		t.Fatalf("Expected ErrSnapshotExists, got %v", err)
+	}
+	presenter.RequestInfo.Header.Set(CONFLICT_HEADER, "merge")
+	if _, err := presenter.AddSnapshot(); err == nil {
+		t.Fatalf("No error for unknown conflict mode")
+	}
+
+	presenter.RequestInfo.Header.Set(CONFLICT_HEADER, "append")
+	if _, err := presenter.AddSnapshot(); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+}
+
+func TestViewSnapshotVersion(t *testing.T) {
+	fakeDb, presenter := setUpPresenter()
+	fakeDb.findSnapshotOk = true
+	presenter.RequestInfo.Form["version"] = "1"
+	_, _, data, ok := presenter.ViewSnapshot()
+	if !ok || data[0][0] != "old" {
+		t.Fatalf("Unexpected data for version 1: %v", data)
+	}
+
+	for _, version := range []string{"3", "latest"} {
+		presenter.RequestInfo.Form["version"] = version
+		if _, _, _, ok = presenter.ViewSnapshot(); ok {
+			t.Fatalf("Got ok for nonexistent version %v", version)
+		}
+	}
+}
+
+func TestAppendRowsFromBody(t *testing.T) {
+	fakeDb, presenter := setUpPresenter()
+	fakeDb.findSnapshotOk = true
+	presenter.RequestInfo.Body = "name,value\nkey3,3\nkey4,4\n"
+	rowCount, err := presenter.AppendRows()
+	if err != nil || rowCount != 2 {
+		t.Fatalf("Unexpected result appending rows: %d, %v", rowCount, err)
+	}
+
+	presenter.RequestInfo.Body = "other\nkey5\n"
+	if _, err = presenter.AppendRows(); err != ErrHeaderMismatch {
+		t.Fatalf("Expected ErrHeaderMismatch, got %v", err)
+	}
+	for _, body := range []string{"", "name,value\nkey\"5,5\n"} {
+		presenter.RequestInfo.Body = body
+		if _, err = presenter.AppendRows(); err == nil || err == ErrHeaderMismatch {
+			t.Fatalf("Expected a parse error for %q, got %v", body, err)
+		}
+	}
+}
+
+func TestStorageStats(t *testing.T) {
+	_, presenter := setUpPresenter()
+	_, total := presenter.StorageStats()
+	if total.SnapshotCount != 3 || total.BytesSaved() != 800 {
+		t.Fatalf("Unexpected total storage stats %v", total)
+	}
+}
+
+func TestUnchangedSince(t *testing.T) {
+	_, presenter := setUpPresenter()
+	unchangedSince := presenter.UnchangedSince()
+	if len(unchangedSince) != 1 || unchangedSince["host1"]["queries"].Unix() != 123 {
+		t.Fatalf("Unexpected unchanged times %v", unchangedSince)
+	}
+	if !unchangedSince["host2"]["processes"].IsZero() {
+		t.Fatalf("Unexpected unchanged time for host2")
+	}
+}
+
+func TestAddPin(t *testing.T) {
+	fakeDb, presenter := setUpPresenter()
+	presenter.RequestInfo.Identity = "steve"
+	presenter.RequestInfo.Form["at"] = "2013-10-05 15:32:44"
+	presenter.RequestInfo.Form["hostname"] = "host1"
+	presenter.RequestInfo.Form["note"] = "outage"
+	pin, err := presenter.AddPin()
+	if err != nil || !pin.IsSingleTimestamp() || pin.Start().Format(TIME_FORMAT) != "15:32:44" ||
+		pin.Hostname != "host1" || pin.Identity != "steve" {
+		t.Fatalf("Unexpected pin %v, %v", pin, err)
+	}
+
+	presenter.RequestInfo.Form = map[string]string{"start": "2013-10-05", "end": "2013-10-06"}
+	pin, err = presenter.AddPin()
+	if err != nil || pin.End().Sub(pin.Start()) != 24*time.Hour || pin.Hostname != "" {
+		t.Fatalf("Unexpected range pin %v, %v", pin, err)
+	}
+	presenter.RequestInfo.Form = map[string]string{"start": "2013-10-05"}
+	if _, err = presenter.AddPin(); err == nil {
+		t.Fatalf("Pinned a range without an end")
+	}
+	if len(fakeDb.pins) != 2 {
+		t.Fatalf("Unexpected pins stored: %v", fakeDb.pins)
+	}
+
+	fakeDb.findSnapshotOk = true
+	snapshot := Snapshot{UnixTimestamp: pin.StartUnixTimestamp, Hostname: "host1", Title: "x"}
+	if covering := presenter.PinsCovering(snapshot); len(covering) != 1 || covering[0].Id != 2 {
+		t.Fatalf("Unexpected covering pins: %v", covering)
+	}
+}
+
+func TestAddAndUpdateAnnotation(t *testing.T) {
+	fakeDb, presenter := setUpPresenter()
+	presenter.RequestInfo.Identity = "steve"
+	presenter.RequestInfo.Form = map[string]string{
+		"start": "2013-10-05 14:02:00", "end": "2013-10-05 14:10:00", "text": "DB failover",
+	}
+	annotation, err := presenter.AddAnnotation()
+	if err != nil || annotation.End().Sub(annotation.Start()) != 8*time.Minute ||
+		annotation.Identity != "steve" {
+		t.Fatalf("Unexpected annotation %v, %v", annotation, err)
+	}
+	presenter.RequestInfo.Form = map[string]string{"start": "2013-10-05", "end": "2013-10-06"}
+	if _, err = presenter.AddAnnotation(); err == nil {
+		t.Fatalf("Added an annotation without text")
+	}
+	presenter.RequestInfo.Form = map[string]string{"start": "2013-10-05", "text": "x"}
+	if _, err = presenter.AddAnnotation(); err == nil {
+		t.Fatalf("Added an annotation without an end")
+	}
+	presenter.RequestInfo.Form = map[string]string{
+		"start": "2013-10-06", "end": "2013-10-05", "text": "x",
+	}
+	if _, err = presenter.AddAnnotation(); err == nil || err.Error() != "start must be before end" {
+		t.Fatalf("Unexpected error for an annotation ending before it starts: %v", err)
+	}
+
+	presenter.RequestInfo.Vars = map[string]string{"id": "1"}
+	presenter.RequestInfo.Form = map[string]string{"end": "2013-10-05 14:12:00"}
+	annotation, ok, err := presenter.UpdateAnnotation()
+	if !ok || err != nil || annotation.End().Format(TIME_FORMAT) != "14:12:00" ||
+		fakeDb.annotations[0].Text != "DB failover" {
+		t.Fatalf("Unexpected updated annotation %v, %v, %v", annotation, ok, err)
+	}
+	presenter.RequestInfo.Form = map[string]string{"end": "2013-10-05 14:00:00"}
+	if _, _, err = presenter.UpdateAnnotation(); err == nil {
+		t.Fatalf("Moved an annotation's end before its start")
+	}
+	presenter.RequestInfo.Vars = map[string]string{"id": "2"}
+	if _, ok, _ = presenter.UpdateAnnotation(); ok {
+		t.Fatalf("Updated a nonexistent annotation")
+	}
+}
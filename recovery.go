@@ -0,0 +1,93 @@
+package timeturner
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// ErrorContext is rendered by the "error" template, or as JSON for API clients.
+type ErrorContext struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"status_text"`
+	Message    string `json:"error"`
+	RequestId  string `json:"request_id"`
+}
+
+// acceptsHtml reports whether the client is a browser rather than an API client like curl or a
+// collector, judging by its Accept header.
+func acceptsHtml(header http.Header) bool {
+	return strings.Contains(header.Get("Accept"), "text/html")
+}
+
+// renderError responds with the "error" template for browsers and a JSON error for API clients.
+func renderError(templates *template.Template, writer http.ResponseWriter, header http.Header,
+	requestId string, statusCode int, message string) {
+	errorContext := ErrorContext{statusCode, http.StatusText(statusCode), message, requestId}
+	writer.Header().Set("Cache-Control", "no-store")
+	if acceptsHtml(header) && templates != nil {
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		writer.WriteHeader(statusCode)
+		if err := templates.ExecuteTemplate(writer, "error", errorContext); err != nil {
+			log.Printf("ERROR: Request %v: Failed to render error page: %v\n", requestId, err)
+		}
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	if err := json.NewEncoder(writer).Encode(errorContext); err != nil {
+		log.Printf("ERROR: Request %v: Failed to write error: %v\n", requestId, err)
+	}
+}
+
+// handlePanic logs a panic recovered while handling a request, along with its stack, and responds
+// with a 500 unless the response has already started.
+func (app App) handlePanic(recovered interface{}, writer http.ResponseWriter,
+	request *http.Request, requestId string, responseStarted bool) {
+	if recovered == http.ErrAbortHandler {
+		// The handler asked for the connection to be dropped.
+		panic(recovered)
+	}
+	app.Metrics.PanicRecovered()
+	log.Printf(
+		"ERROR: Request %v: Panic handling %v %v: %v\n%s",
+		requestId, request.Method, request.URL, recovered, debug.Stack(),
+	)
+	if !responseStarted {
+		renderError(
+			app.Templates, writer, request.Header, requestId, http.StatusInternalServerError,
+			"Something went wrong handling this request.",
+		)
+	}
+}
+
+type requestIdKey struct{}
+
+// requestIdFor returns the ID Handler gave the request, or a new one if it bypassed Handler.
+func requestIdFor(request *http.Request) string {
+	if id, ok := request.Context().Value(requestIdKey{}).(string); ok {
+		return id
+	}
+	return newRequestId()
+}
+
+// Handler serves the app's routes, giving each request an ID and turning panics that escape the
+// route handlers into error pages instead of dropped connections.
+func (app App) Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := newRequestId()
+		writer.Header().Set(REQUEST_ID_HEADER, id)
+		request = request.WithContext(context.WithValue(request.Context(), requestIdKey{}, id))
+		response := &loggedResponse{ResponseWriter: writer}
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				app.handlePanic(recovered, response, request, id, response.status != 0)
+			}
+		}()
+		app.Router.ServeHTTP(response, request)
+	})
+}
@@ -0,0 +1,82 @@
+package timeturner
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serveWithAccept(handler http.Handler, url string, accept string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", url, nil)
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func assertJsonError(t *testing.T, response *httptest.ResponseRecorder, status int) {
+	var errorContext ErrorContext
+	if err := json.NewDecoder(response.Body).Decode(&errorContext); err != nil {
+		t.Fatalf("Failed to decode error: %v", err)
+	}
+	requestId := response.Header().Get(REQUEST_ID_HEADER)
+	if response.Code != status || errorContext.Status != status || requestId == "" ||
+		errorContext.RequestId != requestId || errorContext.Message == "" {
+		t.Fatalf("Unexpected error %v %v with request ID %v", response.Code, errorContext, requestId)
+	}
+}
+
+func assertHtmlError(t *testing.T, response *httptest.ResponseRecorder, status int,
+	heading string) {
+	body := response.Body.String()
+	if response.Code != status || !strings.Contains(body, heading) ||
+		!strings.Contains(body, "Request "+response.Header().Get(REQUEST_ID_HEADER)) {
+		t.Fatalf("Unexpected error page %v:\n%v", response.Code, body)
+	}
+}
+
+func TestNotFoundPage(t *testing.T) {
+	handler := MakeApp(setUp(), make(Authorizer)).Handler()
+	browserAccept := "text/html,application/xhtml+xml,*/*;q=0.8"
+	assertHtmlError(
+		t, serveWithAccept(handler, "/no/such/page", browserAccept), http.StatusNotFound,
+		"404 Not Found",
+	)
+	assertJsonError(t, serveWithAccept(handler, "/no/such/page", ""), http.StatusNotFound)
+}
+
+func TestNotFoundWithoutHandler(t *testing.T) {
+	router := MakeApp(setUp(), make(Authorizer)).Router
+	assertJsonError(t, serveWithAccept(router, "/no/such/page", ""), http.StatusNotFound)
+}
+
+func TestViewErrors(t *testing.T) {
+	handler := MakeApp(setUp(), make(Authorizer)).Handler()
+	url := "/2013-10-05/15:32:44/host1/quotes/"
+	assertHtmlError(t, serveWithAccept(handler, url, "text/html"), http.StatusNotFound, "404")
+	assertJsonError(t, serveWithAccept(handler, url, ""), http.StatusNotFound)
+}
+
+func TestPanicRecovery(t *testing.T) {
+	app := MakeApp(setUp(), make(Authorizer))
+	app.Router.HandleFunc("/panic", app.WrapHandler(func(View) { panic("oops") }))
+	app.Router.HandleFunc("/unwrapped-panic", func(http.ResponseWriter, *http.Request) {
+		panic("oops")
+	})
+	handler := app.Handler()
+
+	for _, url := range []string{"/panic", "/unwrapped-panic"} {
+		assertHtmlError(
+			t, serveWithAccept(handler, url, "text/html"), http.StatusInternalServerError,
+			"500 Internal Server Error",
+		)
+		assertJsonError(t, serveWithAccept(handler, url, ""), http.StatusInternalServerError)
+	}
+	if app.Metrics.panicsRecovered != 4 {
+		t.Fatalf("Expected 4 panics recovered, got %v", app.Metrics.panicsRecovered)
+	}
+}
@@ -0,0 +1,128 @@
+package timeturner
+
+import (
+	"errors"
+	"github.com/coopernurse/gorp"
+	"strconv"
+	"time"
+)
+
+// RetentionPolicy decides which snapshots are kept as they age. Snapshots younger than KeepAllFor
+// are all kept. Up to KeepTenMinutelyFor, the earliest snapshot of each host and title in each 10
+// minute window is kept, and beyond that the earliest in each hour. Snapshots older than MaxAge
+// are deleted; a zero MaxAge keeps the hourly snapshots forever. A zero KeepTenMinutelyFor turns
+// downsampling off, keeping every snapshot until MaxAge. Pinned snapshots are always kept.
+type RetentionPolicy struct {
+	KeepAllFor         time.Duration
+	KeepTenMinutelyFor time.Duration
+	MaxAge             time.Duration
+}
+
+var DefaultRetentionPolicy = RetentionPolicy{MaxAge: 14 * 24 * time.Hour}
+
+func (policy RetentionPolicy) Validate() error {
+	if policy.KeepTenMinutelyFor > 0 && policy.KeepAllFor > policy.KeepTenMinutelyFor {
+		return errors.New("snapshots must be kept 10-minutely for longer than they're all kept")
+	}
+	if policy.MaxAge > 0 && policy.MaxAge < policy.KeepTenMinutelyFor {
+		return errors.New("snapshots must be kept 10-minutely for less than the maximum age")
+	}
+	return nil
+}
+
+// IsExpired reports whether a snapshot taken at timestamp is past MaxAge.
+func (policy RetentionPolicy) IsExpired(timestamp time.Time, now time.Time) bool {
+	return policy.MaxAge > 0 && timestamp.Before(now.Add(-policy.MaxAge))
+}
+
+// DownsampleWindow returns the length of the windows a snapshot taken at timestamp is downsampled
+// to, keeping only the earliest snapshot of each host and title in each, or zero if it's kept
+// regardless. Windows are aligned to Unix time.
+func (policy RetentionPolicy) DownsampleWindow(timestamp time.Time, now time.Time) time.Duration {
+	switch {
+	case policy.KeepTenMinutelyFor == 0 || !timestamp.Before(now.Add(-policy.KeepAllFor)):
+		return 0
+	case timestamp.Before(now.Add(-policy.KeepTenMinutelyFor)):
+		return time.Hour
+	default:
+		return 10 * time.Minute
+	}
+}
+
+// UseRetentionPolicy changes which snapshots Compact keeps. Snapshots past the policy's MaxAge are
+// also deleted whenever a snapshot is added.
+func (database *TimeturnerDatabase) UseRetentionPolicy(policy RetentionPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	database.retention = policy
+	return nil
+}
+
+// downsampledWhere is a WHERE clause matching the snapshots between two times that have an
+// earlier snapshot of the same host and title in the same window of the given length.
+func downsampledWhere(windowSeconds int64) string {
+	window := strconv.FormatInt(windowSeconds, 10)
+	return "UnixTimestamp >= ? AND UnixTimestamp < ? AND EXISTS (" +
+		"SELECT 1 FROM Snapshot Earlier WHERE Earlier.Hostname = Snapshot.Hostname " +
+		"AND Earlier.Title = Snapshot.Title AND Earlier.UnixTimestamp < Snapshot.UnixTimestamp " +
+		"AND Earlier.UnixTimestamp / " + window + " = Snapshot.UnixTimestamp / " + window +
+		") AND " + notPinned
+}
+
+// compactWhere deletes the snapshots matching the WHERE clause and returns how many there were.
+func (database *TimeturnerDatabase) compactWhere(where string, args ...interface{}) int64 {
+	var count int64
+	var hashes []string
+	err := database.inTransaction(func(transaction *gorp.Transaction) (err error) {
+		count, err = transaction.SelectInt("SELECT COUNT(*) FROM Snapshot WHERE "+where, args...)
+		if err == nil && count > 0 {
+			hashes, err = deleteWhere(transaction, where, args...)
+		}
+		return err
+	})
+	if err != nil {
+		panic(err)
+	}
+	database.collectGarbage(hashes)
+	return count
+}
+
+// Compact applies the retention policy, downsampling older snapshots and deleting expired ones,
+// and returns how many snapshots it deleted. Windows are aligned to Unix time, so a snapshot kept
+// in a 10 minute window is also the one kept in its hour once it's older. It also deletes blobs
+// nothing refers to anymore and retries moving contents that failed to upload to the ContentStore.
+func (database *TimeturnerDatabase) Compact() int64 {
+	policy := database.retention
+	now := database.nowFunc()
+	var deleted int64
+	if policy.MaxAge > 0 {
+		deleted += database.compactWhere(
+			"UnixTimestamp < ? AND "+notPinned, now.Add(-policy.MaxAge).Unix(),
+		)
+	}
+	if policy.KeepTenMinutelyFor > 0 {
+		tenMinutelyStart := now.Add(-policy.KeepTenMinutelyFor).Unix()
+		deleted += database.compactWhere(
+			downsampledWhere(int64(time.Hour/time.Second)), 0, tenMinutelyStart,
+		)
+		deleted += database.compactWhere(
+			downsampledWhere(int64(10*time.Minute/time.Second)),
+			tenMinutelyStart, now.Add(-policy.KeepAllFor).Unix(),
+		)
+	}
+	database.metrics.RetentionDeleted(deleted)
+	var orphaned []string
+	_, err := database.mapper.Select(
+		&orphaned,
+		"SELECT Hash FROM ContentBlob WHERE "+
+			"NOT EXISTS (SELECT 1 FROM Snapshot WHERE ContentHash = Hash) AND "+
+			"NOT EXISTS (SELECT 1 FROM SnapshotRevision WHERE ContentHash = Hash)",
+	)
+	if err != nil {
+		panic(err)
+	}
+	database.collectGarbage(orphaned)
+	database.uploadBlobs("SELECT Hash FROM ContentBlob")
+	return deleted
+}
@@ -0,0 +1,103 @@
+package timeturner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicyValidate(t *testing.T) {
+	day := 24 * time.Hour
+	valid := []RetentionPolicy{
+		DefaultRetentionPolicy,
+		{KeepAllFor: 6 * time.Hour, KeepTenMinutelyFor: 3 * day, MaxAge: 30 * day},
+		{KeepAllFor: 6 * time.Hour, KeepTenMinutelyFor: 3 * day},
+	}
+	for _, policy := range valid {
+		if err := policy.Validate(); err != nil {
+			t.Fatalf("Rejected %v: %v", policy, err)
+		}
+	}
+	invalid := []RetentionPolicy{
+		{KeepAllFor: 4 * day, KeepTenMinutelyFor: 3 * day},
+		{KeepTenMinutelyFor: 3 * day, MaxAge: 2 * day},
+	}
+	for _, policy := range invalid {
+		if err := policy.Validate(); err == nil {
+			t.Fatalf("Accepted %v", policy)
+		}
+	}
+}
+
+func TestCompactDownsamplesOlderSnapshots(t *testing.T) {
+	// An hour boundary in every timezone with whole-hour offsets.
+	start := time.Unix(1381017600, 0)
+	current := start
+	database := InitializeDatabase(setUpConnection(), func() time.Time { return current }, false)
+	day := 24 * time.Hour
+	err := database.UseRetentionPolicy(
+		RetentionPolicy{KeepAllFor: 2 * time.Hour, KeepTenMinutelyFor: 2 * day, MaxAge: 30 * day},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(timestamp time.Time, hostname string) {
+		database.AddSnapshot(timestamp, hostname, "processes", wrapSimpleContents("x"),
+			OverwriteOnConflict, Actor{})
+	}
+
+	for minute := 0; minute < 120; minute += 5 {
+		add(start.Add(time.Duration(minute)*time.Minute), "host1")
+	}
+	add(start.Add(5*time.Minute), "host2")
+	pinned := start.Add(7 * time.Minute)
+	add(pinned, "host1")
+	database.AddPin(Pin{StartUnixTimestamp: pinned.Unix(), EndUnixTimestamp: pinned.Unix() + 1})
+
+	recentStart := start.Add(10*day - time.Hour)
+	for minute := 0; minute < 10; minute++ {
+		add(recentStart.Add(time.Duration(minute)*time.Minute), "host1")
+	}
+	tenMinutelyStart := start.Add(9 * day)
+	for minute := 0; minute < 30; minute += 2 {
+		add(tenMinutelyStart.Add(time.Duration(minute)*time.Minute), "host1")
+	}
+	add(start.Add(-21*day), "host1")
+
+	current = start.Add(10 * day)
+	if deleted := database.Compact(); deleted != 22+12+1 {
+		t.Fatalf("Unexpected deletion count %d", deleted)
+	}
+	if deleted := database.Compact(); deleted != 0 {
+		t.Fatalf("Compacting twice deleted %d snapshots", deleted)
+	}
+
+	var kept []time.Time
+	for _, day := range database.GetAllDays() {
+		kept = append(kept, database.GetTimestamps(day)...)
+	}
+	expected := []time.Time{start, start.Add(5 * time.Minute), pinned, start.Add(time.Hour)}
+	for minute := 0; minute < 30; minute += 10 {
+		expected = append(expected, tenMinutelyStart.Add(time.Duration(minute)*time.Minute))
+	}
+	for minute := 0; minute < 10; minute++ {
+		expected = append(expected, recentStart.Add(time.Duration(minute)*time.Minute))
+	}
+	if len(kept) != len(expected) {
+		t.Fatalf("Expected %v, kept %v", expected, kept)
+	}
+	for index, timestamp := range kept {
+		if !timestamp.Equal(expected[index]) {
+			t.Fatalf("Expected %v, kept %v", expected, kept)
+		}
+	}
+	if snapshots := database.GetSnapshots(start.Add(5 * time.Minute)); len(snapshots) != 1 ||
+		snapshots[0].Hostname != "host2" {
+		t.Fatalf("Unexpected snapshots kept for host2: %v", snapshots)
+	}
+
+	// The 10-minutely snapshots become hourly and the recent ones 10-minutely.
+	current = current.Add(day + time.Hour)
+	if deleted := database.Compact(); deleted != 2+9 {
+		t.Fatalf("Unexpected deletion count %d after a day", deleted)
+	}
+}
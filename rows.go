@@ -0,0 +1,107 @@
+package timeturner
+
+import (
+	"encoding/json"
+	"github.com/coopernurse/gorp"
+)
+
+// ROWS_CODEC marks snapshots whose data rows are each stored in a SnapshotRow, with the row's
+// cells as a JSON object keyed by column name, so SQL can filter, aggregate and index into them:
+//
+//	SELECT json_extract(Cells, '$.command') FROM SnapshotRow
+//	WHERE SnapshotId = ? AND CAST(json_extract(Cells, '$.rss') AS INTEGER) > 1000000
+//
+// The snapshot's own CsvContents hold just the header row. Row storage is chosen per title; see
+// TimeturnerDatabase.UseRowStorage.
+const ROWS_CODEC = "rows"
+
+// RowStorageTitle records a title whose snapshots are stored as rows.
+type RowStorageTitle struct {
+	Title string
+}
+
+func usesRowStorage(executor gorp.SqlExecutor, title string) bool {
+	count, err := executor.SelectInt("SELECT COUNT(*) FROM RowStorageTitle WHERE Title = ?", title)
+	if err != nil {
+		panic(err)
+	}
+	return count > 0
+}
+
+type SnapshotRow struct {
+	SnapshotId int64
+	RowNumber  int64
+	Cells      string
+}
+
+// canStoreRows reports whether contents can be stored as rows, which needs a header whose column
+// names are distinct, since they key each row's cells.
+func canStoreRows(contents [][]string) bool {
+	if len(contents) == 0 {
+		return false
+	}
+	seen := make(map[string]bool)
+	for _, columnName := range contents[0] {
+		if seen[columnName] {
+			return false
+		}
+		seen[columnName] = true
+	}
+	return true
+}
+
+// insertRows stores data rows for a snapshot, numbering them from firstRowNumber.
+func insertRows(executor gorp.SqlExecutor, snapshotId int64, header []string, rows [][]string,
+	firstRowNumber int64) {
+	for index, row := range rows {
+		cells := make(map[string]string)
+		for columnIndex, columnName := range header {
+			cells[columnName] = cellAt(row, columnIndex)
+		}
+		encodedCells, err := json.Marshal(cells)
+		if err != nil {
+			panic(err)
+		}
+		_, err = executor.Exec(
+			"INSERT INTO SnapshotRow (SnapshotId, RowNumber, Cells) VALUES (?, ?, ?)",
+			snapshotId, firstRowNumber+int64(index), string(encodedCells),
+		)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func nextRowNumber(executor gorp.SqlExecutor, snapshotId int64) int64 {
+	rowNumber, err := executor.SelectInt(
+		"SELECT COALESCE(MAX(RowNumber), 0) + 1 FROM SnapshotRow WHERE SnapshotId = ?", snapshotId,
+	)
+	if err != nil {
+		panic(err)
+	}
+	return rowNumber
+}
+
+// loadRows reads a snapshot's data rows back, with cells in header order.
+func loadRows(executor gorp.SqlExecutor, snapshotId int64, header []string) [][]string {
+	var storedRows []SnapshotRow
+	_, err := executor.Select(
+		&storedRows, "SELECT * FROM SnapshotRow WHERE SnapshotId = ? ORDER BY RowNumber", snapshotId,
+	)
+	if err != nil {
+		panic(err)
+	}
+	rows := make([][]string, 0, len(storedRows))
+	for _, storedRow := range storedRows {
+		var cells map[string]string
+		if err = json.Unmarshal([]byte(storedRow.Cells), &cells); err != nil {
+			panic(err)
+		}
+		row := make([]string, len(header))
+		for index, columnName := range header {
+			row[index] = cells[columnName]
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
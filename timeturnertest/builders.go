@@ -0,0 +1,110 @@
+package timeturnertest
+
+import (
+	"github.com/gostevehoward/timeturner"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Clock is a deterministic clock for a database's nowFunc. It only moves when told to.
+type Clock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+func (clock *Clock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+func (clock *Clock) Advance(duration time.Duration) time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = clock.now.Add(duration)
+	return clock.now
+}
+
+func (clock *Clock) Set(now time.Time) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = now
+}
+
+// ContentsBuilder builds snapshot contents a row at a time:
+//
+//	contents := timeturnertest.Contents("pid", "command").Row("1", "init").Build()
+type ContentsBuilder struct {
+	rows [][]string
+}
+
+func Contents(header ...string) *ContentsBuilder {
+	return &ContentsBuilder{[][]string{header}}
+}
+
+func (builder *ContentsBuilder) Row(cells ...string) *ContentsBuilder {
+	builder.rows = append(builder.rows, cells)
+	return builder
+}
+
+func (builder *ContentsBuilder) Build() [][]string {
+	return builder.rows
+}
+
+// RequestBuilder builds the RequestInfo a Presenter handles:
+//
+//	request := timeturnertest.Request(timestamp).Snapshot("host1", "processes").Form("sort", "pid")
+//	presenter := timeturner.Presenter{Database: database, RequestInfo: request.Build()}
+type RequestBuilder struct {
+	requestInfo timeturner.RequestInfo
+}
+
+func Request(timestamp time.Time) *RequestBuilder {
+	return &RequestBuilder{
+		timeturner.RequestInfo{
+			Vars:      make(map[string]string),
+			Timestamp: timestamp,
+			Form:      make(map[string]string),
+			Header:    make(http.Header),
+		},
+	}
+}
+
+func (builder *RequestBuilder) Var(name string, value string) *RequestBuilder {
+	builder.requestInfo.Vars[name] = value
+	return builder
+}
+
+// Snapshot sets the vars naming a snapshot, as the snapshot routes do.
+func (builder *RequestBuilder) Snapshot(hostname string, title string) *RequestBuilder {
+	return builder.Var("hostname", hostname).Var("title", title)
+}
+
+func (builder *RequestBuilder) Form(name string, value string) *RequestBuilder {
+	builder.requestInfo.Form[name] = value
+	return builder
+}
+
+func (builder *RequestBuilder) Header(name string, value string) *RequestBuilder {
+	builder.requestInfo.Header.Set(name, value)
+	return builder
+}
+
+func (builder *RequestBuilder) Body(body string) *RequestBuilder {
+	builder.requestInfo.Body = body
+	return builder
+}
+
+func (builder *RequestBuilder) Identity(identity string) *RequestBuilder {
+	builder.requestInfo.Identity = identity
+	return builder
+}
+
+func (builder *RequestBuilder) Build() timeturner.RequestInfo {
+	return builder.requestInfo
+}
@@ -0,0 +1,704 @@
+// Package timeturnertest provides an in-memory timeturner.Database and helpers for building test
+// data, for tests of code built on timeturner and for running a server without a database file.
+package timeturnertest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"github.com/gostevehoward/timeturner"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MEMORY_CODEC is the codec reported in a MemoryDatabase's storage stats.
+const MEMORY_CODEC = "memory"
+
+type snapshotKey struct {
+	unixTimestamp int64
+	hostname      string
+	title         string
+}
+
+type storedSnapshot struct {
+	snapshot  timeturner.Snapshot
+	revisions []string
+}
+
+// MemoryDatabase implements timeturner.Database in memory, with the same behavior as the SQLite
+// implementation: conflict modes, versions, appends, deletes, the audit log, and retention and
+// compaction under a timeturner.RetentionPolicy. It's safe for concurrent use.
+type MemoryDatabase struct {
+	nowFunc          func() time.Time
+	lock             sync.Mutex
+	retention        timeturner.RetentionPolicy
+	metrics          *timeturner.Metrics
+	snapshots        map[snapshotKey]*storedSnapshot
+	auditEntries     []timeturner.AuditEntry
+	pins             []timeturner.Pin
+	annotations      []timeturner.Annotation
+	hostUsage        map[string]timeturner.HostUsage
+	nextId           int64
+	nextPinId        int64
+	nextAnnotationId int64
+}
+
+func NewMemoryDatabase(nowFunc func() time.Time) *MemoryDatabase {
+	return &MemoryDatabase{
+		nowFunc:          nowFunc,
+		retention:        timeturner.DefaultRetentionPolicy,
+		metrics:          timeturner.NewMetrics(),
+		snapshots:        make(map[snapshotKey]*storedSnapshot),
+		hostUsage:        make(map[string]timeturner.HostUsage),
+		nextId:           1,
+		nextPinId:        1,
+		nextAnnotationId: 1,
+	}
+}
+
+func dumpCsv(contents [][]string) string {
+	var buffer bytes.Buffer
+	if err := csv.NewWriter(&buffer).WriteAll(contents); err != nil {
+		panic(err)
+	}
+	return buffer.String()
+}
+
+func hashContents(csvContents string) string {
+	hash := sha256.Sum256([]byte(csvContents))
+	return hex.EncodeToString(hash[:])
+}
+
+func isSameHeader(snapshot timeturner.Snapshot, header []string) bool {
+	contents := snapshot.Contents()
+	if len(contents) == 0 {
+		return len(header) == 0
+	}
+	if len(contents[0]) != len(header) {
+		return false
+	}
+	for index, columnName := range contents[0] {
+		if columnName != header[index] {
+			return false
+		}
+	}
+	return true
+}
+
+func (stored *storedSnapshot) setContents(csvContents string) {
+	stored.snapshot.CsvContents = csvContents
+	stored.snapshot.Codec = timeturner.NO_CODEC
+	stored.snapshot.ContentLength = int64(len(csvContents))
+	stored.snapshot.ContentHash = hashContents(csvContents)
+}
+
+func (database *MemoryDatabase) isPinned(snapshot timeturner.Snapshot) bool {
+	for _, pin := range database.pins {
+		if pin.Covers(snapshot) {
+			return true
+		}
+	}
+	return false
+}
+
+// UseRetentionPolicy changes which snapshots Compact keeps, like
+// TimeturnerDatabase.UseRetentionPolicy.
+func (database *MemoryDatabase) UseRetentionPolicy(policy timeturner.RetentionPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	database.retention = policy
+	return nil
+}
+
+// UseMetrics counts the snapshots deleted by the retention policy in the given metrics.
+func (database *MemoryDatabase) UseMetrics(metrics *timeturner.Metrics) {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	database.metrics = metrics
+}
+
+// deleteExpiredSnapshots deletes unpinned snapshots past the retention policy's MaxAge and returns
+// how many there were. The lock must be held.
+func (database *MemoryDatabase) deleteExpiredSnapshots(now time.Time) int64 {
+	var deleted int64
+	for key, stored := range database.snapshots {
+		if database.retention.IsExpired(stored.snapshot.Timestamp(), now) &&
+			!database.isPinned(stored.snapshot) {
+			delete(database.snapshots, key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// downsample deletes the unpinned snapshots the retention policy downsamples to windows of the
+// given length that have an earlier snapshot of the same host and title in the same window, and
+// returns how many there were. The lock must be held.
+func (database *MemoryDatabase) downsample(window time.Duration, now time.Time) int64 {
+	type windowKey struct {
+		hostname string
+		title    string
+		window   int64
+	}
+	windowSeconds := int64(window / time.Second)
+	keyFor := func(key snapshotKey) windowKey {
+		return windowKey{key.hostname, key.title, key.unixTimestamp / windowSeconds}
+	}
+	earliest := make(map[windowKey]int64)
+	for key := range database.snapshots {
+		if timestamp, ok := earliest[keyFor(key)]; !ok || key.unixTimestamp < timestamp {
+			earliest[keyFor(key)] = key.unixTimestamp
+		}
+	}
+	var deleted int64
+	for key, stored := range database.snapshots {
+		isDownsampled := database.retention.DownsampleWindow(stored.snapshot.Timestamp(), now) ==
+			window && earliest[keyFor(key)] < key.unixTimestamp
+		if isDownsampled && !database.isPinned(stored.snapshot) {
+			delete(database.snapshots, key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (database *MemoryDatabase) cleanOldSnapshots() {
+	database.metrics.RetentionDeleted(database.deleteExpiredSnapshots(database.nowFunc()))
+}
+
+// Compact applies the retention policy like TimeturnerDatabase.Compact.
+func (database *MemoryDatabase) Compact() int64 {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	now := database.nowFunc()
+	deleted := database.deleteExpiredSnapshots(now)
+	deleted += database.downsample(time.Hour, now)
+	deleted += database.downsample(10*time.Minute, now)
+	database.metrics.RetentionDeleted(deleted)
+	return deleted
+}
+
+// addAuditEntry stores the entry, stamped with the current time. The lock must be held.
+func (database *MemoryDatabase) addAuditEntry(entry timeturner.AuditEntry) {
+	entry.Id = int64(len(database.auditEntries)) + 1
+	entry.UnixTimestamp = database.nowFunc().Unix()
+	database.auditEntries = append(database.auditEntries, entry)
+}
+
+// createSnapshot stores a new snapshot and audits it. The lock must be held.
+func (database *MemoryDatabase) createSnapshot(key snapshotKey, contents [][]string,
+	actor timeturner.Actor) {
+	stored := &storedSnapshot{
+		snapshot: timeturner.Snapshot{
+			Id:            database.nextId,
+			UnixTimestamp: key.unixTimestamp,
+			Hostname:      key.hostname,
+			Title:         key.title,
+		},
+	}
+	database.nextId++
+	stored.setContents(dumpCsv(contents))
+	database.snapshots[key] = stored
+	entry := actor.Audit(timeturner.CreateAction, stored.snapshot)
+	entry.ContentHash = stored.snapshot.ContentHash
+	database.addAuditEntry(entry)
+	if !actor.Importing {
+		database.cleanOldSnapshots()
+	}
+}
+
+func (database *MemoryDatabase) AddSnapshot(timestamp time.Time, hostname string, title string,
+	contents [][]string, onConflict timeturner.ConflictMode,
+	actor timeturner.Actor) (version int64, err error) {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+
+	key := snapshotKey{timestamp.Unix(), hostname, title}
+	stored, alreadyExists := database.snapshots[key]
+	if !alreadyExists {
+		database.createSnapshot(key, contents, actor)
+		return 1, nil
+	}
+
+	entry := actor.Audit(timeturner.OverwriteAction, stored.snapshot)
+	csvContents := dumpCsv(contents)
+	switch onConflict {
+	case timeturner.RejectOnConflict:
+		return 0, timeturner.ErrSnapshotExists
+	case timeturner.AppendOnConflict:
+		entry.Action = timeturner.AppendAction
+		if stored.snapshot.CsvContents != "" && len(contents) > 0 {
+			if !isSameHeader(stored.snapshot, contents[0]) {
+				return 0, timeturner.ErrHeaderMismatch
+			}
+			contents = contents[1:]
+		}
+		csvContents = stored.snapshot.CsvContents + dumpCsv(contents)
+	}
+	entry.PreviousContentHash = stored.snapshot.ContentHash
+	stored.revisions = append(stored.revisions, stored.snapshot.CsvContents)
+	stored.setContents(csvContents)
+	entry.ContentHash = stored.snapshot.ContentHash
+	database.addAuditEntry(entry)
+	return int64(len(stored.revisions)) + 1, nil
+}
+
+// sortedSnapshots returns copies of the stored snapshots accepted by filter, ordered by time,
+// hostname and title.
+func (database *MemoryDatabase) sortedSnapshots(
+	filter func(snapshot timeturner.Snapshot) bool) []timeturner.Snapshot {
+	snapshots := make([]timeturner.Snapshot, 0)
+	for _, stored := range database.snapshots {
+		if filter(stored.snapshot) {
+			snapshots = append(snapshots, stored.snapshot)
+		}
+	}
+	sort.Slice(snapshots, func(i int, j int) bool {
+		if snapshots[i].UnixTimestamp != snapshots[j].UnixTimestamp {
+			return snapshots[i].UnixTimestamp < snapshots[j].UnixTimestamp
+		}
+		if snapshots[i].Hostname != snapshots[j].Hostname {
+			return snapshots[i].Hostname < snapshots[j].Hostname
+		}
+		return snapshots[i].Title < snapshots[j].Title
+	})
+	return snapshots
+}
+
+func uniqueTimestamps(snapshots []timeturner.Snapshot,
+	mapTimestamp func(time.Time) time.Time) []time.Time {
+	timestamps := make([]time.Time, 0)
+	seen := make(map[time.Time]bool)
+	for _, snapshot := range snapshots {
+		timestamp := mapTimestamp(snapshot.Timestamp())
+		if !seen[timestamp] {
+			timestamps = append(timestamps, timestamp)
+			seen[timestamp] = true
+		}
+	}
+	return timestamps
+}
+
+func (database *MemoryDatabase) GetAllDays() []time.Time {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	snapshots := database.sortedSnapshots(func(timeturner.Snapshot) bool { return true })
+	return uniqueTimestamps(snapshots, func(timestamp time.Time) time.Time {
+		year, month, day := timestamp.Date()
+		return time.Date(year, month, day, 0, 0, 0, 0, timestamp.Location())
+	})
+}
+
+func (database *MemoryDatabase) GetTimestamps(day time.Time) []time.Time {
+	return database.GetTimestampsBetween(day, day.AddDate(0, 0, 1))
+}
+
+// GetTimestampsBetween returns the times of the snapshots from start up to end, in order.
+func (database *MemoryDatabase) GetTimestampsBetween(start time.Time,
+	end time.Time) []time.Time {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	snapshots := database.sortedSnapshots(func(snapshot timeturner.Snapshot) bool {
+		return snapshot.UnixTimestamp >= start.Unix() && snapshot.UnixTimestamp < end.Unix()
+	})
+	return uniqueTimestamps(snapshots, func(timestamp time.Time) time.Time { return timestamp })
+}
+
+func (database *MemoryDatabase) GetSnapshots(timestamp time.Time) []timeturner.Snapshot {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	snapshots := database.sortedSnapshots(func(snapshot timeturner.Snapshot) bool {
+		return snapshot.UnixTimestamp == timestamp.Unix()
+	})
+	for index := range snapshots {
+		snapshots[index] = timeturner.Snapshot{
+			Id:            snapshots[index].Id,
+			UnixTimestamp: snapshots[index].UnixTimestamp,
+			Hostname:      snapshots[index].Hostname,
+			Title:         snapshots[index].Title,
+		}
+	}
+	return snapshots
+}
+
+func (database *MemoryDatabase) GetSnapshotWithContents(timestamp time.Time, hostname string,
+	title string) (snapshot timeturner.Snapshot, ok bool) {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	stored, ok := database.snapshots[snapshotKey{timestamp.Unix(), hostname, title}]
+	if !ok {
+		return timeturner.Snapshot{}, false
+	}
+	return stored.snapshot, true
+}
+
+func (database *MemoryDatabase) GetTitleSnapshots(timestamp time.Time,
+	title string) []timeturner.Snapshot {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	return database.sortedSnapshots(func(snapshot timeturner.Snapshot) bool {
+		return snapshot.UnixTimestamp == timestamp.Unix() && snapshot.Title == title
+	})
+}
+
+func (database *MemoryDatabase) GetSnapshotVersions(timestamp time.Time, hostname string,
+	title string) []int64 {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	stored, ok := database.snapshots[snapshotKey{timestamp.Unix(), hostname, title}]
+	if !ok {
+		return nil
+	}
+	versions := make([]int64, 0)
+	for version := int64(1); version <= int64(len(stored.revisions))+1; version++ {
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+func (database *MemoryDatabase) GetSnapshotVersion(timestamp time.Time, hostname string,
+	title string, version int64) (snapshot timeturner.Snapshot, ok bool) {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	stored, ok := database.snapshots[snapshotKey{timestamp.Unix(), hostname, title}]
+	if !ok || version < 1 || version > int64(len(stored.revisions))+1 {
+		return timeturner.Snapshot{}, false
+	}
+	snapshot = stored.snapshot
+	if version <= int64(len(stored.revisions)) {
+		snapshot.CsvContents = stored.revisions[version-1]
+		snapshot.ContentLength = int64(len(snapshot.CsvContents))
+		snapshot.ContentHash = hashContents(snapshot.CsvContents)
+	}
+	return snapshot, true
+}
+
+func (database *MemoryDatabase) AppendRows(timestamp time.Time, hostname string, title string,
+	contents [][]string, actor timeturner.Actor) (created bool, err error) {
+	if len(contents) == 0 {
+		return false, timeturner.ErrHeaderMismatch
+	}
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	key := snapshotKey{timestamp.Unix(), hostname, title}
+	stored, ok := database.snapshots[key]
+	if ok {
+		rows := contents[1:]
+		if stored.snapshot.CsvContents == "" {
+			rows = contents
+		} else if !isSameHeader(stored.snapshot, contents[0]) {
+			return false, timeturner.ErrHeaderMismatch
+		}
+		stored.setContents(stored.snapshot.CsvContents + dumpCsv(rows))
+		entry := actor.Audit(timeturner.AppendAction, stored.snapshot)
+		entry.ContentHash = hashContents(dumpCsv(contents[1:]))
+		database.addAuditEntry(entry)
+		return false, nil
+	}
+	database.createSnapshot(key, contents, actor)
+	return true, nil
+}
+
+func (database *MemoryDatabase) deleteSnapshots(actor timeturner.Actor,
+	filter func(snapshot timeturner.Snapshot) bool) []timeturner.Snapshot {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	deleted := database.sortedSnapshots(filter)
+	for index, snapshot := range deleted {
+		deleted[index].CsvContents = ""
+		delete(
+			database.snapshots,
+			snapshotKey{snapshot.UnixTimestamp, snapshot.Hostname, snapshot.Title},
+		)
+		entry := actor.Audit(timeturner.DeleteAction, snapshot)
+		entry.PreviousContentHash = snapshot.ContentHash
+		database.addAuditEntry(entry)
+	}
+	return deleted
+}
+
+func (database *MemoryDatabase) DeleteSnapshot(timestamp time.Time, hostname string,
+	title string, actor timeturner.Actor) (snapshot timeturner.Snapshot, ok bool) {
+	deleted := database.deleteSnapshots(actor, func(snapshot timeturner.Snapshot) bool {
+		return snapshot.UnixTimestamp == timestamp.Unix() && snapshot.Hostname == hostname &&
+			snapshot.Title == title
+	})
+	if len(deleted) == 0 {
+		return timeturner.Snapshot{}, false
+	}
+	return deleted[0], true
+}
+
+func (database *MemoryDatabase) DeleteHost(hostname string,
+	actor timeturner.Actor) []timeturner.Snapshot {
+	return database.deleteSnapshots(actor, func(snapshot timeturner.Snapshot) bool {
+		return snapshot.Hostname == hostname
+	})
+}
+
+func (database *MemoryDatabase) DeleteTitle(title string,
+	actor timeturner.Actor) []timeturner.Snapshot {
+	return database.deleteSnapshots(actor, func(snapshot timeturner.Snapshot) bool {
+		return snapshot.Title == title
+	})
+}
+
+func (database *MemoryDatabase) DeleteTimeRange(start time.Time, end time.Time,
+	actor timeturner.Actor) []timeturner.Snapshot {
+	return database.deleteSnapshots(actor, func(snapshot timeturner.Snapshot) bool {
+		return snapshot.UnixTimestamp >= start.Unix() && snapshot.UnixTimestamp < end.Unix()
+	})
+}
+
+func (database *MemoryDatabase) AddAuditEntry(entry timeturner.AuditEntry) {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	database.addAuditEntry(entry)
+}
+
+// GetAuditEntries returns up to limit entries, newest first.
+func (database *MemoryDatabase) GetAuditEntries(limit int) []timeturner.AuditEntry {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	entries := append([]timeturner.AuditEntry{}, database.auditEntries...)
+	sort.Slice(entries, func(i int, j int) bool {
+		if entries[i].UnixTimestamp != entries[j].UnixTimestamp {
+			return entries[i].UnixTimestamp > entries[j].UnixTimestamp
+		}
+		return entries[i].Id > entries[j].Id
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+// GetStorageStats reports every snapshot under MEMORY_CODEC, with identical contents stored once.
+func (database *MemoryDatabase) GetStorageStats() []timeturner.StorageStats {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	if len(database.snapshots) == 0 {
+		return nil
+	}
+	stats := timeturner.StorageStats{Codec: MEMORY_CODEC}
+	seen := make(map[string]bool)
+	for _, stored := range database.snapshots {
+		stats.SnapshotCount++
+		stats.ContentBytes += stored.snapshot.ContentLength
+		if !seen[stored.snapshot.ContentHash] {
+			stats.StoredBytes += stored.snapshot.ContentLength
+			seen[stored.snapshot.ContentHash] = true
+		}
+	}
+	return []timeturner.StorageStats{stats}
+}
+
+// GetUnchangedSince finds the snapshots at the given time whose contents haven't changed since an
+// earlier snapshot of the same host and title. Each is returned with the timestamp of the
+// earliest snapshot in that unchanged run.
+func (database *MemoryDatabase) GetUnchangedSince(timestamp time.Time) []timeturner.Snapshot {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	current := database.sortedSnapshots(func(snapshot timeturner.Snapshot) bool {
+		return snapshot.UnixTimestamp == timestamp.Unix()
+	})
+	unchanged := make([]timeturner.Snapshot, 0)
+	for _, snapshot := range current {
+		earlier := database.sortedSnapshots(func(other timeturner.Snapshot) bool {
+			return other.Hostname == snapshot.Hostname && other.Title == snapshot.Title &&
+				other.UnixTimestamp < snapshot.UnixTimestamp
+		})
+		since := snapshot.UnixTimestamp
+		for index := len(earlier) - 1; index >= 0; index-- {
+			if earlier[index].ContentHash != snapshot.ContentHash {
+				break
+			}
+			since = earlier[index].UnixTimestamp
+		}
+		if since < snapshot.UnixTimestamp {
+			unchanged = append(
+				unchanged,
+				timeturner.Snapshot{
+					UnixTimestamp: since,
+					Hostname:      snapshot.Hostname,
+					Title:         snapshot.Title,
+				},
+			)
+		}
+	}
+	return unchanged
+}
+
+func (database *MemoryDatabase) AddPin(pin timeturner.Pin) timeturner.Pin {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	pin.Id = database.nextPinId
+	pin.UnixTimestamp = database.nowFunc().Unix()
+	database.nextPinId++
+	database.pins = append(database.pins, pin)
+	return pin
+}
+
+// GetPins returns every pin, most recently pinned times first.
+func (database *MemoryDatabase) GetPins() []timeturner.Pin {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	pins := append([]timeturner.Pin{}, database.pins...)
+	sort.Slice(pins, func(i int, j int) bool {
+		if pins[i].StartUnixTimestamp != pins[j].StartUnixTimestamp {
+			return pins[i].StartUnixTimestamp > pins[j].StartUnixTimestamp
+		}
+		return pins[i].Id > pins[j].Id
+	})
+	return pins
+}
+
+func (database *MemoryDatabase) DeletePin(id int64) (pin timeturner.Pin, ok bool) {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	for index, pin := range database.pins {
+		if pin.Id == id {
+			database.pins = append(database.pins[:index], database.pins[index+1:]...)
+			return pin, true
+		}
+	}
+	return timeturner.Pin{}, false
+}
+
+func (database *MemoryDatabase) GetHostUsage(day time.Time) []timeturner.HostUsage {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	var usage []timeturner.HostUsage
+	for hostname, hostUsage := range database.hostUsage {
+		if hostUsage.Day.Before(day) {
+			delete(database.hostUsage, hostname)
+		} else if hostUsage.Day.Equal(day) {
+			usage = append(usage, hostUsage)
+		}
+	}
+	sort.Slice(usage, func(i int, j int) bool { return usage[i].Hostname < usage[j].Hostname })
+	return usage
+}
+
+func (database *MemoryDatabase) SaveHostUsage(usage timeturner.HostUsage) {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	database.hostUsage[usage.Hostname] = usage
+}
+
+func (database *MemoryDatabase) AddAnnotation(
+	annotation timeturner.Annotation) timeturner.Annotation {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	annotation.Id = database.nextAnnotationId
+	annotation.UnixTimestamp = database.nowFunc().Unix()
+	database.nextAnnotationId++
+	database.annotations = append(database.annotations, annotation)
+	return annotation
+}
+
+func (database *MemoryDatabase) findAnnotation(id int64) int {
+	for index, annotation := range database.annotations {
+		if annotation.Id == id {
+			return index
+		}
+	}
+	return -1
+}
+
+func (database *MemoryDatabase) UpdateAnnotation(annotation timeturner.Annotation) bool {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	index := database.findAnnotation(annotation.Id)
+	if index < 0 {
+		return false
+	}
+	stored := &database.annotations[index]
+	stored.StartUnixTimestamp = annotation.StartUnixTimestamp
+	stored.EndUnixTimestamp = annotation.EndUnixTimestamp
+	stored.Text = annotation.Text
+	return true
+}
+
+func (database *MemoryDatabase) GetAnnotation(id int64) (
+	annotation timeturner.Annotation, ok bool) {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	index := database.findAnnotation(id)
+	if index < 0 {
+		return timeturner.Annotation{}, false
+	}
+	return database.annotations[index], true
+}
+
+func (database *MemoryDatabase) DeleteAnnotation(id int64) (
+	annotation timeturner.Annotation, ok bool) {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	index := database.findAnnotation(id)
+	if index < 0 {
+		return timeturner.Annotation{}, false
+	}
+	annotation = database.annotations[index]
+	database.annotations = append(database.annotations[:index], database.annotations[index+1:]...)
+	return annotation, true
+}
+
+// filterAnnotations returns the annotations accepted by filter, sorted by start and then Id.
+func (database *MemoryDatabase) filterAnnotations(
+	filter func(annotation timeturner.Annotation) bool) []timeturner.Annotation {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	annotations := make([]timeturner.Annotation, 0)
+	for _, annotation := range database.annotations {
+		if filter(annotation) {
+			annotations = append(annotations, annotation)
+		}
+	}
+	sort.Slice(annotations, func(i int, j int) bool {
+		if annotations[i].StartUnixTimestamp != annotations[j].StartUnixTimestamp {
+			return annotations[i].StartUnixTimestamp < annotations[j].StartUnixTimestamp
+		}
+		return annotations[i].Id < annotations[j].Id
+	})
+	return annotations
+}
+
+// GetAnnotations returns the annotations overlapping start (inclusive) to end (exclusive), in
+// order of their start.
+func (database *MemoryDatabase) GetAnnotations(start time.Time,
+	end time.Time) []timeturner.Annotation {
+	return database.filterAnnotations(func(annotation timeturner.Annotation) bool {
+		return annotation.StartUnixTimestamp < end.Unix() &&
+			annotation.EndUnixTimestamp > start.Unix()
+	})
+}
+
+// SearchAnnotations returns the annotations whose text contains the query, ignoring case, latest
+// windows first.
+func (database *MemoryDatabase) SearchAnnotations(query string) []timeturner.Annotation {
+	query = strings.ToLower(query)
+	annotations := database.filterAnnotations(func(annotation timeturner.Annotation) bool {
+		return strings.Contains(strings.ToLower(annotation.Text), query)
+	})
+	for i, j := 0, len(annotations)-1; i < j; i, j = i+1, j-1 {
+		annotations[i], annotations[j] = annotations[j], annotations[i]
+	}
+	return annotations
+}
+
+// Ping always succeeds, since there's nothing to connect to.
+func (database *MemoryDatabase) Ping() error {
+	return nil
+}
+
+// PendingMigrations is always empty, since there's no schema to migrate.
+func (database *MemoryDatabase) PendingMigrations() []timeturner.Migration {
+	return nil
+}
@@ -0,0 +1,368 @@
+package timeturnertest
+
+import (
+	"database/sql"
+	"github.com/gostevehoward/timeturner"
+	_ "github.com/mattn/go-sqlite3"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2013, 10, 6, 0, 0, 0, 0, time.Local)
+
+// forEachDatabase runs a test against both a MemoryDatabase and the SQLite database, so the two
+// stay interchangeable.
+func forEachDatabase(t *testing.T,
+	test func(t *testing.T, clock *Clock, database timeturner.Database)) {
+	t.Run("memory", func(t *testing.T) {
+		clock := NewClock(start)
+		test(t, clock, NewMemoryDatabase(clock.Now))
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		connection, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer connection.Close()
+		connection.SetMaxOpenConns(1)
+		clock := NewClock(start)
+		test(t, clock, timeturner.InitializeDatabase(connection, clock.Now, false))
+	})
+}
+
+func TestConflictModesAndVersions(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, clock *Clock, database timeturner.Database) {
+		first := Contents("query").Row("a").Build()
+		version, err := database.AddSnapshot(start, "host1", "queries", first,
+			timeturner.RejectOnConflict, timeturner.Actor{})
+		if version != 1 || err != nil {
+			t.Fatalf("Failed to add snapshot: %d, %v", version, err)
+		}
+		_, err = database.AddSnapshot(start, "host1", "queries", first, timeturner.RejectOnConflict,
+			timeturner.Actor{})
+		if err != timeturner.ErrSnapshotExists {
+			t.Fatalf("Expected ErrSnapshotExists, got %v", err)
+		}
+		version, _ = database.AddSnapshot(start, "host1", "queries",
+			Contents("query").Row("b").Build(), timeturner.AppendOnConflict, timeturner.Actor{})
+		if version != 2 {
+			t.Fatalf("Unexpected version after append: %d", version)
+		}
+		_, err = database.AddSnapshot(start, "host1", "queries", Contents("other").Build(),
+			timeturner.AppendOnConflict, timeturner.Actor{})
+		if err != timeturner.ErrHeaderMismatch {
+			t.Fatalf("Expected ErrHeaderMismatch, got %v", err)
+		}
+		version, _ = database.AddSnapshot(start, "host1", "queries",
+			Contents("query").Row("c").Build(), timeturner.OverwriteOnConflict, timeturner.Actor{})
+		if version != 3 {
+			t.Fatalf("Unexpected version after overwrite: %d", version)
+		}
+
+		versions := database.GetSnapshotVersions(start, "host1", "queries")
+		if len(versions) != 3 {
+			t.Fatalf("Unexpected versions: %v", versions)
+		}
+		expectedContents := []string{"query\na\n", "query\na\nb\n", "query\nc\n"}
+		for index, expected := range expectedContents {
+			snapshot, ok := database.GetSnapshotVersion(start, "host1", "queries", int64(index+1))
+			if !ok || snapshot.CsvContents != expected {
+				t.Fatalf("Unexpected version %d: %q, %v", index+1, snapshot.CsvContents, ok)
+			}
+		}
+		if _, ok := database.GetSnapshotVersion(start, "host1", "queries", 4); ok {
+			t.Fatalf("Found nonexistent version")
+		}
+	})
+}
+
+func TestAppendingToEmptySnapshots(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, clock *Clock, database timeturner.Database) {
+		for _, title := range []string{"queries", "processes"} {
+			database.AddSnapshot(start, "host1", title, [][]string{}, timeturner.RejectOnConflict,
+				timeturner.Actor{})
+		}
+		_, err := database.AddSnapshot(start, "host1", "queries", [][]string{},
+			timeturner.AppendOnConflict, timeturner.Actor{})
+		if entries := database.GetAuditEntries(1); err != nil ||
+			entries[0].Action != timeturner.AppendAction {
+			t.Fatalf("Expected an empty append to be audited as one: %v, %v", entries, err)
+		}
+		_, err = database.AddSnapshot(start, "host1", "queries", Contents("query").Row("a").Build(),
+			timeturner.AppendOnConflict, timeturner.Actor{})
+		snapshot, _ := database.GetSnapshotWithContents(start, "host1", "queries")
+		if err != nil || snapshot.CsvContents != "query\na\n" {
+			t.Fatalf("Unexpected append to an empty snapshot: %q, %v", snapshot.CsvContents, err)
+		}
+		_, err = database.AppendRows(start, "host1", "processes",
+			Contents("pid").Row("1").Build(), timeturner.Actor{})
+		snapshot, _ = database.GetSnapshotWithContents(start, "host1", "processes")
+		if err != nil || snapshot.CsvContents != "pid\n1\n" {
+			t.Fatalf("Unexpected rows appended to an empty snapshot: %q, %v",
+				snapshot.CsvContents, err)
+		}
+	})
+}
+
+func TestAppendRows(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, clock *Clock, database timeturner.Database) {
+		created, err := database.AppendRows(start, "host1", "slow queries",
+			Contents("query").Row("a").Build(), timeturner.Actor{})
+		if !created || err != nil {
+			t.Fatalf("Failed to create snapshot by appending: %v, %v", created, err)
+		}
+		created, err = database.AppendRows(start, "host1", "slow queries",
+			Contents("query").Row("b").Build(), timeturner.Actor{})
+		if created || err != nil {
+			t.Fatalf("Failed to append to snapshot: %v, %v", created, err)
+		}
+		snapshot, _ := database.GetSnapshotWithContents(start, "host1", "slow queries")
+		if snapshot.CsvContents != "query\na\nb\n" {
+			t.Fatalf("Unexpected contents after append: %q", snapshot.CsvContents)
+		}
+		versions := database.GetSnapshotVersions(start, "host1", "slow queries")
+		if len(versions) != 1 {
+			t.Fatalf("Appending rows created revisions: %v", versions)
+		}
+	})
+}
+
+func TestListingAndDeletes(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, clock *Clock, database timeturner.Database) {
+		contents := Contents("column").Row("value").Build()
+		for _, timestamp := range []time.Time{start, start.Add(time.Hour), start.AddDate(0, 0, 1)} {
+			for _, hostname := range []string{"host2", "host1"} {
+				database.AddSnapshot(timestamp, hostname, "processes", contents,
+					timeturner.OverwriteOnConflict, timeturner.Actor{})
+			}
+		}
+
+		if days := database.GetAllDays(); len(days) != 2 || !days[1].Equal(start.AddDate(0, 0, 1)) {
+			t.Fatalf("Unexpected days: %v", days)
+		}
+		if timestamps := database.GetTimestamps(start); len(timestamps) != 2 {
+			t.Fatalf("Unexpected timestamps: %v", timestamps)
+		}
+		snapshots := database.GetSnapshots(start)
+		if len(snapshots) != 2 || snapshots[0].Hostname != "host1" || snapshots[0].CsvContents != "" {
+			t.Fatalf("Unexpected snapshots: %v", snapshots)
+		}
+		snapshots = database.GetTitleSnapshots(start, "processes")
+		if len(snapshots) != 2 || snapshots[0].Hostname != "host1" ||
+			snapshots[1].CsvContents != "column\nvalue\n" {
+			t.Fatalf("Unexpected title snapshots: %v", snapshots)
+		}
+
+		if _, ok := database.DeleteSnapshot(start, "host1", "processes", timeturner.Actor{}); !ok {
+			t.Fatalf("Failed to delete snapshot")
+		}
+		if _, ok := database.GetSnapshotWithContents(start, "host1", "processes"); ok {
+			t.Fatalf("Found deleted snapshot")
+		}
+		if deleted := database.DeleteHost("host2", timeturner.Actor{}); len(deleted) != 3 {
+			t.Fatalf("Unexpected host deletion: %v", deleted)
+		}
+		deleted := database.DeleteTimeRange(start, start.Add(2*time.Hour), timeturner.Actor{})
+		if len(deleted) != 1 {
+			t.Fatalf("Unexpected time range deletion: %v", deleted)
+		}
+		if deleted := database.DeleteTitle("processes", timeturner.Actor{}); len(deleted) != 1 {
+			t.Fatalf("Unexpected title deletion: %v", deleted)
+		}
+	})
+}
+
+func TestAuditEntries(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, clock *Clock, database timeturner.Database) {
+		database.AddAuditEntry(timeturner.AuditEntry{Action: "add", Hostname: "host1"})
+		clock.Advance(time.Minute)
+		database.AddAuditEntry(timeturner.AuditEntry{Action: "delete", Hostname: "host1"})
+		database.AddAuditEntry(timeturner.AuditEntry{Action: "add", Hostname: "host2"})
+
+		entries := database.GetAuditEntries(2)
+		if len(entries) != 2 || entries[0].Hostname != "host2" || entries[1].Action != "delete" {
+			t.Fatalf("Unexpected audit entries: %v", entries)
+		}
+		if entries[0].UnixTimestamp != clock.Now().Unix() {
+			t.Fatalf("Audit entry wasn't timestamped with the clock: %v", entries[0])
+		}
+	})
+}
+
+func TestWritesAreAudited(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, clock *Clock, database timeturner.Database) {
+		actor := timeturner.Actor{Identity: "collector", SourceAddress: "10.0.0.1"}
+		first := Contents("name", "value").Row("key1", "1").Build()
+		database.AddSnapshot(start, "host1", "processes", first, timeturner.RejectOnConflict, actor)
+		second := Contents("name", "value").Row("key2", "2").Build()
+		database.AddSnapshot(start, "host1", "processes", second, timeturner.OverwriteOnConflict,
+			actor)
+		database.AddSnapshot(start, "host1", "processes", first, timeturner.AppendOnConflict, actor)
+		database.AppendRows(start, "host1", "processes", Contents("name", "value").Row("key3", "3").
+			Build(), actor)
+		database.DeleteSnapshot(start, "host1", "processes", actor)
+
+		afterOverwrite := dumpCsv(second)
+		afterAppend := "name,value\nkey2,2\nkey1,1\n"
+		afterAppendRows := afterAppend + "key3,3\n"
+		expected := []timeturner.AuditEntry{
+			{Action: timeturner.DeleteAction, PreviousContentHash: hashContents(afterAppendRows)},
+			{Action: timeturner.AppendAction, ContentHash: hashContents("key3,3\n")},
+			{
+				Action:              timeturner.AppendAction,
+				ContentHash:         hashContents(afterAppend),
+				PreviousContentHash: hashContents(afterOverwrite),
+			},
+			{
+				Action:              timeturner.OverwriteAction,
+				ContentHash:         hashContents(afterOverwrite),
+				PreviousContentHash: hashContents(dumpCsv(first)),
+			},
+			{Action: timeturner.CreateAction, ContentHash: hashContents(dumpCsv(first))},
+		}
+		entries := database.GetAuditEntries(10)
+		if len(entries) != len(expected) {
+			t.Fatalf("Unexpected audit entries: %v", entries)
+		}
+		for i, entry := range entries {
+			isOk := entry.Action == expected[i].Action &&
+				entry.ContentHash == expected[i].ContentHash &&
+				entry.PreviousContentHash == expected[i].PreviousContentHash &&
+				entry.Identity == actor.Identity && entry.SourceAddress == actor.SourceAddress &&
+				entry.Hostname == "host1" && entry.Title == "processes" &&
+				entry.SnapshotUnixTimestamp == start.Unix()
+			if !isOk {
+				t.Errorf("Expected %v, got %v", expected[i], entry)
+			}
+		}
+	})
+}
+
+func TestUnchangedSinceAndRetention(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, clock *Clock, database timeturner.Database) {
+		same := Contents("column").Row("same").Build()
+		for hours := 0; hours < 3; hours++ {
+			timestamp := start.Add(time.Duration(hours) * time.Hour)
+			database.AddSnapshot(timestamp, "host1", "queries", same, timeturner.OverwriteOnConflict,
+				timeturner.Actor{})
+		}
+		unchanged := database.GetUnchangedSince(start.Add(2 * time.Hour))
+		if len(unchanged) != 1 || unchanged[0].UnixTimestamp != start.Unix() {
+			t.Fatalf("Unexpected unchanged snapshots: %v", unchanged)
+		}
+
+		database.AddSnapshot(start, "host2", "queries", same, timeturner.OverwriteOnConflict,
+			timeturner.Actor{})
+		database.AddPin(timeturner.Pin{
+			StartUnixTimestamp: start.Unix(), EndUnixTimestamp: start.Unix() + 1, Hostname: "host2",
+		})
+
+		later := clock.Advance(15 * 24 * time.Hour)
+		database.AddSnapshot(later, "host1", "queries", same, timeturner.OverwriteOnConflict,
+			timeturner.Actor{})
+		if days := database.GetAllDays(); len(days) != 2 {
+			t.Fatalf("Unexpected days after cleanup: %v", days)
+		}
+		if kept := database.GetSnapshots(start); len(kept) != 1 || kept[0].Hostname != "host2" {
+			t.Fatalf("Unexpected snapshots after cleanup: %v", kept)
+		}
+	})
+}
+
+// compactingDatabase is implemented by both databases, but isn't part of timeturner.Database.
+type compactingDatabase interface {
+	UseRetentionPolicy(policy timeturner.RetentionPolicy) error
+	Compact() int64
+}
+
+func TestCompact(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, clock *Clock, database timeturner.Database) {
+		compacting := database.(compactingDatabase)
+		day := 24 * time.Hour
+		err := compacting.UseRetentionPolicy(timeturner.RetentionPolicy{
+			KeepAllFor: time.Hour, KeepTenMinutelyFor: day, MaxAge: 3 * day,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := start.Add(2 * day)
+		tenMinutely := now.Add(-12 * time.Hour)
+		timestamps := []time.Time{
+			start, start.Add(5 * time.Minute), start.Add(7 * time.Minute),
+			start.Add(65 * time.Minute), tenMinutely, tenMinutely.Add(3 * time.Minute),
+			tenMinutely.Add(11 * time.Minute), now.Add(-30 * time.Minute),
+			now.Add(-29 * time.Minute), start.Add(-2 * day),
+		}
+		for _, timestamp := range timestamps {
+			database.AddSnapshot(timestamp, "host1", "queries", Contents("query").Build(),
+				timeturner.OverwriteOnConflict, timeturner.Actor{})
+		}
+		database.AddPin(timeturner.Pin{
+			StartUnixTimestamp: timestamps[2].Unix(), EndUnixTimestamp: timestamps[2].Unix() + 1,
+		})
+
+		clock.Set(now)
+		if deleted := compacting.Compact(); deleted != 3 {
+			t.Fatalf("Unexpected deletion count %d", deleted)
+		}
+		if deleted := compacting.Compact(); deleted != 0 {
+			t.Fatalf("Compacting twice deleted %d snapshots", deleted)
+		}
+		for index, timestamp := range timestamps {
+			_, ok := database.GetSnapshotWithContents(timestamp, "host1", "queries")
+			if expected := index != 1 && index != 5 && index != 9; ok != expected {
+				t.Errorf("Expected snapshot at %v to be kept: %v", timestamp, expected)
+			}
+		}
+	})
+}
+
+func TestAnnotations(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, clock *Clock, database timeturner.Database) {
+		failover := database.AddAnnotation(timeturner.Annotation{
+			StartUnixTimestamp: start.Unix(), EndUnixTimestamp: start.Add(time.Hour).Unix(),
+			Text: "DB failover",
+		})
+		database.AddAnnotation(timeturner.Annotation{
+			StartUnixTimestamp: start.Add(time.Hour).Unix(),
+			EndUnixTimestamp:   start.Add(2 * time.Hour).Unix(),
+			Text:               "Deploy",
+		})
+		if failover.UnixTimestamp != clock.Now().Unix() {
+			t.Fatalf("Annotation wasn't timestamped with the clock: %v", failover)
+		}
+		overlapping := database.GetAnnotations(start.Add(time.Minute), start.Add(time.Hour))
+		if len(overlapping) != 1 || overlapping[0].Id != failover.Id {
+			t.Fatalf("Unexpected overlapping annotations: %v", overlapping)
+		}
+		found := database.SearchAnnotations("db")
+		if len(found) != 1 || found[0].Id != failover.Id {
+			t.Fatalf("Unexpected search results: %v", found)
+		}
+		if all := database.SearchAnnotations(""); len(all) != 2 || all[0].Text != "Deploy" {
+			t.Fatalf("Unexpected annotations: %v", all)
+		}
+		if _, ok := database.DeleteAnnotation(failover.Id); !ok {
+			t.Fatalf("Failed to delete annotation")
+		}
+		if database.UpdateAnnotation(failover) {
+			t.Fatalf("Updated a deleted annotation")
+		}
+	})
+}
+
+func TestPresenterWithMemoryDatabase(t *testing.T) {
+	database := NewMemoryDatabase(NewClock(start).Now)
+	database.AddSnapshot(start, "host1", "processes",
+		Contents("pid", "command").Row("10", "sshd").Row("9", "init").Build(),
+		timeturner.OverwriteOnConflict, timeturner.Actor{})
+
+	presenter := timeturner.Presenter{
+		Database:    database,
+		RequestInfo: Request(start).Snapshot("host1", "processes").Form("sort", "command").Build(),
+	}
+	_, _, data, ok := presenter.ViewSnapshot()
+	if !ok || len(data) != 2 || data[0][1] != "init" {
+		t.Fatalf("Unexpected snapshot data: %v, %v", data, ok)
+	}
+}
@@ -0,0 +1,114 @@
+package timeturner
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// LoadTLSConfig reads a PEM certificate and key to serve with. If clientCaFile is set, clients
+// presenting a certificate must have one signed by a CA in that file; clients without one are
+// still served, and ClientCertPolicy decides what they can write.
+func LoadTLSConfig(certFile string, keyFile string, clientCaFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCaFile != "" {
+		caPem, err := ioutil.ReadFile(clientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("No certificates found in %s", clientCaFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// ClientCertPolicy decides which hosts' snapshots a client may write or delete. When Required, only
+// clients with a verified TLS certificate may write snapshots or delete a host's snapshots, each
+// for the hostnames its certificate's Common Name maps to in Hostnames. A CN not in Hostnames may
+// only change snapshots for the hostname equal to it.
+type ClientCertPolicy struct {
+	Required  bool
+	Hostnames map[string][]string
+}
+
+func NewClientCertPolicy() *ClientCertPolicy {
+	return &ClientCertPolicy{false, make(map[string][]string)}
+}
+
+// LoadClientHostnames reads lines of the form "<common name> <hostname>,<hostname>". Blank lines
+// and lines starting with # are ignored.
+func LoadClientHostnames(reader io.Reader) (map[string][]string, error) {
+	hostnames := make(map[string][]string)
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Line %d: expected common name and hostnames", lineNumber)
+		}
+		hostnames[fields[0]] = append(hostnames[fields[0]], splitList(fields[1])...)
+	}
+	return hostnames, scanner.Err()
+}
+
+func LoadClientHostnamesFile(path string) (map[string][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return LoadClientHostnames(file)
+}
+
+// clientCommonName returns the Common Name of the request's verified client certificate, if any.
+func clientCommonName(request *http.Request) (commonName string, ok bool) {
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 ||
+		len(request.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return request.TLS.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+func (policy *ClientCertPolicy) allowedHostnames(commonName string) []string {
+	if hostnames, ok := policy.Hostnames[commonName]; ok {
+		return hostnames
+	}
+	return []string{commonName}
+}
+
+// AuthorizeHostname returns the Common Name of the request's client certificate, or an error if
+// it has none or the certificate doesn't allow changing snapshots for the hostname.
+func (policy *ClientCertPolicy) AuthorizeHostname(request *http.Request, hostname string) (
+	commonName string, err error) {
+	commonName, ok := clientCommonName(request)
+	if !ok {
+		return "", errors.New("a verified client certificate is required")
+	}
+	for _, allowed := range policy.allowedHostnames(commonName) {
+		if allowed == hostname {
+			return commonName, nil
+		}
+	}
+	return commonName, fmt.Errorf("client certificate for %s can't change snapshots for %s",
+		commonName, hostname)
+}
@@ -0,0 +1,189 @@
+package timeturner
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPem     []byte
+	keyPem      []byte
+}
+
+// makeTestCertificate creates a certificate signed by the parent, or a self-signed CA if the
+// parent is nil.
+func makeTestCertificate(t *testing.T, commonName string, parent *testCertificate) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCertificate{
+		certificate,
+		key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func writeTestFile(t *testing.T, directory string, name string, contents []byte) string {
+	path := filepath.Join(directory, name)
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadClientHostnames(t *testing.T) {
+	hostnames, err := LoadClientHostnames(strings.NewReader(`
+# common name  hostnames
+collector host1,host2
+`))
+	if err != nil {
+		t.Fatalf("Got error loading client hostnames: %v", err)
+	}
+	policy := ClientCertPolicy{true, hostnames}
+	if allowed := policy.allowedHostnames("collector"); len(allowed) != 2 || allowed[1] != "host2" {
+		t.Fatalf("Unexpected hostnames %v", allowed)
+	}
+	if allowed := policy.allowedHostnames("host3"); len(allowed) != 1 || allowed[0] != "host3" {
+		t.Fatalf("Expected a CN to map to itself by default, got %v", allowed)
+	}
+	if _, err := LoadClientHostnames(strings.NewReader("collector")); err == nil {
+		t.Fatal("No error for a line without hostnames")
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	directory := t.TempDir()
+	ca := makeTestCertificate(t, "Test CA", nil)
+	serverCert := makeTestCertificate(t, "timeturner", &ca)
+	tlsConfig, err := LoadTLSConfig(
+		writeTestFile(t, directory, "server.pem", serverCert.certPem),
+		writeTestFile(t, directory, "server.key", serverCert.keyPem),
+		writeTestFile(t, directory, "ca.pem", ca.certPem),
+	)
+	if err != nil {
+		t.Fatalf("Failed to load TLS configuration: %v", err)
+	}
+
+	database := setUp()
+	authorizer := make(Authorizer)
+	app := MakeApp(database, authorizer)
+	// Recent enough to outlive retention, since other tests move now.
+	timePath := "/" + now.Format(DATE_FORMAT) + "/" + now.Format(TIME_FORMAT) + "/"
+	app.ClientCerts.Required = true
+	app.ClientCerts.Hostnames["collector"] = []string{"host2", "host3"}
+	server := httptest.NewUnstartedServer(app.Router)
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	send := func(client *testCertificate, method string, path string) int {
+		clientConfig := &tls.Config{RootCAs: roots}
+		if client != nil {
+			certificate, err := tls.X509KeyPair(client.certPem, client.keyPem)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConfig.Certificates = []tls.Certificate{certificate}
+		}
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		request, _ := http.NewRequest(method, server.URL+path, strings.NewReader("name\nsteve\n"))
+		if method == "DELETE" {
+			request.Header.Set("Authorization", "Bearer secret")
+		}
+		response, err := httpClient.Do(request)
+		if err != nil {
+			t.Fatalf("Failed to %v %v: %v", method, path, err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	host1 := makeTestCertificate(t, "host1", &ca)
+	collector := makeTestCertificate(t, "collector", &ca)
+	cases := []struct {
+		client   *testCertificate
+		hostname string
+		status   int
+	}{
+		{&host1, "host1", http.StatusOK},
+		{&host1, "host2", http.StatusForbidden},
+		{&collector, "host2", http.StatusOK},
+		{&collector, "host1", http.StatusForbidden},
+		{nil, "host1", http.StatusForbidden},
+	}
+	for _, testCase := range cases {
+		path := timePath + testCase.hostname + "/quotes/"
+		if status := send(testCase.client, "PUT", path); status != testCase.status {
+			t.Errorf("Expected %v writing %v, got %v", testCase.status, testCase.hostname, status)
+		}
+	}
+
+	entries := database.GetAuditEntries(10)
+	if len(entries) != 2 || entries[0].Identity != "collector" || entries[1].Identity != "host1" {
+		t.Fatalf("Expected certificate CNs as audit identities, got %v", entries)
+	}
+
+	authorizer["secret"] = AccessToken{"ops", map[Permission]bool{DeletePermission: true}}
+
+	deletes := []struct {
+		client *testCertificate
+		path   string
+		status int
+	}{
+		{&collector, timePath + "host1/quotes/", http.StatusForbidden},
+		{&collector, "/hosts/host1/", http.StatusForbidden},
+		{nil, "/hosts/host2/", http.StatusForbidden},
+		{&host1, timePath + "host1/quotes/", http.StatusOK},
+		{&collector, "/hosts/host2/", http.StatusOK},
+	}
+	for _, testCase := range deletes {
+		if status := send(testCase.client, "DELETE", testCase.path); status != testCase.status {
+			t.Errorf("Expected %v deleting %v, got %v", testCase.status, testCase.path, status)
+		}
+	}
+}
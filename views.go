@@ -1,10 +1,15 @@
 package timeturner
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
 	"html/template"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -20,19 +25,35 @@ func makeTemplateFunctions(router *mux.Router) template.FuncMap {
 		}
 		return url.String()
 	}
+	getSnapshotRouteUrl := func(routeName string, timestamp time.Time, hostname string,
+		title string, extraParameters ...string) string {
+		urlParameters := []string{
+			"date", timestamp.Format(DATE_FORMAT),
+			"time", timestamp.Format(TIME_FORMAT),
+			"hostname", hostname,
+			"title", title,
+		}
+		return getUrl(routeName, append(urlParameters, extraParameters...)...)
+	}
 	return template.FuncMap{
 		"formatDate":     func(date time.Time) string { return date.Format(DATE_FORMAT) },
 		"formatTime":     func(date time.Time) string { return date.Format(TIME_FORMAT) },
 		"formatDateTime": func(date time.Time) string { return date.Format(DATETIME_FORMAT) },
 		"getUrl":         getUrl,
 		"getSnapshotUrl": func(timestamp time.Time, hostname string, title string) string {
-			urlParameters := []string{
-				"date", timestamp.Format(DATE_FORMAT),
-				"time", timestamp.Format(TIME_FORMAT),
-				"hostname", hostname,
-				"title", title,
+			return getSnapshotRouteUrl("view snapshot", timestamp, hostname, title)
+		},
+		"getSnapshotRouteUrl": getSnapshotRouteUrl,
+		"exportFormatNames":   func() []string { return exportFormatNames },
+		"withQuery": func(baseUrl string, form map[string]string) template.URL {
+			query := make(url.Values)
+			for key, value := range form {
+				query.Set(key, value)
 			}
-			return getUrl("view snapshot", urlParameters...)
+			if len(query) == 0 {
+				return template.URL(baseUrl)
+			}
+			return template.URL(baseUrl + "?" + query.Encode())
 		},
 	}
 }
@@ -42,12 +63,28 @@ type View struct {
 	Templates *template.Template
 	Writer    http.ResponseWriter
 	Presenter Presenter
+	Metrics   *Metrics
+	Limiter   *IngestionLimiter
+}
+
+// Error responds with an error page for browsers and a JSON error for API clients, either
+// including the request ID.
+func (view View) Error(message string, statusCode int) {
+	renderError(
+		view.Templates, view.Writer, view.Presenter.RequestInfo.Header,
+		view.Presenter.RequestInfo.RequestId, statusCode, message,
+	)
+}
+
+func (view View) logError(format string, args ...interface{}) {
+	log.Printf("ERROR: Request %v: "+format+"\n",
+		append([]interface{}{view.Presenter.RequestInfo.RequestId}, args...)...)
 }
 
 func (view View) renderTemplate(templateName string, templateContext interface{}) {
 	err := view.Templates.ExecuteTemplate(view.Writer, templateName, templateContext)
 	if err != nil {
-		log.Printf("ERROR: Failed to render template %v: %v\n", templateName, err)
+		view.logError("Failed to render template %v: %v", templateName, err)
 	}
 }
 
@@ -61,39 +98,384 @@ func (view View) ListDays() {
 }
 
 type ListTimesContext struct {
-	Date       time.Time
-	Timestamps []time.Time
+	Date        time.Time
+	Timestamps  []time.Time
+	Annotations []Annotation
 }
 
 func (view View) ListTimes() {
 	date, times := view.Presenter.ListTimes()
-	view.renderTemplate("list times", ListTimesContext{date, times})
+	view.renderTemplate(
+		"list times", ListTimesContext{date, times, view.Presenter.DayAnnotations()},
+	)
 }
 
 type ListSnapshotsContext struct {
-	Timestamp time.Time
-	HostMap   map[string][]string
+	Timestamp      time.Time
+	HostMap        map[string][]string
+	Titles         []string
+	UnchangedSince map[string]map[string]time.Time
+	Annotations    []Annotation
 }
 
 func (view View) ListSnapshots() {
 	timestamp, hostMap := view.Presenter.ListHostsAndTitles()
-	view.renderTemplate("list snapshots", ListSnapshotsContext{timestamp, hostMap})
+	view.renderTemplate(
+		"list snapshots",
+		ListSnapshotsContext{
+			timestamp, hostMap, uniqueTitles(hostMap), view.Presenter.UnchangedSince(),
+			view.Presenter.TimestampAnnotations(),
+		},
+	)
 }
 
 type ViewSnapshotContext struct {
-	Snapshot Snapshot
-	Columns  []Column
-	Data     [][]string
+	Snapshot    Snapshot
+	Columns     []Column
+	Data        [][]string
+	Form        map[string]string
+	Versions    []int64
+	Version     string
+	Pins        []Pin
+	Annotations []Annotation
 }
 
 func (view View) ViewSnapshot() {
 	snapshot, columns, data, ok := view.Presenter.ViewSnapshot()
 	if !ok {
-		http.Error(view.Writer, "No such snapshot found", http.StatusNotFound)
+		view.Error("No such snapshot found", http.StatusNotFound)
+		return
+	}
+	form := view.Presenter.RequestInfo.Form
+	versions := view.Presenter.ListVersions()
+	version := form["version"]
+	if version == "" && len(versions) > 0 {
+		version = strconv.FormatInt(versions[len(versions)-1], 10)
+	}
+	view.renderTemplate(
+		"view snapshot",
+		ViewSnapshotContext{
+			snapshot, columns, data, form, versions, version,
+			view.Presenter.PinsCovering(snapshot), view.Presenter.TimestampAnnotations(),
+		},
+	)
+}
+
+type AggregateSnapshotContext struct {
+	Snapshot   Snapshot
+	GroupBy    string
+	Aggregates string
+	Columns    []Column
+	Data       [][]string
+	Form       map[string]string
+}
+
+func (view View) AggregateSnapshot() {
+	snapshot, columns, data, ok, err := view.Presenter.AggregateSnapshot()
+	if !ok {
+		view.Error("No such snapshot found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		view.Error("Failed to aggregate snapshot: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	form := view.Presenter.RequestInfo.Form
+	view.renderTemplate(
+		"aggregate snapshot",
+		AggregateSnapshotContext{snapshot, form["group"], form["agg"], columns, data, form},
+	)
+}
+
+func (view View) writeExport(snapshot Snapshot, suffix string, table [][]string) {
+	format := view.Presenter.RequestInfo.Vars["format"]
+	exportFormat, ok := exportFormats[format]
+	if !ok {
+		view.Error("Unknown export format "+format, http.StatusNotFound)
+		return
+	}
+
+	view.Writer.Header().Set("Content-Type", exportFormat.ContentType)
+	view.Writer.Header().Set(
+		"Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", exportFilename(snapshot, suffix, format)),
+	)
+	err := exportFormat.Write(view.Writer, table)
+	if err != nil {
+		view.logError("Failed to export %v as %v: %v", snapshot.Title, format, err)
+	}
+}
+
+func (view View) ExportSnapshot() {
+	snapshot, table, ok, err := view.Presenter.ExportSnapshot()
+	if !ok {
+		view.Error("No such snapshot found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		view.Error("Failed to export snapshot: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	view.writeExport(snapshot, "", table)
+}
+
+func (view View) ExportAggregate() {
+	snapshot, table, ok, err := view.Presenter.ExportAggregate()
+	if !ok {
+		view.Error("No such snapshot found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		view.Error("Failed to export aggregate: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	view.writeExport(snapshot, "-aggregate", table)
+}
+
+func (view View) countIngested() {
+	request := view.Presenter.RequestInfo
+	view.Metrics.SnapshotIngested(
+		request.Vars["hostname"], request.Vars["title"], len(request.Body),
+	)
+}
+
+// admit checks a write against its host's ingestion limits, responding with 429 Too Many Requests
+// if it's over them. Writes that then fail are refunded; see refundUnless.
+func (view View) admit(newSnapshot bool) bool {
+	request := view.Presenter.RequestInfo
+	retryAfter, err := view.Limiter.Admit(request.Vars["hostname"], len(request.Body), newSnapshot)
+	if err == nil {
+		return true
+	}
+	retryAfterSeconds := int64(math.Max(1, math.Ceil(retryAfter.Seconds())))
+	view.Writer.Header().Set("Retry-After", strconv.FormatInt(retryAfterSeconds, 10))
+	view.Error(err.Error(), http.StatusTooManyRequests)
+	return false
+}
+
+// refundUnless refunds an admitted write unless it succeeded. It's deferred so that a write
+// which panics is refunded too.
+func (view View) refundUnless(succeeded *bool, newSnapshot bool) {
+	if !*succeeded {
+		request := view.Presenter.RequestInfo
+		view.Limiter.Refund(request.Vars["hostname"], len(request.Body), newSnapshot)
 	}
-	view.renderTemplate("view snapshot", ViewSnapshotContext{snapshot, columns, data})
 }
 
 func (view View) AddSnapshot() {
-	view.Presenter.AddSnapshot()
+	if !view.admit(true) {
+		return
+	}
+	succeeded := false
+	defer view.refundUnless(&succeeded, true)
+	version, err := view.Presenter.AddSnapshot()
+	succeeded = err == nil
+	switch err {
+	case nil:
+		view.countIngested()
+		fmt.Fprintf(view.Writer, "Stored version %d\n", version)
+	case ErrSnapshotExists, ErrHeaderMismatch:
+		view.Error(err.Error(), http.StatusConflict)
+	default:
+		view.Error(err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (view View) AppendRows() {
+	if !view.admit(false) {
+		return
+	}
+	succeeded := false
+	defer view.refundUnless(&succeeded, false)
+	rowCount, err := view.Presenter.AppendRows()
+	succeeded = err == nil
+	switch err {
+	case nil:
+		view.countIngested()
+		fmt.Fprintf(view.Writer, "Appended %d rows\n", rowCount)
+	case ErrHeaderMismatch:
+		view.Error(err.Error(), http.StatusConflict)
+	default:
+		view.Error(err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (view View) writeDeleted(snapshots []Snapshot) {
+	fmt.Fprintf(view.Writer, "Deleted %d snapshots\n", len(snapshots))
+}
+
+func (view View) DeleteSnapshot() {
+	snapshot, ok := view.Presenter.DeleteSnapshot()
+	if !ok {
+		view.Error("No such snapshot found", http.StatusNotFound)
+		return
+	}
+	view.writeDeleted([]Snapshot{snapshot})
+}
+
+func (view View) DeleteHost() {
+	view.writeDeleted(view.Presenter.DeleteHost())
+}
+
+func (view View) DeleteTitle() {
+	view.writeDeleted(view.Presenter.DeleteTitle())
+}
+
+func (view View) DeleteTimeRange() {
+	snapshots, err := view.Presenter.DeleteTimeRange()
+	if err != nil {
+		view.Error("Failed to parse time range: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	view.writeDeleted(snapshots)
+}
+
+type ListPinsContext struct {
+	Pins []Pin
+}
+
+func (view View) ListPins() {
+	view.renderTemplate("pins", ListPinsContext{view.Presenter.ListPins()})
+}
+
+func (view View) AddPin() {
+	pin, err := view.Presenter.AddPin()
+	if err != nil {
+		view.Error("Failed to parse pin: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(view.Writer, "Added pin %d\n", pin.Id)
+}
+
+func (view View) DeletePin() {
+	pin, ok := view.Presenter.DeletePin()
+	if !ok {
+		view.Error("No such pin found", http.StatusNotFound)
+		return
+	}
+	fmt.Fprintf(view.Writer, "Deleted pin %d\n", pin.Id)
+}
+
+type SearchAnnotationsContext struct {
+	Query       string
+	Annotations []Annotation
+}
+
+func (view View) SearchAnnotations() {
+	query, annotations := view.Presenter.SearchAnnotations()
+	view.renderTemplate("annotations", SearchAnnotationsContext{query, annotations})
+}
+
+func (view View) ExportAnnotations() {
+	_, annotations := view.Presenter.SearchAnnotations()
+	view.Writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(view.Writer).Encode(annotations); err != nil {
+		view.logError("Failed to export annotations: %v", err)
+	}
+}
+
+type ViewAnnotationContext struct {
+	Annotation Annotation
+	Timestamps []time.Time
+}
+
+func (view View) ViewAnnotation() {
+	annotation, timestamps, ok := view.Presenter.GetAnnotation()
+	if !ok {
+		view.Error("No such annotation found", http.StatusNotFound)
+		return
+	}
+	view.renderTemplate("annotation", ViewAnnotationContext{annotation, timestamps})
+}
+
+func (view View) AddAnnotation() {
+	annotation, err := view.Presenter.AddAnnotation()
+	if err != nil {
+		view.Error("Failed to parse annotation: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(view.Writer, "Added annotation %d\n", annotation.Id)
+}
+
+func (view View) UpdateAnnotation() {
+	annotation, ok, err := view.Presenter.UpdateAnnotation()
+	if !ok {
+		view.Error("No such annotation found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		view.Error("Failed to parse annotation: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(view.Writer, "Updated annotation %d\n", annotation.Id)
+}
+
+func (view View) DeleteAnnotation() {
+	annotation, ok := view.Presenter.DeleteAnnotation()
+	if !ok {
+		view.Error("No such annotation found", http.StatusNotFound)
+		return
+	}
+	fmt.Fprintf(view.Writer, "Deleted annotation %d\n", annotation.Id)
+}
+
+type CompareHostsContext struct {
+	Timestamp time.Time
+	Title     string
+	Hosts     string
+	Hostnames []string
+	Columns   []Column
+	Data      [][]string
+}
+
+func (view View) CompareHosts() {
+	timestamp, title, hostnames, columns, data := view.Presenter.CompareHosts()
+	hosts := view.Presenter.RequestInfo.Form["hosts"]
+	view.renderTemplate(
+		"compare hosts", CompareHostsContext{timestamp, title, hosts, hostnames, columns, data},
+	)
+}
+
+type StorageStatsContext struct {
+	Stats []StorageStats
+	Total StorageStats
+}
+
+func (view View) StorageStats() {
+	stats, total := view.Presenter.StorageStats()
+	view.renderTemplate("storage stats", StorageStatsContext{stats, total})
+}
+
+type UsageContext struct {
+	Limits IngestionLimits
+	Usage  []HostUsage
+}
+
+func (view View) Usage() {
+	view.renderTemplate("usage", UsageContext{view.Limiter.Limits(), view.Limiter.Usage()})
+}
+
+func (view View) ExportMetrics() {
+	stats := view.Metrics.CachedStorageStats(func() []StorageStats {
+		stats, _ := view.Presenter.StorageStats()
+		return stats
+	})
+	view.Writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	view.Metrics.WriteText(view.Writer, stats)
+}
+
+type ListAuditEntriesContext struct {
+	Entries []AuditEntry
+}
+
+func (view View) ListAuditEntries() {
+	view.renderTemplate("audit log", ListAuditEntriesContext{view.Presenter.ListAuditEntries()})
+}
+
+func (view View) ExportAuditEntries() {
+	view.Writer.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(view.Writer).Encode(view.Presenter.ListAuditEntries())
+	if err != nil {
+		view.logError("Failed to export audit log: %v", err)
+	}
 }